@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// maintenance, when set, stops new renders: cache hits still serve but
+// misses get 503 instead of reaching the processor
+var maintenance atomic.Bool
+
+// adminAuthorized checks the request's bearer token against ADMIN_TOKEN
+func adminAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && config().AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(config().AdminToken)) == 1
+}
+
+// maintenanceHandler reports (GET) or sets (POST ?enabled=true|false) the
+// maintenance mode. Disabled unless ADMIN_TOKEN is configured.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if config().AdminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="weather-wms admin"`)
+		writeJSONException(w, http.StatusUnauthorized, "Unauthorized", "missing or invalid admin token")
+		return
+	}
+	if r.Method == http.MethodPost {
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			writeJSONException(w, http.StatusBadRequest, "InvalidParameterValue", "enabled must be true or false")
+			return
+		}
+		if maintenance.Swap(enabled) != enabled {
+			logMaintenance(enabled)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"maintenance": maintenance.Load()})
+}
+
+func logMaintenance(enabled bool) {
+	if enabled {
+		log.Printf("Maintenance mode enabled: cache misses will return 503")
+	} else {
+		log.Printf("Maintenance mode disabled")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// animateHandler renders a layer over a time range as an animated GIF:
+// /animate?LAYERS=temp_2m&BBOX=...&CRS=...&WIDTH=...&HEIGHT=...&TIME=start/end
+// Frames render concurrently on a bounded pool but are assembled in time order.
+func animateHandler(w http.ResponseWriter, r *http.Request) {
+	q := wmsParams(r.URL.RawQuery)
+
+	layer := q.Get("LAYERS")
+	li, ok := layerIndex.Layer(layer)
+	if !ok {
+		writeWMSException(w, q, http.StatusNotFound, "LayerNotDefined", fmt.Sprintf("no data for layer %q", layer))
+		return
+	}
+
+	width, _ := strconv.Atoi(q.Get("WIDTH"))
+	height, _ := strconv.Atoi(q.Get("HEIGHT"))
+	defWidth, defHeight := defaultImageSize(layer)
+	if width <= 0 {
+		width = defWidth
+	}
+	if height <= 0 {
+		height = defHeight
+	}
+	if (config().MaxWidth > 0 && width > config().MaxWidth) || (config().MaxHeight > 0 && height > config().MaxHeight) {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue",
+			fmt.Sprintf("animation size %dx%d exceeds MaxWidth/MaxHeight", width, height))
+		return
+	}
+
+	steps, err := animationSteps(li.timeSteps(), q.Get("TIME"))
+	if err != nil {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidDimensionValue", err.Error())
+		return
+	}
+	if len(steps) == 0 {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidDimensionValue", "no timesteps in the requested TIME range")
+		return
+	}
+	if config().AnimateMaxFrames > 0 && len(steps) > config().AnimateMaxFrames {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidDimensionValue",
+			fmt.Sprintf("%d frames requested, maximum is %d", len(steps), config().AnimateMaxFrames))
+		return
+	}
+
+	// Params shared by every frame
+	base := url.Values{}
+	base.Set("layer", layer)
+	base.Set("width", strconv.Itoa(width))
+	base.Set("height", strconv.Itoa(height))
+	if bb, ok := parseBBox(q.Get("BBOX")); ok {
+		minx, miny, maxx, maxy := bboxToLonLat(bb, requestCRS(q))
+		base.Set("bbox", fmt.Sprintf("%f,%f,%f,%f", minx, miny, maxx, maxy))
+	}
+	for _, p := range []string{"COLORSCALERANGE", "PALETTE", "GAMMA"} {
+		if val := q.Get(p); val != "" {
+			base.Set(strings.ToLower(p), val)
+		}
+	}
+
+	delay := 50 // hundredths of a second
+	if d, err := strconv.Atoi(q.Get("DELAY")); err == nil && d > 0 {
+		delay = d
+	}
+
+	frames, err := renderFrames(r.Context(), base, steps, width, height)
+	if err != nil {
+		writeWMSException(w, q, renderErrorStatus(w, err), "NoApplicableCode", err.Error())
+		return
+	}
+
+	anim := &gif.GIF{LoopCount: 0}
+	for _, f := range frames {
+		anim.Image = append(anim.Image, f)
+		anim.Delay = append(anim.Delay, delay)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		writeWMSException(w, q, http.StatusInternalServerError, "NoApplicableCode", fmt.Sprintf("encoding animation: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Write(buf.Bytes())
+}
+
+// animationSteps filters steps to TIME "start/end" (RFC3339, either side
+// may be empty); no TIME means every step
+func animationSteps(steps []timeStep, value string) ([]timeStep, error) {
+	if value == "" {
+		return steps, nil
+	}
+	startS, endS, ok := strings.Cut(value, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid TIME %q, expected start/end", value)
+	}
+	var start, end time.Time
+	var err error
+	if startS != "" {
+		if start, err = time.Parse(time.RFC3339, startS); err != nil {
+			return nil, fmt.Errorf("invalid TIME start %q, expected RFC3339", startS)
+		}
+	}
+	if endS != "" {
+		if end, err = time.Parse(time.RFC3339, endS); err != nil {
+			return nil, fmt.Errorf("invalid TIME end %q, expected RFC3339", endS)
+		}
+	}
+	var out []timeStep
+	for _, st := range steps {
+		if (!start.IsZero() && st.Time.Before(start)) || (!end.IsZero() && st.Time.After(end)) {
+			continue
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// renderFrames renders one frame per step on ANIMATE_CONCURRENCY workers.
+// Each result lands at its step's index, so completion order doesn't
+// matter; the first failure cancels the rest.
+func renderFrames(ctx context.Context, base url.Values, steps []timeStep, width, height int) ([]*image.Paletted, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	frames := make([]*image.Paletted, len(steps))
+	var firstErr error
+	var once sync.Once
+	jobs := make(chan int)
+	workers := config().AnimateConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f, err := renderFrame(ctx, base, steps[i], width, height)
+				if err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("frame %s failed: %w", steps[i].Time.Format(time.RFC3339), err)
+						cancel()
+					})
+					continue
+				}
+				frames[i] = f
+			}
+		}()
+	}
+	for i := range steps {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return frames, nil
+}
+
+// renderFrame renders a single step and converts it to a paletted image
+func renderFrame(ctx context.Context, base url.Values, step timeStep, width, height int) (*image.Paletted, error) {
+	v := url.Values{}
+	for k, vals := range base {
+		v[k] = vals
+	}
+	v.Set("file", step.File.Name)
+	v.Set("time", step.Time.Format(time.RFC3339))
+
+	entry, _, _, err := cachedRender(ctx, v, width, height, nil)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(entry.Body))
+	if err != nil {
+		return nil, fmt.Errorf("decoding frame: %v", err)
+	}
+	pm := image.NewPaletted(img.Bounds(), palette.Plan9)
+	draw.FloydSteinberg.Draw(pm, img.Bounds(), img, img.Bounds().Min)
+	return pm, nil
+}
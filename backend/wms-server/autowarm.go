@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// autowarmSlots bounds background renders across every autowarm run
+var autowarmSlots chan struct{}
+
+// autowarmNewData is the layer index's change hook: for each layer with
+// autowarm configured whose files changed, it pre-renders the new valid
+// times' tiles in the background
+func autowarmNewData(prev, cur []layerInfo) {
+	seen := map[string]time.Time{}
+	for _, l := range prev {
+		for _, f := range l.Files {
+			seen[f.Path] = f.ModTime
+		}
+	}
+	for _, l := range cur {
+		aw := config().Layers[l.Name].Autowarm
+		if aw == nil {
+			continue
+		}
+		var steps []timeStep
+		for _, st := range l.timeSteps() {
+			if mt, ok := seen[st.File.Path]; !ok || !mt.Equal(st.File.ModTime) {
+				steps = append(steps, st)
+			}
+		}
+		if len(steps) > 0 {
+			go autowarmLayer(l.Name, *aw, steps)
+		}
+	}
+}
+
+// autowarmLayer renders every configured tile for each step, stopping at
+// AUTOWARM_MAX_TILES or on maintenance mode
+func autowarmLayer(layer string, aw autowarmConfig, steps []timeStep) {
+	bbox := worldExtent
+	if aw.BBox != nil {
+		bbox = *aw.BBox
+	} else if ext, ok := layerExtent(layer); ok {
+		bbox = ext
+	}
+	var tiles [][3]int
+	for _, z := range aw.ZoomLevels {
+		tiles = append(tiles, tilesCovering(bbox, z)...)
+	}
+	total := len(tiles) * len(steps)
+	if config().AutowarmMaxTiles > 0 && total > config().AutowarmMaxTiles {
+		log.Printf("Autowarm %s: %d tiles for %d new times exceeds AUTOWARM_MAX_TILES, warming the first %d",
+			layer, total, len(steps), config().AutowarmMaxTiles)
+		total = config().AutowarmMaxTiles
+	}
+	log.Printf("Autowarm %s: rendering %d tiles for %d new times", layer, total, len(steps))
+
+	start := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var done, failed int
+	queued := 0
+queue:
+	for _, st := range steps {
+		timeSeg := st.Time.Format(time.RFC3339)
+		for _, t := range tiles {
+			if queued == total {
+				break queue
+			}
+			select {
+			case autowarmSlots <- struct{}{}:
+			case <-ctx.Done():
+				break queue
+			}
+			queued++
+			wg.Add(1)
+			go func(v url.Values) {
+				defer func() { <-autowarmSlots; wg.Done() }()
+				_, _, _, err := cachedRender(ctx, v, tileSize, tileSize, nil)
+				mu.Lock()
+				defer mu.Unlock()
+				if errors.Is(err, errMaintenance) {
+					cancel()
+				}
+				if err != nil {
+					failed++
+				}
+				if done++; done%100 == 0 {
+					log.Printf("Autowarm %s: %d/%d tiles", layer, done, total)
+				}
+			}(tileParams(layer, timeSeg, t[0], t[1], t[2]))
+		}
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		log.Printf("Autowarm %s: stopped for maintenance mode after %d tiles", layer, done)
+		return
+	}
+	log.Printf("Autowarm %s: done, %d tiles in %s (%d failed)", layer, done, time.Since(start).Round(time.Millisecond), failed)
+}
+
+// tilesCovering lists the z/x/y tiles intersecting a lon/lat bbox
+func tilesCovering(bbox [4]float64, z int) [][3]int {
+	n := 1 << z
+	x0, y0 := lonLatToTile(bbox[0], bbox[3], n)
+	x1, y1 := lonLatToTile(bbox[2], bbox[1], n)
+	var out [][3]int
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			out = append(out, [3]int{z, x, y})
+		}
+	}
+	return out
+}
+
+// lonLatToTile returns the XYZ tile holding a point at a zoom with n tiles
+// per side, clamped to the grid
+func lonLatToTile(lon, lat float64, n int) (x, y int) {
+	lat = math.Max(-maxMercatorLat, math.Min(maxMercatorLat, lat)) * math.Pi / 180
+	fx := (lon + 180) / 360 * float64(n)
+	fy := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * float64(n)
+	clamp := func(f float64) int { return min(max(int(f), 0), n-1) }
+	return clamp(fx), clamp(fy)
+}
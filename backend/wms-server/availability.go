@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// availabilityDay lists the valid hours (UTC) with data on one date
+type availabilityDay struct {
+	Date  string `json:"date"`
+	Hours []int  `json:"hours"`
+}
+
+// availabilityHandler returns a layer's valid times grouped by date, plus
+// its model runs, for time pickers: /availability/{layer}?start=&end=
+// (dates as YYYY-MM-DD, both inclusive and optional)
+func availabilityHandler(w http.ResponseWriter, r *http.Request) {
+	layer := mux.Vars(r)["layer"]
+	li, ok := layerIndex.Layer(layer)
+	if !ok {
+		writeJSONException(w, http.StatusNotFound, "LayerNotDefined", fmt.Sprintf("no data for layer %q", layer))
+		return
+	}
+
+	var start, end string
+	for _, p := range []struct {
+		name string
+		dst  *string
+	}{{"start", &start}, {"end", &end}} {
+		if s := r.URL.Query().Get(p.name); s != "" {
+			if _, err := time.Parse(time.DateOnly, s); err != nil {
+				writeJSONException(w, http.StatusBadRequest, "InvalidParameterValue",
+					fmt.Sprintf("invalid %s %q, expected YYYY-MM-DD", p.name, s))
+				return
+			}
+			*p.dst = s
+		}
+	}
+
+	// Steps are sorted, so each date's hours arrive in order
+	days := []availabilityDay{}
+	for _, st := range li.timeSteps() {
+		date := st.Time.Format(time.DateOnly)
+		if (start != "" && date < start) || (end != "" && date > end) {
+			continue
+		}
+		if n := len(days); n == 0 || days[n-1].Date != date {
+			days = append(days, availabilityDay{Date: date})
+		}
+		days[len(days)-1].Hours = append(days[len(days)-1].Hours, st.Time.Hour())
+	}
+
+	runs := []string{}
+	for _, run := range li.runs() {
+		runs = append(runs, run.Format(time.RFC3339))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"layer": layer,
+		"runs":  runs,
+		"dates": days,
+	})
+}
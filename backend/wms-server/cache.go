@@ -0,0 +1,210 @@
+package main
+
+import (
+	"container/list"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a rendered image as returned by the processor
+type cacheEntry struct {
+	ContentType string
+	Body        []byte
+	NoData      bool          // processor flagged the image as entirely no-data
+	RenderTime  time.Duration // processor-reported render time, zero if not reported
+}
+
+// tileCache is a fixed-size LRU of rendered images keyed by the canonical
+// processor query string. With a disk tier, evicted entries spill to disk
+// and disk hits are promoted back into memory. Each layer also has its own
+// LRU of the same items, so a layer over its quota (CACHE_LAYER_QUOTA or
+// LAYER_CONFIG cacheQuota) evicts its own oldest tiles rather than every
+// other layer's.
+type tileCache struct {
+	mu     sync.Mutex
+	max    int
+	ll     *list.List
+	items  map[string]*list.Element
+	bytes  int64
+	layers map[string]*layerLRU
+	disk   *diskCache
+}
+
+type cacheItem struct {
+	key     string
+	layer   string
+	entry   cacheEntry
+	layerEl *list.Element // nil for a stale copy
+}
+
+// Stale copies for RENDER_DEGRADE=serve-stale are keyed staleKeyPrefix and
+// the view. They count toward CACHE_SIZE but belong to no layer, so they
+// take none of a layer's quota, and they aren't spilled to disk.
+const staleKeyPrefix = "stale|"
+
+type layerLRU struct {
+	ll    *list.List
+	bytes int64
+}
+
+// newTileCache returns an LRU holding up to max entries (0 disables caching)
+func newTileCache(max int) *tileCache {
+	return &tileCache{max: max, ll: list.New(), items: map[string]*list.Element{}, layers: map[string]*layerLRU{}}
+}
+
+func (c *tileCache) Get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		it := el.Value.(*cacheItem)
+		c.ll.MoveToFront(el)
+		if it.layerEl != nil {
+			c.layers[it.layer].ll.MoveToFront(it.layerEl)
+		}
+		c.mu.Unlock()
+		return it.entry, true
+	}
+	c.mu.Unlock()
+
+	if c.disk != nil && !strings.HasPrefix(key, staleKeyPrefix) {
+		if entry, ok := c.disk.Get(key); ok {
+			c.Put(key, entry)
+			return entry, true
+		}
+	}
+	return cacheEntry{}, false
+}
+
+func (c *tileCache) Put(key string, entry cacheEntry) {
+	var evicted []*cacheItem
+	c.mu.Lock()
+	if c.max <= 0 {
+		c.mu.Unlock()
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		it := el.Value.(*cacheItem)
+		delta := int64(len(entry.Body) - len(it.entry.Body))
+		c.bytes += delta
+		it.entry = entry
+		c.ll.MoveToFront(el)
+		if it.layerEl != nil {
+			c.layers[it.layer].bytes += delta
+			c.layers[it.layer].ll.MoveToFront(it.layerEl)
+		}
+		c.mu.Unlock()
+		return
+	}
+	if strings.HasPrefix(key, staleKeyPrefix) {
+		c.items[key] = c.ll.PushFront(&cacheItem{key: key, entry: entry})
+		c.bytes += int64(len(entry.Body))
+		for c.ll.Len() > c.max {
+			evicted = append(evicted, c.remove(c.ll.Back().Value.(*cacheItem)))
+		}
+		c.mu.Unlock()
+		c.spill(evicted)
+		return
+	}
+	layer := cacheKeyLayer(key)
+	lru := c.layers[layer]
+	if lru == nil {
+		lru = &layerLRU{ll: list.New()}
+		c.layers[layer] = lru
+	}
+	it := &cacheItem{key: key, layer: layer, entry: entry}
+	it.layerEl = lru.ll.PushFront(it)
+	c.items[key] = c.ll.PushFront(it)
+	c.bytes += int64(len(entry.Body))
+	lru.bytes += int64(len(entry.Body))
+	if quota := layerCacheQuota(layer); quota > 0 {
+		for lru.ll.Len() > quota {
+			evicted = append(evicted, c.remove(lru.ll.Back().Value.(*cacheItem)))
+		}
+	}
+	for c.ll.Len() > c.max {
+		evicted = append(evicted, c.remove(c.ll.Back().Value.(*cacheItem)))
+	}
+	c.mu.Unlock()
+	c.spill(evicted)
+}
+
+// resize changes the entry limit, evicting down to it at once
+func (c *tileCache) resize(limit int) {
+	var evicted []*cacheItem
+	c.mu.Lock()
+	c.max = limit
+	for c.ll.Len() > max(limit, 0) {
+		evicted = append(evicted, c.remove(c.ll.Back().Value.(*cacheItem)))
+	}
+	c.mu.Unlock()
+	c.spill(evicted)
+}
+
+// spill counts evicted items and moves them to the disk tier, if any.
+// Disk writes happen outside the lock.
+func (c *tileCache) spill(evicted []*cacheItem) {
+	stats.evictions.Add(uint64(len(evicted)))
+	if c.disk != nil {
+		for _, it := range evicted {
+			if it.layerEl != nil {
+				c.disk.Put(it.key, it.entry)
+			}
+		}
+	}
+}
+
+// remove drops an item from both LRUs; the caller holds mu
+func (c *tileCache) remove(it *cacheItem) *cacheItem {
+	c.ll.Remove(c.items[it.key])
+	delete(c.items, it.key)
+	c.bytes -= int64(len(it.entry.Body))
+	if it.layerEl == nil {
+		return it
+	}
+	lru := c.layers[it.layer]
+	lru.ll.Remove(it.layerEl)
+	lru.bytes -= int64(len(it.entry.Body))
+	if lru.ll.Len() == 0 {
+		delete(c.layers, it.layer)
+	}
+	return it
+}
+
+// cacheKeyLayer is the layer param of a cache key. Composites cache per
+// member layer; an RGB composite's key names its three bands.
+func cacheKeyLayer(key string) string {
+	v, _ := url.ParseQuery(key)
+	return v.Get("layer")
+}
+
+// layerOccupancy is one layer's share of the memory cache
+type layerOccupancy struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Quota   int   `json:"quota,omitempty"`
+}
+
+// Layers reports each cached layer's entries, bytes and quota
+func (c *tileCache) Layers() map[string]layerOccupancy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]layerOccupancy, len(c.layers))
+	for name, lru := range c.layers {
+		out[name] = layerOccupancy{Entries: lru.ll.Len(), Bytes: lru.bytes, Quota: layerCacheQuota(name)}
+	}
+	return out
+}
+
+func (c *tileCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Bytes is the total image size held in memory
+func (c *tileCache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStaleCopiesOnlyForServeStale(t *testing.T) {
+	v := url.Values{"layer": {"temp_2m"}, "time": {"2026-10-14T00:00:00Z"}, "width": {"256"}}
+	prev := tiles
+	t.Cleanup(func() { tiles = prev })
+	for _, degrade := range []string{"retry-lowres", "error", "serve-stale"} {
+		useConfig(t, map[string]string{"RENDER_DEGRADE": degrade, "CACHE_SIZE": "10"})
+		tiles = newTileCache(config().CacheSize)
+		putStale(v, cacheEntry{Body: []byte("png")})
+		_, ok := tiles.Get(staleCacheKey(v))
+		if want := degrade == "serve-stale"; ok != want {
+			t.Errorf("RENDER_DEGRADE=%s: stale copy cached = %v, want %v", degrade, ok, want)
+		}
+	}
+}
+
+func TestStaleCopiesOutsideLayerQuota(t *testing.T) {
+	useConfig(t, map[string]string{"CACHE_LAYER_QUOTA": "1"})
+	c := newTileCache(10)
+	c.disk = mustDiskCache(t)
+
+	tile := url.Values{"layer": {"temp_2m"}, "time": {"2026-10-14T00:00:00Z"}}
+	c.Put(tile.Encode(), cacheEntry{Body: []byte("tile")})
+	c.Put(staleCacheKey(tile), cacheEntry{Body: []byte("stale")})
+	if _, ok := c.Get(tile.Encode()); !ok {
+		t.Fatal("a stale copy evicted its layer's only tile under a quota of 1")
+	}
+	if got := c.Layers()["temp_2m"]; got.Entries != 1 || got.Bytes != 4 {
+		t.Errorf("layer occupancy = %+v, want the tile alone", got)
+	}
+	if _, ok := c.Layers()[""]; ok {
+		t.Error("stale copies are reported as a layer")
+	}
+
+	// Evicted stale copies are dropped, not spilled to disk
+	c.resize(0)
+	if _, ok := c.disk.Get(staleCacheKey(tile)); ok {
+		t.Error("evicted stale copy was spilled to disk")
+	}
+	if _, ok := c.disk.Get(tile.Encode()); !ok {
+		t.Error("evicted tile was not spilled to disk")
+	}
+}
+
+func mustDiskCache(t *testing.T) *diskCache {
+	t.Helper()
+	d, err := newDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestSpilledEntryKeepsNoData(t *testing.T) {
+	useConfig(t, nil)
+	c := newTileCache(1)
+	c.disk = mustDiskCache(t)
+
+	// Opaque, so only the flag can make it a 204
+	body := testPNG(t, 1, 1)
+	want := cacheEntry{ContentType: "image/png", Body: body, NoData: true, RenderTime: 1500 * time.Millisecond}
+	c.Put("nodata", want)
+	c.Put("other", cacheEntry{ContentType: "image/png", Body: body})
+	if _, ok := c.disk.Get("nodata"); !ok {
+		t.Fatal("evicted entry was not spilled to disk")
+	}
+	got, ok := c.Get("nodata")
+	if !ok {
+		t.Fatal("spilled entry not found")
+	}
+	if got.NoData != want.NoData || got.RenderTime != want.RenderTime || got.ContentType != want.ContentType || !bytes.Equal(got.Body, want.Body) {
+		t.Errorf("read back %+v, want %+v", got, want)
+	}
+
+	// Without the flags the header is the content type alone, as spilled
+	// by earlier versions
+	c.disk.Put("plain", cacheEntry{ContentType: "image/png", Body: body})
+	if got, ok := c.disk.Get("plain"); !ok || got.NoData || got.RenderTime != 0 || got.ContentType != "image/png" {
+		t.Errorf("plain entry read back as %+v", got)
+	}
+	data, err := os.ReadFile(c.disk.path("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append([]byte("image/png\n"), body...); !bytes.Equal(data, want) {
+		t.Errorf("plain entry stored as %q, want the content type line and body", data[:min(len(data), 20)])
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cache-Control policies are set here by endpoint category rather than
+// in each handler. CACHE_CONTROL_<CATEGORY> overrides a category's
+// policy, "none" sending no header. Only successful and 304 responses get
+// one; a handler that sets its own, e.g. for a degraded render, keeps it.
+var cacheCategories = []struct {
+	name, policy string
+}{
+	{"capabilities", ""}, // public, max-age=CAPABILITIES_MAX_AGE_SECONDS
+	{"datasets", "public, max-age=60"},
+	{"meta", "public, max-age=60"},
+	{"tiles", "public, max-age=300"},
+	{"tiles_past", "public, max-age=86400"}, // valid times no newer run will cover
+	{"featureinfo", "no-store"},
+}
+
+// parseCacheControl reads the policy of every category
+func parseCacheControl(env envSource, capabilitiesMaxAge time.Duration) (map[string]string, error) {
+	policies := map[string]string{}
+	for _, cat := range cacheCategories {
+		def := cat.policy
+		if cat.name == "capabilities" {
+			def = fmt.Sprintf("public, max-age=%d", int(capabilitiesMaxAge.Seconds()))
+		}
+		name := "CACHE_CONTROL_" + strings.ToUpper(cat.name)
+		policy := strings.TrimSpace(env.get(name, def))
+		if strings.EqualFold(policy, "none") {
+			continue
+		}
+		if err := checkCacheControl(policy); err != nil {
+			return nil, fmt.Errorf("%s %q: %v", name, policy, err)
+		}
+		policies[cat.name] = policy
+	}
+	return policies, nil
+}
+
+// checkCacheControl accepts the response directives worth configuring
+func checkCacheControl(policy string) error {
+	for _, d := range strings.Split(policy, ",") {
+		name, value, hasValue := strings.Cut(strings.ToLower(strings.TrimSpace(d)), "=")
+		switch name {
+		case "public", "private", "no-store", "no-cache", "immutable", "must-revalidate", "proxy-revalidate", "no-transform":
+			if hasValue {
+				return fmt.Errorf("%s takes no value", name)
+			}
+		case "max-age", "s-maxage", "stale-while-revalidate", "stale-if-error":
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				return fmt.Errorf("%s needs a number of seconds", name)
+			}
+		default:
+			return fmt.Errorf("unknown directive %q, expected e.g. public, private, no-store, immutable or max-age=N", name)
+		}
+	}
+	return nil
+}
+
+// cacheCategory names the category of a GET or HEAD request, "" for
+// endpoints left uncached
+func cacheCategory(r *http.Request) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	parts := strings.Split(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, config().BasePath), "/"), "/")
+	switch parts[0] {
+	case "wms":
+		q := wmsParams(r.URL.RawQuery)
+		switch strings.ToLower(q.Get("REQUEST")) {
+		case "getcapabilities":
+			return "capabilities"
+		case "getmap":
+			// The layer is in the dataset path as <layer>/<file>, else LAYERS
+			layer, _, _ := strings.Cut(q.Get("LAYERS"), ",")
+			if len(parts) > 2 {
+				layer = parts[len(parts)-2]
+			}
+			return tileCategory(layer, q.Get("TIME"))
+		case "getfeatureinfo":
+			return "featureinfo"
+		}
+	case "wmts":
+		if len(parts) > 2 {
+			return tileCategory(parts[1], parts[2])
+		}
+	case "collections":
+		if len(parts) == 3 && parts[2] == "map" {
+			return tileCategory(parts[1], r.URL.Query().Get("datetime"))
+		}
+		return "capabilities"
+	case "datasets":
+		return "datasets"
+	case "meta", "availability":
+		return "meta"
+	case "value":
+		return "featureinfo"
+	}
+	return ""
+}
+
+// tileCategory is tiles_past for a valid time before the layer's latest
+// run, which later runs won't redo, else tiles
+func tileCategory(layer, t string) string {
+	vt, err := time.Parse(time.RFC3339, t)
+	if err != nil {
+		return "tiles"
+	}
+	if li, ok := layerIndex.Layer(layer); ok {
+		if runs := li.runs(); len(runs) > 0 && vt.Before(runs[len(runs)-1]) {
+			return "tiles_past"
+		}
+	}
+	return "tiles"
+}
+
+// cacheControl applies the category's policy to the response
+func cacheControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := config().CacheControl[cacheCategory(r)]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&cacheControlWriter{ResponseWriter: w, policy: policy}, r)
+	})
+}
+
+// cacheControlWriter sets Cache-Control as the response starts
+type cacheControlWriter struct {
+	http.ResponseWriter
+	policy      string
+	wroteHeader bool
+}
+
+func (c *cacheControlWriter) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		h := c.Header()
+		if (code < 300 || code == http.StatusNotModified) && h.Get("Cache-Control") == "" {
+			h.Set("Cache-Control", c.policy)
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cacheControlWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *cacheControlWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
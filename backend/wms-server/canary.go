@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Blue-green processor rollouts: PROCESSOR_CANARY_PERCENT of GetMap renders
+// go to PROCESSOR_CANARY_URL and the rest to PROCESSOR_URL. The choice
+// rides on the request context to openRender. Cached images are shared
+// between the two, so only cache misses reach either backend.
+const (
+	backendPrimary = "primary"
+	backendCanary  = "canary"
+)
+
+type backendKey struct{}
+
+// pickBackend routes one GetMap request
+func pickBackend() string {
+	if config().ProcessorCanaryURL != "" && rand.Intn(100) < config().CanaryPercent {
+		return backendCanary
+	}
+	return backendPrimary
+}
+
+// withBackend sends the renders under ctx to backend
+func withBackend(ctx context.Context, backend string) context.Context {
+	return context.WithValue(ctx, backendKey{}, backend)
+}
+
+// renderBackend is the backend chosen for ctx, primary by default
+func renderBackend(ctx context.Context) string {
+	if b, ok := ctx.Value(backendKey{}).(string); ok {
+		return b
+	}
+	return backendPrimary
+}
+
+// renderURL is the base URL of the processor ctx renders on
+func renderURL(ctx context.Context) string {
+	if renderBackend(ctx) == backendCanary {
+		return config().ProcessorCanaryURL
+	}
+	return config().ProcessorURL
+}
+
+// routeGetMap picks the backend for a GetMap request, naming it in
+// X-Processor while a canary is configured
+func routeGetMap(w http.ResponseWriter, r *http.Request) *http.Request {
+	backend := pickBackend()
+	if config().ProcessorCanaryURL != "" {
+		w.Header().Set("X-Processor", backend)
+	}
+	return r.WithContext(withBackend(r.Context(), backend))
+}
+
+// backendCounters are one backend's renders, failures and time spent
+type backendCounters struct {
+	renders atomic.Uint64
+	errors  atomic.Uint64
+	ns      atomic.Uint64
+}
+
+var backendStats = map[string]*backendCounters{
+	backendPrimary: {},
+	backendCanary:  {},
+}
+
+// backendRender records a render on ctx's backend
+func backendRender(ctx context.Context, d time.Duration, err error) {
+	c := backendStats[renderBackend(ctx)]
+	c.renders.Add(1)
+	c.ns.Add(uint64(d))
+	if err != nil {
+		c.errors.Add(1)
+	}
+}
+
+// backendReport is a backend's share of the /stats payload
+type backendReport struct {
+	Renders     uint64  `json:"renders"`
+	Errors      uint64  `json:"errors"`
+	AvgRenderMs float64 `json:"avg_render_ms"`
+}
+
+func backendReports() map[string]backendReport {
+	out := map[string]backendReport{}
+	for name, c := range backendStats {
+		rep := backendReport{Renders: c.renders.Load(), Errors: c.errors.Load()}
+		if rep.Renders > 0 {
+			rep.AvgRenderMs = float64(c.ns.Load()) / float64(rep.Renders) / 1e6
+		}
+		out[name] = rep
+	}
+	return out
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// capsWriter streams capabilities XML through an xml.Encoder. It tracks the
+// open elements so an aborted document can still be closed off cleanly.
+type capsWriter struct {
+	enc     *xml.Encoder
+	flusher http.Flusher
+	open    []xml.Name
+	err     error
+}
+
+func newCapsWriter(w http.ResponseWriter) *capsWriter {
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	c := &capsWriter{enc: enc}
+	c.flusher, _ = w.(http.Flusher)
+	return c
+}
+
+func (c *capsWriter) token(t xml.Token) {
+	if c.err == nil {
+		c.err = c.enc.EncodeToken(t)
+	}
+}
+
+// start opens an element; attrs are name/value pairs
+func (c *capsWriter) start(name string, attrs ...string) {
+	se := xml.StartElement{Name: xml.Name{Local: name}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		se.Attr = append(se.Attr, xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+	}
+	c.token(se)
+	c.open = append(c.open, se.Name)
+}
+
+func (c *capsWriter) end() {
+	if len(c.open) == 0 {
+		return
+	}
+	name := c.open[len(c.open)-1]
+	c.open = c.open[:len(c.open)-1]
+	c.token(xml.EndElement{Name: name})
+}
+
+func (c *capsWriter) text(s string) {
+	c.token(xml.CharData(s))
+}
+
+// elem writes a complete element with text content
+func (c *capsWriter) elem(name, text string, attrs ...string) {
+	c.start(name, attrs...)
+	c.text(text)
+	c.end()
+}
+
+// list writes values comma-separated, one token each, so long dimension
+// lists are never joined in memory
+func (c *capsWriter) list(values func(yield func(string))) {
+	first := true
+	values(func(s string) {
+		if !first {
+			c.text(",")
+		}
+		first = false
+		c.text(s)
+	})
+}
+
+// flush pushes what has been encoded so far out to the client
+func (c *capsWriter) flush() {
+	if c.err == nil {
+		c.err = c.enc.Flush()
+	}
+	if c.err == nil && c.flusher != nil {
+		c.flusher.Flush()
+	}
+}
+
+// close ends any elements still open and flushes
+func (c *capsWriter) close() error {
+	for len(c.open) > 0 {
+		c.end()
+	}
+	c.flush()
+	return c.err
+}
+
+func handleGetCapabilities(w http.ResponseWriter, r *http.Request, dataset string, q url.Values) {
+	layers := layerIndex.Layers()
+	groups := groupNames()
+	// The file a layer-scoped document advertises the path binding with
+	var pathFile string
+
+	// /wms/{layer} scopes the document to that one layer or group
+	if dataset != "" {
+		layer, file, err := splitDataset(dataset)
+		if err != nil {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+			return
+		}
+		if layer == "" {
+			layer, file = file, ""
+		}
+		var ok bool
+		if layers, groups, ok = scopeLayers(layers, layer); !ok {
+			writeWMSException(w, q, http.StatusNotFound, "LayerNotDefined", fmt.Sprintf("no data for layer %q", layer))
+			return
+		}
+		if len(groups) == 0 {
+			pathFile = layerPathFile(layers[0], file)
+		}
+	}
+
+	// UPDATESEQUENCE lets clients skip re-fetching unchanged capabilities
+	seq := layerIndex.UpdateSequence()
+	if us := q.Get("UPDATESEQUENCE"); us != "" {
+		if n, err := strconv.ParseInt(us, 10, 64); err == nil {
+			switch {
+			case n == seq:
+				writeWMSException(w, q, http.StatusOK, "CurrentUpdateSequence",
+					fmt.Sprintf("capabilities unchanged since update sequence %d", seq))
+				return
+			case n > seq:
+				writeWMSException(w, q, http.StatusBadRequest, "InvalidUpdateSequence",
+					fmt.Sprintf("UPDATESEQUENCE %d is newer than the current %d", n, seq))
+				return
+			}
+		}
+	}
+
+	// FORMAT or Accept picks XML or the JSON rendering of the same document
+	w.Header().Add("Vary", "Accept")
+	asJSON := wantsJSONCapabilities(r, q)
+	version := requestVersion(q)
+
+	// Conditional GET: clients poll capabilities to detect new data.
+	// If-None-Match, when sent, decides on its own.
+	variant := version
+	if asJSON {
+		variant = "json"
+	}
+	etag := capabilitiesETag(r, dataset, variant, seq)
+	w.Header().Set("ETag", etag)
+	newest := layerIndex.LastModified().Truncate(time.Second)
+	if !newest.IsZero() {
+		w.Header().Set("Last-Modified", newest.Format(http.TimeFormat))
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !newest.IsZero() && !newest.After(ims) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if asJSON {
+		writeJSONCapabilities(w, r, layers, groups, seq)
+		return
+	}
+	if version == wms111 {
+		w.Header().Set("Content-Type", "application/vnd.ogc.wms_xml")
+	} else {
+		w.Header().Set("Content-Type", "text/xml")
+	}
+
+	c := newCapsWriter(w)
+	// Whatever happens below, the document that reaches the client is closed
+	defer c.close()
+
+	c.token(xml.ProcInst{Target: "xml", Inst: []byte(`version="1.0" encoding="UTF-8"`)})
+	c.text("\n")
+	if version == wms111 {
+		c.start("WMT_MS_Capabilities", "version", wms111, "updateSequence", strconv.FormatInt(seq, 10),
+			"xmlns:xlink", "http://www.w3.org/1999/xlink",
+			"xmlns:wx", "urn:weather-wms:vendor")
+	} else {
+		c.start("WMS_Capabilities", "version", wms130, "updateSequence", strconv.FormatInt(seq, 10),
+			"xmlns", "http://www.opengis.net/wms",
+			"xmlns:xlink", "http://www.w3.org/1999/xlink",
+			"xmlns:wx", "urn:weather-wms:vendor")
+	}
+
+	serviceHref := serviceURL(r)
+	c.start("Service")
+	if version == wms111 {
+		c.elem("Name", "OGC:WMS")
+	} else {
+		c.elem("Name", "WMS")
+	}
+	c.elem("Title", "Weather Visualization WMS Server")
+	// The path binding's URL differs per layer, so only a layer's own
+	// capabilities can give it a DCPType; clients use hrefs verbatim
+	c.elem("Abstract", "Custom Golang WMS server for NOAA GFS weather data. "+
+		"Besides KVP, every operation accepts a layer and one of its files in the path, "+
+		"in place of LAYERS: "+serviceHref+"/[<dir>/]<layer>/<file>?... "+
+		"The capabilities of one layer, at "+serviceHref+"/<layer>, advertise that binding for its latest file.")
+	c.elem("OnlineResource", "", "xlink:type", "simple", "xlink:href", serviceHref)
+	// 1.1.1 has no elements for the limits
+	if version == wms130 {
+		writeServiceLimits(c)
+	}
+	c.end()
+
+	c.start("Capability")
+	c.start("Request")
+	for _, op := range capsOperations() {
+		c.start(op.name)
+		for _, f := range op.formats {
+			if version == wms111 && op.name == "GetCapabilities" && f == "text/xml" {
+				f = "application/vnd.ogc.wms_xml"
+			}
+			c.elem("Format", f)
+		}
+		// Clients build request URLs from these. KVP comes first for clients
+		// that only read one.
+		writeDCPType(c, serviceHref+"?", bindingKVP)
+		if pathFile != "" {
+			writeDCPType(c, serviceHref+"/"+url.PathEscape(layers[0].Name)+"/"+url.PathEscape(pathFile)+"?", bindingPath)
+		}
+		c.end()
+	}
+	c.end()
+	// Required by the 1.3.0 schema between Request and Layer; these are the
+	// EXCEPTIONS values writeWMSException understands
+	c.start("Exception")
+	formats := exceptionFormats
+	if version == wms111 {
+		formats = exceptionFormats111
+	}
+	for _, f := range formats {
+		c.elem("Format", f)
+	}
+	c.end()
+
+	// Rendering profiles accepted by GetMap's PROFILE param (vendor extension)
+	c.start("wx:RenderProfiles")
+	for _, name := range profileNames() {
+		c.elem("wx:Profile", config().Profiles[name].Encode(), "name", name)
+	}
+	c.end()
+	// Palettes the processor reported; usable as STYLES or PALETTE
+	c.start("wx:Palettes")
+	for _, name := range procInfo().Palettes {
+		c.elem("wx:Palette", name)
+	}
+	c.end()
+
+	c.start("Layer")
+	c.elem("Title", "Weather Data Layers")
+	// A simple time dimension list: now to +48h in 3h steps
+	if version == wms111 {
+		c.elem("Dimension", "", "name", "time", "units", "ISO8601")
+		c.start("Extent", "name", "time")
+	} else {
+		c.start("Dimension", "name", "time", "units", "ISO8601")
+	}
+	now := time.Now().UTC().Truncate(time.Hour)
+	c.list(func(yield func(string)) {
+		for i := 0; i <= 48; i += 3 {
+			yield(now.Add(time.Duration(i) * time.Hour).Format(time.RFC3339))
+		}
+	})
+	c.end()
+	c.flush()
+
+	// One child Layer per discovered parameter, carrying the newest file's mtime
+	for _, l := range layers {
+		if r.Context().Err() != nil {
+			return
+		}
+		ext, _ := layerExtent(l.Name)
+		c.start("Layer", "queryable", "1")
+		c.elem("Name", l.Name)
+		c.elem("Title", l.Name)
+		crsList := config().Layers[l.Name].crsList()
+		for _, crs := range crsList {
+			c.elem(crsElement(version), crs)
+		}
+		writeBoundingBoxes(c, ext, crsList, version)
+		writeDimensions(c, layerDimensions(l), version)
+		writeStyles(c, l.Name)
+		if lc := config().Layers[l.Name]; lc.ValidRange != nil {
+			c.elem("wx:ValidRange", "", "min", strconv.FormatFloat(lc.ValidRange[0], 'g', -1, 64),
+				"max", strconv.FormatFloat(lc.ValidRange[1], 'g', -1, 64), "masking", lc.maskingMode())
+		}
+		if config().Layers[l.Name].LogScale {
+			c.elem("wx:LogScale", "true")
+		}
+		c.elem("wx:LastModified", l.LastModified.Format(time.RFC3339))
+		c.end()
+		c.flush()
+	}
+
+	// Layer groups render as a composite of their members
+	for _, name := range groups {
+		c.start("Layer", "queryable", "0")
+		c.elem("Name", name)
+		c.elem("Title", fmt.Sprintf("%s (%s)", name, strings.Join(config().LayerGroups[name], ", ")))
+		for _, crs := range groupCRS(name) {
+			c.elem(crsElement(version), crs)
+		}
+		if isRGBGroup(name) {
+			c.start("Style")
+			c.elem("Name", rgbStyle)
+			c.elem("Title", "RGB composite of "+strings.Join(config().LayerGroups[name], ", "))
+			c.end()
+		}
+		c.end()
+	}
+}
+
+// scopeLayers narrows capabilities to the named layer, or to a group and
+// its members
+func scopeLayers(layers []layerInfo, name string) ([]layerInfo, []string, bool) {
+	if members, ok := config().LayerGroups[name]; ok {
+		var scoped []layerInfo
+		for _, l := range layers {
+			if containsString(members, l.Name) {
+				scoped = append(scoped, l)
+			}
+		}
+		return scoped, []string{name}, true
+	}
+	if l, ok := findLayer(layers, name); ok {
+		return []layerInfo{l}, nil, true
+	}
+	return nil, nil, false
+}
+
+// xlink:role values telling the two request bindings apart
+const (
+	bindingKVP  = "urn:weather-wms:binding:kvp"
+	bindingPath = "urn:weather-wms:binding:path"
+)
+
+// layerPathFile is the file a layer's path binding is advertised with:
+// the one its capabilities were requested for, else the first of its
+// latest run, which GetMap renders by default
+func layerPathFile(l layerInfo, file string) string {
+	if f, ok := l.fileByName(file); ok {
+		return f.Name
+	}
+	runs := l.runs()
+	if len(runs) == 0 {
+		return ""
+	}
+	if files := l.runFiles(runs[len(runs)-1]); len(files) > 0 {
+		return files[0].Name
+	}
+	return ""
+}
+
+// writeDCPType writes the HTTP Get and Post bindings for an operation;
+// wmsHandler takes form-encoded KVP as a POST body at the same URL
+func writeDCPType(c *capsWriter, href, role string) {
+	c.start("DCPType")
+	c.start("HTTP")
+	for _, method := range []string{"Get", "Post"} {
+		c.start(method)
+		c.elem("OnlineResource", "", "xlink:type", "simple", "xlink:role", role, "xlink:href", href)
+		c.end()
+	}
+	c.end()
+	c.end()
+}
+
+// writeServiceLimits advertises the limits handleGetMap enforces; zero
+// means unlimited and is left out
+func writeServiceLimits(c *capsWriter) {
+	if config().MaxLayers > 0 {
+		c.elem("LayerLimit", strconv.Itoa(config().MaxLayers))
+	}
+	if config().MaxWidth > 0 {
+		c.elem("MaxWidth", strconv.Itoa(config().MaxWidth))
+	}
+	if config().MaxHeight > 0 {
+		c.elem("MaxHeight", strconv.Itoa(config().MaxHeight))
+	}
+}
+
+// capsOperation is a request type and the output formats it supports
+type capsOperation struct {
+	name    string
+	formats []string
+}
+
+func capsOperations() []capsOperation {
+	return []capsOperation{
+		{"GetCapabilities", []string{"text/xml", "application/json"}},
+		{"GetMap", procInfo().Formats},
+		{"GetFeatureInfo", []string{"application/json", "application/geo+json"}},
+	}
+}
+
+// capabilitiesETag names one capabilities document: the index's update
+// sequence, plus what else shapes it. That is the scope, XML version or
+// JSON, the service URL, the config generation, and the hour, which the
+// time defaults and root time list follow.
+func capabilitiesETag(r *http.Request, dataset, variant string, seq int64) string {
+	key := fmt.Sprintf("%s|%s|%s|%d|%d", dataset, variant, serviceURL(r), configGeneration.Load(),
+		time.Now().UTC().Truncate(time.Hour).Unix())
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf(`"caps-%d-%s"`, seq, hex.EncodeToString(sum[:6]))
+}
+
+// etagMatches applies If-None-Match's weak comparison to etag
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// exceptionFormats are the EXCEPTIONS values writeWMSException understands
+var exceptionFormats = []string{"XML", "INIMAGE", "BLANK", "JSON"}
+
+// exceptionFormats111 are the same in the MIME type spelling of WMS 1.1.1
+var exceptionFormats111 = []string{"application/vnd.ogc.se_xml", "application/vnd.ogc.se_inimage", "application/vnd.ogc.se_blank", "application/json"}
+
+// crsElement names a layer's CRS elements: CRS in 1.3.0, SRS before
+func crsElement(version string) string {
+	if version == wms111 {
+		return "SRS"
+	}
+	return "CRS"
+}
+
+// capsDimension is one Dimension element of a layer
+type capsDimension struct {
+	Name    string   `json:"name"`
+	Units   string   `json:"units"`
+	Default string   `json:"default"`
+	Values  []string `json:"values"`
+}
+
+// layerDimensions returns the layer's time, reference_time, member and
+// elevation dimensions, leaving out any it doesn't have
+func layerDimensions(l layerInfo) []capsDimension {
+	var dims []capsDimension
+	if d, ok := timeDimension(l.timeSteps()); ok {
+		dims = append(dims, d)
+	}
+	if d, ok := referenceTimeDimension(l); ok {
+		dims = append(dims, d)
+	}
+	if d, ok := memberDimension(l); ok {
+		dims = append(dims, d)
+	}
+	if d, ok := elevationDimension(l); ok {
+		dims = append(dims, d)
+	}
+	return dims
+}
+
+// writeDimensions writes a layer's dimensions. WMS 1.1.1 declares each in
+// an empty Dimension and lists its values in a separate Extent.
+func writeDimensions(c *capsWriter, dims []capsDimension, version string) {
+	if version == wms111 {
+		for _, d := range dims {
+			c.elem("Dimension", "", "name", d.Name, "units", d.Units)
+		}
+	}
+	for _, d := range dims {
+		if version == wms111 {
+			c.start("Extent", "name", d.Name, "default", d.Default)
+		} else {
+			c.start("Dimension", "name", d.Name, "units", d.Units, "default", d.Default)
+		}
+		c.list(func(yield func(string)) {
+			for _, v := range d.Values {
+				yield(v)
+			}
+		})
+		c.end()
+	}
+}
+
+// timeDimension lists a layer's discovered valid times, defaulting to the
+// one closest to now
+func timeDimension(steps []timeStep) (capsDimension, bool) {
+	if len(steps) == 0 {
+		return capsDimension{}, false
+	}
+	now := time.Now().UTC()
+	def := steps[0].Time
+	d := capsDimension{Name: "time", Units: "ISO8601"}
+	for _, st := range steps {
+		if absDuration(st.Time.Sub(now)) < absDuration(def.Sub(now)) {
+			def = st.Time
+		}
+		d.Values = append(d.Values, st.Time.Format(time.RFC3339))
+	}
+	d.Default = def.Format(time.RFC3339)
+	return d, true
+}
+
+// referenceTimeDimension lists the layer's model runs when enabled; GetMap
+// selects one with DIM_REFERENCE_TIME
+func referenceTimeDimension(l layerInfo) (capsDimension, bool) {
+	runs := l.runs()
+	if !config().RefTimeDimension || len(runs) == 0 {
+		return capsDimension{}, false
+	}
+	d := capsDimension{Name: "reference_time", Units: "ISO8601", Default: runs[len(runs)-1].Format(time.RFC3339)}
+	for _, run := range runs {
+		d.Values = append(d.Values, run.Format(time.RFC3339))
+	}
+	return d, true
+}
+
+// memberDimension advertises ensemble members for layers that have them
+func memberDimension(l layerInfo) (capsDimension, bool) {
+	members := l.members()
+	if len(members) == 0 {
+		return capsDimension{}, false
+	}
+	values := append(append([]string(nil), members...), "mean")
+	return capsDimension{Name: "member", Units: "", Default: l.defaultMember(), Values: values}, true
+}
+
+// elevationDimension lists the vertical levels of layers that have them,
+// defaulting to the first; GetMap selects one with ELEVATION
+func elevationDimension(l layerInfo) (capsDimension, bool) {
+	levels := l.levels()
+	if len(levels) == 0 {
+		return capsDimension{}, false
+	}
+	return capsDimension{Name: "elevation", Units: "", Default: levels[0], Values: levels}, true
+}
+
+// capsBoundingBox is a BoundingBox in the axis order WMS 1.3.0 uses for
+// its CRS
+type capsBoundingBox struct {
+	CRS  string  `json:"crs"`
+	MinX float64 `json:"minx"`
+	MinY float64 `json:"miny"`
+	MaxX float64 `json:"maxx"`
+	MaxY float64 `json:"maxy"`
+}
+
+// boundingBoxes converts a lon/lat extent to each of the layer's CRSes the
+// server can convert to. EPSG:4326 is lat/lon; Web Mercator is rounded to
+// centimetres.
+func boundingBoxes(ext [4]float64, crsList []string) []capsBoundingBox {
+	cm := func(f float64) float64 { return math.Round(f*100) / 100 }
+	minx, miny := lonLatToMercator(ext[0], ext[1])
+	maxx, maxy := lonLatToMercator(ext[2], ext[3])
+	var out []capsBoundingBox
+	for _, crs := range crsList {
+		switch {
+		case strings.EqualFold(crs, "EPSG:4326"):
+			out = append(out, capsBoundingBox{crs, ext[1], ext[0], ext[3], ext[2]})
+		case isWebMercator(crs):
+			out = append(out, capsBoundingBox{crs, cm(minx), cm(miny), cm(maxx), cm(maxy)})
+		}
+	}
+	return out
+}
+
+// writeBoundingBoxes writes a lon/lat extent as the geographic bounding box
+// plus the layer's boundingBoxes. WMS 1.1.1 has LatLonBoundingBox and keeps
+// EPSG:4326 in lon/lat order.
+func writeBoundingBoxes(c *capsWriter, ext [4]float64, crsList []string, version string) {
+	g := func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+	m := func(f float64) string { return strconv.FormatFloat(f, 'f', 2, 64) }
+
+	if version == wms111 {
+		c.elem("LatLonBoundingBox", "", "minx", g(ext[0]), "miny", g(ext[1]), "maxx", g(ext[2]), "maxy", g(ext[3]))
+	} else {
+		c.start("EX_GeographicBoundingBox")
+		c.elem("westBoundLongitude", g(ext[0]))
+		c.elem("eastBoundLongitude", g(ext[2]))
+		c.elem("southBoundLatitude", g(ext[1]))
+		c.elem("northBoundLatitude", g(ext[3]))
+		c.end()
+	}
+	for _, bb := range boundingBoxes(ext, crsList) {
+		f := g
+		if isWebMercator(bb.CRS) {
+			f = m
+		}
+		if version == wms111 {
+			if swapsAxes(wms130, bb.CRS) {
+				bb.MinX, bb.MinY, bb.MaxX, bb.MaxY = bb.MinY, bb.MinX, bb.MaxY, bb.MaxX
+			}
+			c.elem("BoundingBox", "", "SRS", bb.CRS, "minx", f(bb.MinX), "miny", f(bb.MinY), "maxx", f(bb.MaxX), "maxy", f(bb.MaxY))
+		} else {
+			c.elem("BoundingBox", "", "CRS", bb.CRS, "minx", f(bb.MinX), "miny", f(bb.MinY), "maxx", f(bb.MaxX), "maxy", f(bb.MaxY))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var hrefRe = regexp.MustCompile(`xlink:href="([^"]*)"`)
+
+// Clients use advertised hrefs verbatim, so each must be a real URL
+func TestCapabilitiesHrefsAreUsable(t *testing.T) {
+	e := newTestEnv(t, nil, nil, "temp_2m_2026101400.nc")
+	for _, version := range []string{wms130, wms111} {
+		rec := e.get("/wms?SERVICE=WMS&REQUEST=GetCapabilities&VERSION=" + version)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", version, rec.Code)
+		}
+		hrefs := hrefRe.FindAllStringSubmatch(rec.Body.String(), -1)
+		if len(hrefs) == 0 {
+			t.Fatalf("%s: no hrefs advertised", version)
+		}
+		for _, m := range hrefs {
+			href := m[1]
+			if strings.ContainsAny(href, "{}<>") {
+				t.Errorf("%s: href %q is a template, not a URL", version, href)
+			}
+			if u, err := url.Parse(href); err != nil || u.Scheme == "" || u.Host == "" {
+				t.Errorf("%s: href %q is not an absolute URL", version, href)
+			}
+		}
+	}
+}
+
+// getMapBindings lists the GetMap OnlineResources of a capabilities
+// document as role: href
+func getMapBindings(t *testing.T, body []byte) map[string]string {
+	t.Helper()
+	var caps struct {
+		Resources []struct {
+			Role string `xml:"role,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"Capability>Request>GetMap>DCPType>HTTP>Get>OnlineResource"`
+	}
+	if err := xml.Unmarshal(body, &caps); err != nil {
+		t.Fatal(err)
+	}
+	bindings := map[string]string{}
+	for _, r := range caps.Resources {
+		bindings[r.Role] = r.Href
+	}
+	return bindings
+}
+
+func TestCapabilitiesPathBinding(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"LAYER_GROUPS": "surface=temp_2m"}, nil,
+		"temp_2m_2026101400.nc", "temp_2m_2026101406.nc")
+	tests := []struct {
+		name, dataset, wantPath string
+	}{
+		{"all layers", "", ""},
+		{"group", "/surface", ""},
+		{"layer", "/temp_2m", "/wms/temp_2m/temp_2m_2026101406.nc?"},
+		{"layer and file", "/temp_2m/temp_2m_2026101400.nc", "/wms/temp_2m/temp_2m_2026101400.nc?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, version := range []string{wms130, wms111} {
+				rec := e.get("/wms" + tt.dataset + "?SERVICE=WMS&REQUEST=GetCapabilities&VERSION=" + version)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: status %d: %.200s", version, rec.Code, rec.Body.String())
+				}
+				bindings := getMapBindings(t, rec.Body.Bytes())
+				if kvp := bindings[bindingKVP]; !strings.HasSuffix(kvp, "/wms?") {
+					t.Errorf("%s: KVP binding = %q, want the /wms? endpoint", version, kvp)
+				}
+				path, ok := bindings[bindingPath]
+				if tt.wantPath == "" {
+					if ok {
+						t.Errorf("%s: path binding %q advertised without a layer", version, path)
+					}
+					continue
+				}
+				u, err := url.Parse(path)
+				if err != nil || u.Host == "" || u.RequestURI() != tt.wantPath {
+					t.Fatalf("%s: path binding = %q, want an absolute URL to %s", version, path, tt.wantPath)
+				}
+
+				// A client appends its params to the href as advertised
+				get := e.get(u.RequestURI() + "SERVICE=WMS&REQUEST=GetMap&VERSION=" + version +
+					"&STYLES=&CRS=EPSG:4326&SRS=EPSG:4326&BBOX=0,0,10,10&WIDTH=4&HEIGHT=4&FORMAT=image/png")
+				if get.Code != http.StatusOK || get.Header().Get("Content-Type") != "image/png" {
+					t.Errorf("%s: GetMap at the path binding: %d %.200s", version, get.Code, get.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// jsonCapabilities is GetCapabilities as JSON for web clients, built from
+// the same helpers as the XML document. Bounding boxes keep the WMS 1.3.0
+// axis order of their CRS.
+type jsonCapabilities struct {
+	Version        string            `json:"version"`
+	UpdateSequence int64             `json:"updateSequence"`
+	Service        jsonCapsService   `json:"service"`
+	Requests       map[string]jsonOp `json:"requests"`
+	Exceptions     []string          `json:"exceptions"`
+	Profiles       map[string]string `json:"profiles"`
+	Palettes       []string          `json:"palettes"`
+	Layers         []jsonCapsLayer   `json:"layers"`
+	Groups         []jsonCapsGroup   `json:"groups"`
+}
+
+type jsonCapsService struct {
+	Name           string `json:"name"`
+	Title          string `json:"title"`
+	Abstract       string `json:"abstract"`
+	OnlineResource string `json:"onlineResource"`
+	LayerLimit     int    `json:"layerLimit,omitempty"`
+	MaxWidth       int    `json:"maxWidth,omitempty"`
+	MaxHeight      int    `json:"maxHeight,omitempty"`
+}
+
+type jsonOp struct {
+	Formats []string `json:"formats"`
+}
+
+type jsonCapsLayer struct {
+	Name          string            `json:"name"`
+	Title         string            `json:"title"`
+	Queryable     bool              `json:"queryable"`
+	CRS           []string          `json:"crs"`
+	GeographicBox [4]float64        `json:"geographicBoundingBox"` // west, south, east, north
+	BoundingBoxes []capsBoundingBox `json:"boundingBoxes"`
+	Dimensions    []capsDimension   `json:"dimensions"`
+	Styles        []jsonCapsStyle   `json:"styles"`
+	ValidRange    *jsonValidRange   `json:"validRange,omitempty"`
+	LogScale      bool              `json:"logScale"`
+	LastModified  string            `json:"lastModified"`
+}
+
+type jsonCapsGroup struct {
+	Name    string          `json:"name"`
+	Title   string          `json:"title"`
+	Members []string        `json:"members"`
+	CRS     []string        `json:"crs"`
+	Styles  []jsonCapsStyle `json:"styles"`
+}
+
+type jsonCapsStyle struct {
+	Name  string `json:"name"`
+	Title string `json:"title"`
+}
+
+type jsonValidRange struct {
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Masking string  `json:"masking"`
+}
+
+// wantsJSONCapabilities reports whether GetCapabilities should answer in
+// JSON: FORMAT=application/json, or no FORMAT and an Accept that lists it
+func wantsJSONCapabilities(r *http.Request, q url.Values) bool {
+	if f := strings.TrimSpace(q.Get("FORMAT")); f != "" {
+		mt, _, err := mime.ParseMediaType(f)
+		return err == nil && mt == "application/json"
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mt == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONCapabilities writes the capabilities of layers and groups as JSON
+func writeJSONCapabilities(w http.ResponseWriter, r *http.Request, layers []layerInfo, groups []string, seq int64) {
+	caps := jsonCapabilities{
+		Version:        "1.3.0",
+		UpdateSequence: seq,
+		Service: jsonCapsService{
+			Name:           "WMS",
+			Title:          "Weather Visualization WMS Server",
+			Abstract:       "Custom Golang WMS server for NOAA GFS weather data",
+			OnlineResource: serviceURL(r),
+			LayerLimit:     config().MaxLayers,
+			MaxWidth:       config().MaxWidth,
+			MaxHeight:      config().MaxHeight,
+		},
+		Requests:   map[string]jsonOp{},
+		Exceptions: exceptionFormats,
+		Profiles:   map[string]string{},
+		Palettes:   procInfo().Palettes,
+		Layers:     []jsonCapsLayer{},
+		Groups:     []jsonCapsGroup{},
+	}
+	for _, op := range capsOperations() {
+		caps.Requests[op.name] = jsonOp{Formats: op.formats}
+	}
+	for _, name := range profileNames() {
+		caps.Profiles[name] = config().Profiles[name].Encode()
+	}
+
+	for _, l := range layers {
+		ext, _ := layerExtent(l.Name)
+		lc := config().Layers[l.Name]
+		cl := jsonCapsLayer{
+			Name:          l.Name,
+			Title:         l.Name,
+			Queryable:     true,
+			CRS:           lc.crsList(),
+			GeographicBox: ext,
+			BoundingBoxes: boundingBoxes(ext, lc.crsList()),
+			Dimensions:    layerDimensions(l),
+			Styles:        []jsonCapsStyle{},
+			LogScale:      lc.LogScale,
+			LastModified:  l.LastModified.Format(time.RFC3339),
+		}
+		if cl.Dimensions == nil {
+			cl.Dimensions = []capsDimension{}
+		}
+		for _, name := range styleNames(l.Name) {
+			cl.Styles = append(cl.Styles, jsonCapsStyle{name, config().Styles[name].Title})
+		}
+		if lc.ValidRange != nil {
+			cl.ValidRange = &jsonValidRange{lc.ValidRange[0], lc.ValidRange[1], lc.maskingMode()}
+		}
+		caps.Layers = append(caps.Layers, cl)
+	}
+
+	for _, name := range groups {
+		members := config().LayerGroups[name]
+		g := jsonCapsGroup{
+			Name:    name,
+			Title:   fmt.Sprintf("%s (%s)", name, strings.Join(members, ", ")),
+			Members: members,
+			CRS:     groupCRS(name),
+			Styles:  []jsonCapsStyle{},
+		}
+		if isRGBGroup(name) {
+			g.Styles = append(g.Styles, jsonCapsStyle{rgbStyle, "RGB composite of " + strings.Join(members, ", ")})
+		}
+		caps.Groups = append(caps.Groups, g)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(caps)
+}
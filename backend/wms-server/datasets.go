@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// layerStyle is a style a layer can be requested with, as advertised in
+// its capabilities <Style> elements
+type layerStyle struct {
+	Name            string `json:"name"`
+	Title           string `json:"title"`
+	Palette         string `json:"palette,omitempty"`
+	ColorScaleRange string `json:"colorscalerange,omitempty"`
+}
+
+// datasetInfo describes a layer for frontend style and time controls
+type datasetInfo struct {
+	Name                   string       `json:"name"`
+	Title                  string       `json:"title"`
+	Units                  string       `json:"units,omitempty"`
+	Styles                 []layerStyle `json:"styles"`
+	Palettes               []string     `json:"palettes"`
+	DefaultPalette         string       `json:"defaultPalette,omitempty"`
+	DefaultColorScaleRange string       `json:"defaultColorScaleRange,omitempty"`
+	LogScale               bool         `json:"logScale,omitempty"`
+	Variable               string       `json:"variable,omitempty"`
+	DataRange              *[2]float64  `json:"dataRange,omitempty"` // data min, max
+	BBox                   [4]float64   `json:"bbox"`
+	LastModified           string       `json:"lastModified"`
+	// /meta only
+	Times      []string        `json:"times,omitempty"`
+	TimeSteps  []timeSegment   `json:"timeSteps,omitempty"`
+	Runs       []string        `json:"runs,omitempty"`
+	Dimensions []capsDimension `json:"dimensions,omitempty"` // only those the layer has
+}
+
+// timeSegment is a run of valid times at one spacing, e.g. 3-hourly to
+// +120h. Consecutive segments share the time the cadence changes at.
+type timeSegment struct {
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	StepHours float64 `json:"stepHours"`
+}
+
+// describeLayer combines the sidecar's title, units and color scale with
+// the style registry and the processor's palettes
+func describeLayer(l layerInfo) datasetInfo {
+	d := datasetInfo{
+		Name:         l.Name,
+		Title:        l.Name,
+		Styles:       []layerStyle{},
+		Palettes:     procInfo().Palettes,
+		LogScale:     config().Layers[l.Name].LogScale,
+		LastModified: l.LastModified.Format(time.RFC3339),
+	}
+	d.BBox, _ = layerExtent(l.Name)
+	if meta, ok := readSidecar(l.Name); ok {
+		if meta.Name != "" {
+			d.Title = meta.Name
+		}
+		d.Units = meta.Units
+		d.Variable = meta.Variable
+		if st := meta.Statistics; st.Min != nil && st.Max != nil {
+			d.DataRange = &[2]float64{*st.Min, *st.Max}
+		}
+		d.DefaultPalette = meta.ColorScale.Palette
+		if r := meta.ColorScale.Range; len(r) == 2 {
+			d.DefaultColorScaleRange = strconv.FormatFloat(r[0], 'g', -1, 64) + "," + strconv.FormatFloat(r[1], 'g', -1, 64)
+		}
+	}
+	for _, name := range styleNames(l.Name) {
+		s := config().Styles[name]
+		d.Styles = append(d.Styles, layerStyle{Name: name, Title: s.Title, Palette: s.Palette, ColorScaleRange: s.ColorScaleRange})
+	}
+	return d
+}
+
+// datasetsHandler lists every layer with its style options: /datasets
+func datasetsHandler(w http.ResponseWriter, r *http.Request) {
+	layers := layerIndex.Layers()
+	out := make([]datasetInfo, 0, len(layers))
+	for _, l := range layers {
+		out = append(out, describeLayer(l))
+	}
+	resp := map[string]interface{}{"datasets": out}
+	if warnings := layerIndex.Warnings(); len(warnings) > 0 {
+		resp["warnings"] = warnings
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// metaHandler describes one layer, adding its valid times and model runs:
+// /meta/{layer}
+func metaHandler(w http.ResponseWriter, r *http.Request) {
+	layer := mux.Vars(r)["layer"]
+	li, ok := layerIndex.Layer(layer)
+	if !ok {
+		writeJSONException(w, http.StatusNotFound, "LayerNotDefined", fmt.Sprintf("no data for layer %q", layer))
+		return
+	}
+	d := describeLayer(li)
+	steps := li.timeSteps()
+	for _, st := range steps {
+		d.Times = append(d.Times, st.Time.Format(time.RFC3339))
+	}
+	d.TimeSteps = timeSegments(steps)
+	for _, run := range li.runs() {
+		d.Runs = append(d.Runs, run.Format(time.RFC3339))
+	}
+	d.Dimensions = layerDimensions(li)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// timeSegments splits sorted valid times where the spacing between them
+// changes, so a time slider can space its ticks. A single time has none.
+func timeSegments(steps []timeStep) []timeSegment {
+	var out []timeSegment
+	for i := 1; i < len(steps); i++ {
+		from, to := steps[i-1].Time, steps[i].Time
+		gap := to.Sub(from)
+		if n := len(out); n > 0 && out[n-1].StepHours == gap.Hours() {
+			out[n-1].To = to.Format(time.RFC3339)
+			continue
+		}
+		out = append(out, timeSegment{From: from.Format(time.RFC3339), To: to.Format(time.RFC3339), StepHours: gap.Hours()})
+	}
+	return out
+}
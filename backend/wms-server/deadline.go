@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// requestDeadline bounds each request's context by REQUEST_TIMEOUT_MS, or
+// by the client's X-Timeout-Ms capped at MAX_REQUEST_TIMEOUT_MS. Interactive
+// clients can ask to fail fast while batch jobs allow longer renders; the
+// deadline reaches the processor through processorDo.
+func requestDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if timeout := requestTimeout(r.Header.Get("X-Timeout-Ms")); timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestTimeout parses X-Timeout-Ms, falling back to REQUEST_TIMEOUT_MS
+// when it's absent or not a positive integer
+func requestTimeout(header string) time.Duration {
+	ms, err := strconv.Atoi(header)
+	if err != nil || ms <= 0 {
+		return config().RequestTimeout
+	}
+	d := time.Duration(ms) * time.Millisecond
+	if config().MaxRequestTimeout > 0 && d > config().MaxRequestTimeout {
+		d = config().MaxRequestTimeout
+	}
+	return d
+}
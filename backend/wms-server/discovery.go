@@ -0,0 +1,541 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dataFile is a single NetCDF file found under DataDir
+type dataFile struct {
+	Name         string
+	Path         string
+	RunTime      time.Time
+	ModTime      time.Time
+	Size         int64
+	Level        string // from the pattern's "level" group, if any
+	Member       string // from the pattern's "member" group, if any
+	ForecastHour int    // from the "fhour" group; -1 when the file holds every forecast hour
+}
+
+// layerInfo groups the files discovered for one layer (parameter)
+type layerInfo struct {
+	Name         string
+	Files        []dataFile // oldest run first
+	LastModified time.Time
+}
+
+// defaultFilenamePattern matches the fetcher's <layer>_<YYYYMMDDHH>.nc
+const defaultFilenamePattern = `^(?P<layer>.+)_(?P<time>\d{10})\.nc$`
+
+// compileFilenamePattern validates FILENAME_PATTERN. Named groups: time
+// (required, parsed with FILENAME_TIME_LAYOUT), layer (else the parent
+// directory name), level, member and fhour (all optional).
+func compileFilenamePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.SubexpIndex("time") < 0 {
+		return nil, fmt.Errorf("pattern must have a named group (?P<time>...)")
+	}
+	return re, nil
+}
+
+// parseDataFileName applies the filename pattern. ok is false for files
+// that don't follow the naming convention.
+func parseDataFileName(p string) (layer string, f dataFile, ok bool) {
+	re := config().FilenamePattern
+	name := filepath.Base(p)
+	m := re.FindStringSubmatch(name)
+	if m == nil {
+		return "", f, false
+	}
+	group := func(g string) string {
+		if i := re.SubexpIndex(g); i >= 0 {
+			return m[i]
+		}
+		return ""
+	}
+
+	runTime, err := time.Parse(config().FilenameTimeLayout, group("time"))
+	if err != nil {
+		return "", f, false
+	}
+	f = dataFile{
+		Name:         name,
+		Path:         p,
+		RunTime:      runTime.UTC(),
+		Level:        group("level"),
+		Member:       group("member"),
+		ForecastHour: -1,
+	}
+	if fh := group("fhour"); fh != "" {
+		if f.ForecastHour, err = strconv.Atoi(fh); err != nil {
+			return "", f, false
+		}
+	}
+
+	layer = group("layer")
+	if layer == "" {
+		layer = filepath.Base(filepath.Dir(p))
+	}
+	return layer, f, true
+}
+
+// discoverLayers walks dataDir and groups NetCDF files by layer name.
+// The result is sorted by layer name. Only an unreadable dataDir is an
+// error: a subdirectory or file that can't be read is reported in warnings
+// and the layer it belongs to is left out rather than listed incomplete.
+// Files ignored in favour of a duplicate are listed in duplicates.
+func discoverLayers(dataDir string) (layers []layerInfo, warnings, duplicates []string, err error) {
+	byName := map[string]*layerInfo{}
+	failed := map[string]bool{}
+	err = filepath.WalkDir(dataDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dataDir {
+				return err
+			}
+			// A directory named after a layer holds that layer's files
+			layer := filepath.Base(p)
+			if d != nil && !d.IsDir() {
+				layer, _, _ = parseDataFileName(p)
+			}
+			if layer != "" {
+				failed[layer] = true
+			}
+			warnings = append(warnings, fmt.Sprintf("skipping %s: %v", p, err))
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".nc") {
+			return nil
+		}
+		layer, df, ok := parseDataFileName(p)
+		if !ok {
+			if config().Debug {
+				log.Printf("Skipping %s: name doesn't match FILENAME_PATTERN", p)
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			failed[layer] = true
+			warnings = append(warnings, fmt.Sprintf("skipping %s: %v", p, err))
+			return nil
+		}
+		df.ModTime = fi.ModTime().UTC()
+		df.Size = fi.Size()
+
+		li, ok := byName[layer]
+		if !ok {
+			li = &layerInfo{Name: layer}
+			byName[layer] = li
+		}
+		li.Files = append(li.Files, df)
+		if df.ModTime.After(li.LastModified) {
+			li.LastModified = df.ModTime
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// By name, so warnings and duplicates come out in the same order on
+	// every scan
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	layers = make([]layerInfo, 0, len(byName))
+	for _, name := range names {
+		li := byName[name]
+		if failed[li.Name] {
+			warnings = append(warnings, fmt.Sprintf("layer %s left out: some of its files are unreadable", li.Name))
+			continue
+		}
+		var dups []string
+		li.Files, dups = dedupeFiles(li.Name, li.Files)
+		duplicates = append(duplicates, dups...)
+		sort.Slice(li.Files, func(i, j int) bool {
+			a, b := li.Files[i], li.Files[j]
+			if !a.RunTime.Equal(b.RunTime) {
+				return a.RunTime.Before(b.RunTime)
+			}
+			return a.Name < b.Name
+		})
+		layers = append(layers, *li)
+	}
+	return layers, warnings, duplicates, nil
+}
+
+// fileSlot is what makes two files interchangeable: same run, forecast
+// hour, level and member
+type fileSlot struct {
+	run    time.Time
+	fhour  int
+	level  string
+	member string
+}
+
+// dedupeFiles keeps one file per slot, so a partial re-download or a stray
+// copy can't make the time dimension list a timestamp twice or render from
+// whichever file happened to sort last. The most recently modified file
+// wins, then the largest, then the first by path. Each file ignored is
+// described in dups.
+func dedupeFiles(layer string, files []dataFile) (out []dataFile, dups []string) {
+	best := map[fileSlot]int{}
+	out = files[:0:0]
+	for _, f := range files {
+		slot := fileSlot{f.RunTime, f.ForecastHour, f.Level, f.Member}
+		i, seen := best[slot]
+		if !seen {
+			best[slot] = len(out)
+			out = append(out, f)
+			continue
+		}
+		keep, drop := out[i], f
+		if preferFile(f, keep) {
+			keep, drop = f, keep
+			out[i] = f
+		}
+		dups = append(dups, fmt.Sprintf("layer %s has two files for run %s, using %s and ignoring %s",
+			layer, f.RunTime.Format(time.RFC3339), keep.Path, drop.Path))
+	}
+	return out, dups
+}
+
+// preferFile reports whether a should be used over b for the same slot
+func preferFile(a, b dataFile) bool {
+	if !a.ModTime.Equal(b.ModTime) {
+		return a.ModTime.After(b.ModTime)
+	}
+	if a.Size != b.Size {
+		return a.Size > b.Size
+	}
+	return a.Path < b.Path
+}
+
+// newestModTime returns the most recent modification time across layers
+func newestModTime(layers []layerInfo) time.Time {
+	var newest time.Time
+	for _, l := range layers {
+		if l.LastModified.After(newest) {
+			newest = l.LastModified
+		}
+	}
+	return newest
+}
+
+// Forecast hours contained in each file, matching the fetcher's range(0, 49, 3)
+var forecastHours = func() []int {
+	hours := make([]int, 0, 17)
+	for h := 0; h <= 48; h += 3 {
+		hours = append(hours, h)
+	}
+	return hours
+}()
+
+// timeStep is a valid time and the file that holds it
+type timeStep struct {
+	Time time.Time
+	File dataFile
+}
+
+// timeSteps expands the layer's runs into valid times. When runs overlap,
+// the most recent run wins.
+func (l layerInfo) timeSteps() []timeStep {
+	byTime := map[time.Time]dataFile{}
+	for _, f := range l.Files {
+		if f.ForecastHour >= 0 {
+			byTime[f.RunTime.Add(time.Duration(f.ForecastHour)*time.Hour)] = f
+			continue
+		}
+		for _, h := range forecastHours {
+			byTime[f.RunTime.Add(time.Duration(h)*time.Hour)] = f
+		}
+	}
+	steps := make([]timeStep, 0, len(byTime))
+	for t, f := range byTime {
+		steps = append(steps, timeStep{Time: t, File: f})
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].Time.Before(steps[j].Time) })
+	return steps
+}
+
+// findLayer returns the named layer from a discovery result
+func findLayer(layers []layerInfo, name string) (layerInfo, bool) {
+	for _, l := range layers {
+		if l.Name == name {
+			return l, true
+		}
+	}
+	return layerInfo{}, false
+}
+
+// maxSidecarBytes bounds a decompressed sidecar
+const maxSidecarBytes = 1 << 20
+
+// worldExtent is the lon/lat extent used when a layer's bounds are unknown
+var worldExtent = [4]float64{-180, -90, 180, 90}
+
+// sidecarDataset is the newest dataset entry of the layer's metadata
+// sidecar: one written next to the newest data file by the ingestion
+// pipeline and/or the processor's DATA_DIR/metadata/<layer>.json. Either
+// may be gzipped as .json.gz.
+type sidecarDataset struct {
+	Name   string `json:"name"`
+	Units  string `json:"units"`
+	Bounds struct {
+		West  *float64 `json:"west"`
+		South *float64 `json:"south"`
+		East  *float64 `json:"east"`
+		North *float64 `json:"north"`
+	} `json:"bounds"`
+	ColorScale struct {
+		Palette string    `json:"palette"`
+		Range   []float64 `json:"range"`
+	} `json:"colorScale"`
+	Variable   string `json:"variable"` // NetCDF data variable
+	Statistics struct {
+		Min *float64 `json:"min"`
+		Max *float64 `json:"max"`
+	} `json:"statistics"`
+}
+
+// readSidecar loads the layer's sidecar through the metadata cache; ok is
+// false when there is none. Fields the pipeline's sidecar leaves out are
+// filled from the processor's.
+func readSidecar(name string) (sidecarDataset, bool) {
+	var candidates []string
+	if l, ok := layerIndex.Layer(name); ok && len(l.Files) > 0 {
+		base := strings.TrimSuffix(l.Files[len(l.Files)-1].Path, ".nc")
+		candidates = append(candidates, base+".json.gz", base+".json")
+	}
+	base := filepath.Join(config().DataDir, "metadata", name)
+	candidates = append(candidates, base+".json", base+".json.gz")
+
+	found := sidecars.lookup(name, candidates)
+	if len(found) == 0 {
+		return sidecarDataset{}, false
+	}
+	out := found[0]
+	for _, meta := range found[1:] {
+		if out.Name == "" {
+			out.Name = meta.Name
+		}
+		if out.Units == "" {
+			out.Units = meta.Units
+		}
+		if out.Bounds.West == nil {
+			out.Bounds = meta.Bounds
+		}
+		if out.ColorScale.Palette == "" {
+			out.ColorScale.Palette = meta.ColorScale.Palette
+		}
+		if out.ColorScale.Range == nil {
+			out.ColorScale.Range = meta.ColorScale.Range
+		}
+		if out.Variable == "" {
+			out.Variable = meta.Variable
+		}
+		if out.Statistics.Min == nil || out.Statistics.Max == nil {
+			out.Statistics = meta.Statistics
+		}
+	}
+	return out, true
+}
+
+// loadSidecar decodes one sidecar file, decompressing .gz. Both the
+// processor's {"datasets": [...]} and a bare dataset object are accepted.
+func loadSidecar(p string) (sidecarDataset, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return sidecarDataset{}, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(p, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return sidecarDataset{}, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxSidecarBytes+1))
+	if err != nil {
+		return sidecarDataset{}, err
+	}
+	if len(data) > maxSidecarBytes {
+		return sidecarDataset{}, fmt.Errorf("larger than %d bytes", maxSidecarBytes)
+	}
+	var meta struct {
+		Datasets []sidecarDataset `json:"datasets"`
+		sidecarDataset
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return sidecarDataset{}, err
+	}
+	if len(meta.Datasets) > 0 {
+		return meta.Datasets[0], nil
+	}
+	if meta.Name == "" && meta.Units == "" && meta.Variable == "" && meta.ColorScale.Range == nil && meta.Bounds.West == nil {
+		return sidecarDataset{}, fmt.Errorf("no datasets")
+	}
+	return meta.sidecarDataset, nil
+}
+
+// layerExtent returns the layer's lon/lat extent (minx, miny, maxx, maxy)
+// from the processor's metadata sidecar, falling back to the world extent
+func layerExtent(name string) ([4]float64, bool) {
+	meta, ok := readSidecar(name)
+	if !ok {
+		return worldExtent, false
+	}
+	b := meta.Bounds
+	if b.West == nil || b.South == nil || b.East == nil || b.North == nil {
+		return worldExtent, false
+	}
+	ext := [4]float64{*b.West, *b.South, *b.East, *b.North}
+	// GFS grids use 0..360 longitudes; the processor serves them as -180..180
+	if ext[2] > 180 {
+		ext[0], ext[2] = -180, 180
+	}
+	return ext, true
+}
+
+// layersExtent is the union of the named layers' extents; layers with
+// unknown bounds count as the whole world
+func layersExtent(names []string) [4]float64 {
+	var ext [4]float64
+	for i, name := range names {
+		e, _ := layerExtent(name)
+		if i == 0 {
+			ext = e
+			continue
+		}
+		ext[0], ext[1] = math.Min(ext[0], e[0]), math.Min(ext[1], e[1])
+		ext[2], ext[3] = math.Max(ext[2], e[2]), math.Max(ext[3], e[3])
+	}
+	return ext
+}
+
+// members returns the layer's ensemble member names (empty for
+// deterministic layers)
+func (l layerInfo) members() []string {
+	seen := map[string]bool{}
+	var members []string
+	for _, f := range l.Files {
+		if f.Member != "" && !seen[f.Member] {
+			seen[f.Member] = true
+			members = append(members, f.Member)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// levels returns the layer's vertical levels from the filename pattern's
+// level group, numerically when they're all numbers (empty when the layer
+// has no elevation dimension)
+func (l layerInfo) levels() []string {
+	seen := map[string]bool{}
+	var levels []string
+	numeric := true
+	for _, f := range l.Files {
+		if f.Level != "" && !seen[f.Level] {
+			seen[f.Level] = true
+			levels = append(levels, f.Level)
+			if _, err := strconv.ParseFloat(f.Level, 64); err != nil {
+				numeric = false
+			}
+		}
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		if numeric {
+			a, _ := strconv.ParseFloat(levels[i], 64)
+			b, _ := strconv.ParseFloat(levels[j], 64)
+			return a < b
+		}
+		return levels[i] < levels[j]
+	})
+	return levels
+}
+
+// atLevel narrows the layer to the files of one vertical level
+func (l layerInfo) atLevel(level string) layerInfo {
+	out := layerInfo{Name: l.Name, LastModified: l.LastModified}
+	for _, f := range l.Files {
+		if f.Level == level {
+			out.Files = append(out.Files, f)
+		}
+	}
+	return out
+}
+
+// defaultMember is the control/deterministic member, or the first one
+func (l layerInfo) defaultMember() string {
+	members := l.members()
+	for _, m := range members {
+		if m == config().EnsembleControl {
+			return m
+		}
+	}
+	if len(members) > 0 {
+		return members[0]
+	}
+	return ""
+}
+
+// runFiles returns the layer's files for one model run
+func (l layerInfo) runFiles(run time.Time) []dataFile {
+	var files []dataFile
+	for _, f := range l.Files {
+		if f.RunTime.Equal(run) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// fileByName returns the layer's file with the given base name
+func (l layerInfo) fileByName(name string) (dataFile, bool) {
+	for _, f := range l.Files {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return dataFile{}, false
+}
+
+// runs returns the layer's distinct model run (reference) times, oldest first
+func (l layerInfo) runs() []time.Time {
+	var runs []time.Time
+	for _, f := range l.Files {
+		if len(runs) == 0 || !runs[len(runs)-1].Equal(f.RunTime) {
+			runs = append(runs, f.RunTime)
+		}
+	}
+	return runs
+}
+
+// runSteps returns the valid times covered by a single model run
+func (l layerInfo) runSteps(run time.Time) []timeStep {
+	return layerInfo{Name: l.Name, Files: l.runFiles(run)}.timeSteps()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCache is the second cache tier: entries evicted from memory are
+// spilled to <dir>/<aa>/<sha256 of key>, holding a header line and the
+// image after it. The header is the content type, then tab-separated
+// nodata and render=<duration> when set, so a tile read back is served
+// as it was rendered. When the total size passes maxBytes the least
+// recently used files are removed.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	size     int64
+	evicting bool
+}
+
+// newDiskCache opens dir, counting what a previous run left behind
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &diskCache{dir: dir, maxBytes: maxBytes}
+	for _, f := range d.files() {
+		d.size += f.size
+	}
+	return d, nil
+}
+
+func (d *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(d.dir, name[:2], name)
+}
+
+func (d *diskCache) Get(key string) (cacheEntry, bool) {
+	p := d.path(key)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return cacheEntry{}, false
+	}
+	header, body, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return cacheEntry{}, false
+	}
+	fields := strings.Split(string(header), "\t")
+	entry := cacheEntry{ContentType: fields[0], Body: body}
+	for _, f := range fields[1:] {
+		name, value, _ := strings.Cut(f, "=")
+		switch name {
+		case "nodata":
+			entry.NoData = true
+		case "render":
+			entry.RenderTime, _ = time.ParseDuration(value)
+		}
+	}
+	// mtime doubles as the last-access time for eviction
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return entry, true
+}
+
+func (d *diskCache) Put(key string, entry cacheEntry) {
+	header := entry.ContentType
+	if entry.NoData {
+		header += "\tnodata"
+	}
+	if entry.RenderTime > 0 {
+		header += "\trender=" + entry.RenderTime.String()
+	}
+	data := make([]byte, 0, len(header)+1+len(entry.Body))
+	data = append(append(append(data, header...), '\n'), entry.Body...)
+
+	p := d.path(key)
+	var old int64
+	if fi, err := os.Stat(p); err == nil {
+		old = fi.Size()
+	}
+	if err := writeFileAtomic(p, data); err != nil {
+		log.Printf("Disk cache write failed: %v", err)
+		return
+	}
+
+	d.mu.Lock()
+	d.size += int64(len(data)) - old
+	over := d.maxBytes > 0 && d.size > d.maxBytes && !d.evicting
+	if over {
+		d.evicting = true
+	}
+	d.mu.Unlock()
+	if over {
+		go d.evict()
+	}
+}
+
+type diskCacheFile struct {
+	path  string
+	size  int64
+	mtime time.Time
+}
+
+func (d *diskCache) files() []diskCacheFile {
+	var files []diskCacheFile
+	filepath.Walk(d.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+		files = append(files, diskCacheFile{path: p, size: fi.Size(), mtime: fi.ModTime()})
+		return nil
+	})
+	return files
+}
+
+// evict removes least recently used files until the cache is back to 90%
+// of its limit, leaving headroom so it doesn't run on every spill
+func (d *diskCache) evict() {
+	files := d.files()
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	target := d.maxBytes / 10 * 9
+	removed := 0
+	for _, f := range files {
+		if total <= target {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			total -= f.size
+			removed++
+		}
+	}
+
+	d.mu.Lock()
+	d.size = total
+	d.evicting = false
+	d.mu.Unlock()
+	if config().Debug {
+		log.Printf("Disk cache evicted %d files, %d bytes left", removed, total)
+	}
+}
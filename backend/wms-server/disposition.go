@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// inlineFormats are the image types browsers display; any other GetMap
+// format (GeoTIFF, NetCDF) is offered as a download
+var inlineFormats = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// downloadExtensions names files for formats mime doesn't know, or knows
+// under an unhelpful extension
+var downloadExtensions = map[string]string{
+	"image/tiff":           "tiff",
+	"image/geotiff":        "tiff",
+	"application/x-netcdf": "nc",
+	"application/netcdf":   "nc",
+}
+
+// setDisposition marks a render in a download format as an attachment
+// named <layer>_<time>.<ext>, from the processor params v. Viewable images
+// get no header so web maps show them inline.
+func setDisposition(w http.ResponseWriter, contentType string, v url.Values) {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || inlineFormats[mt] {
+		return
+	}
+	name := fmt.Sprintf("%s_%s.%s", v.Get("layer"), dispositionTime(v), formatExtension(mt))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", safeFilename(name)))
+}
+
+// dispositionTime is the render's valid time: TIME when it is a single
+// instant, else the layer default the processor falls back to
+func dispositionTime(v url.Values) string {
+	const stamp = "20060102T150405Z"
+	if t, err := time.Parse(time.RFC3339, v.Get("time")); err == nil {
+		return t.UTC().Format(stamp)
+	}
+	if li, ok := layerIndex.Layer(v.Get("layer")); ok {
+		if d, ok := timeDimension(li.timeSteps()); ok {
+			if t, err := time.Parse(time.RFC3339, d.Default); err == nil {
+				return t.UTC().Format(stamp)
+			}
+		}
+	}
+	return "latest"
+}
+
+func formatExtension(mediaType string) string {
+	if ext, ok := downloadExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return strings.TrimPrefix(exts[0], ".")
+	}
+	return "bin"
+}
+
+// safeFilename keeps letters, digits, dot, dash and underscore, so layer
+// names can't break out of the quoted header value or name a path
+func safeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// writeServiceException writes a WMS 1.3.0 ServiceExceptionReport
+func writeServiceException(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ServiceExceptionReport version="1.3.0" xmlns="http://www.opengis.net/ogc">
+  <ServiceException code="%s">%s</ServiceException>
+</ServiceExceptionReport>`, xmlEscape(code), xmlEscape(msg))
+}
+
+// writeJSONException writes the error shape used by JSON clients
+func writeJSONException(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg, "code": code})
+}
+
+// exceptionsFormat normalizes an EXCEPTIONS value to XML, INIMAGE, BLANK or
+// JSON, accepting the WMS MIME type spellings. Empty means the spec
+// default, XML.
+func exceptionsFormat(s string) (string, bool) {
+	switch strings.ToLower(s) {
+	case "", "xml", "application/vnd.ogc.se_xml", "text/xml":
+		return "XML", true
+	case "inimage", "application/vnd.ogc.se_inimage":
+		return "INIMAGE", true
+	case "blank", "application/vnd.ogc.se_blank":
+		return "BLANK", true
+	case "json", "application/json":
+		return "JSON", true
+	}
+	return "", false
+}
+
+// writeWMSException reports an error in the format the request's
+// EXCEPTIONS asks for. Image formats answer 200 so map clients draw them.
+func writeWMSException(w http.ResponseWriter, q url.Values, status int, code, msg string) {
+	format, _ := exceptionsFormat(q.Get("EXCEPTIONS"))
+	switch format {
+	case "JSON":
+		writeJSONException(w, status, code, msg)
+	case "INIMAGE", "BLANK":
+		width, _ := strconv.Atoi(q.Get("WIDTH"))
+		height, _ := strconv.Atoi(q.Get("HEIGHT"))
+		if width <= 0 || (config().MaxWidth > 0 && width > config().MaxWidth) {
+			width = 256
+		}
+		if height <= 0 || (config().MaxHeight > 0 && height > config().MaxHeight) {
+			height = 256
+		}
+		text := ""
+		if format == "INIMAGE" {
+			text = code + ": " + msg
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		png.Encode(w, exceptionImage(width, height, text, exceptionBackground(q)))
+	default:
+		writeServiceException(w, status, code, msg)
+	}
+}
+
+// exceptionBackground honors TRANSPARENT and BGCOLOR (0xRRGGBB); the WMS
+// default is an opaque white background
+func exceptionBackground(q url.Values) color.Color {
+	if strings.EqualFold(q.Get("TRANSPARENT"), "true") {
+		return color.Transparent
+	}
+	bg := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	if s := strings.TrimPrefix(strings.ToLower(q.Get("BGCOLOR")), "0x"); len(s) == 6 {
+		if n, err := strconv.ParseUint(s, 16, 32); err == nil {
+			bg = color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 0xff}
+		}
+	}
+	return bg
+}
+
+// exceptionImage draws text, wrapped to the image width, over bg
+func exceptionImage(width, height int, text string, bg color.Color) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	if text == "" {
+		return img
+	}
+
+	face := basicfont.Face7x13
+	d := font.Drawer{Dst: img, Src: image.NewUniform(color.RGBA{0xc0, 0, 0, 0xff}), Face: face}
+	perLine := (width - 8) / face.Advance
+	if perLine < 1 {
+		return img
+	}
+	y := 4 + face.Ascent
+	for _, line := range wrapText(text, perLine) {
+		if y > height {
+			break
+		}
+		d.Dot = fixed.P(4, y)
+		d.DrawString(line)
+		y += face.Height
+	}
+	return img
+}
+
+// wrapText breaks s into lines of at most n characters, on spaces where
+// possible
+func wrapText(s string, n int) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(s) {
+		for len(word) > n {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			lines = append(lines, word[:n])
+			word = word[n:]
+		}
+		switch {
+		case line == "":
+			line = word
+		case len(line)+1+len(word) <= n:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
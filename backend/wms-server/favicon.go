@@ -0,0 +1,21 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed static/favicon.ico
+var faviconICO []byte
+
+// faviconHandler serves the embedded icon, or 204 when FAVICON=none, so
+// browser-based testing doesn't fill the logs with 404s
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if config().Favicon == "none" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "image/x-icon")
+	w.Write(faviconICO)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Max concurrent processor queries for a time-series request
+const seriesConcurrency = 4
+
+// seriesPoint is one entry of a GetFeatureInfo time-series
+type seriesPoint struct {
+	Time  string   `json:"time"`
+	Value *float64 `json:"value"`
+}
+
+func handleGetFeatureInfo(w http.ResponseWriter, r *http.Request, dataset string, q url.Values) {
+	if strings.EqualFold(q.Get("SERIES"), "true") {
+		handleFeatureInfoSeries(w, r, dataset, q)
+		return
+	}
+
+	layer, file, err := splitDataset(dataset)
+	if err != nil {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	if layer == "" {
+		layer = featureInfoLayer(q)
+	}
+	if layer == "" {
+		writeWMSException(w, q, http.StatusBadRequest, "MissingParameterValue", "QUERY_LAYERS or LAYERS is required")
+		return
+	}
+
+	lon, lat, err := featureInfoPoint(q)
+	if err != nil {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidPoint", err.Error())
+		return
+	}
+
+	var t time.Time
+	if ts := q.Get("TIME"); ts != "" {
+		if t, err = time.Parse(time.RFC3339, ts); err != nil {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidDimensionValue", "invalid TIME, expected RFC3339")
+			return
+		}
+	}
+
+	pv, err := queryPointValue(r.Context(), layer, file, "", lon, lat, t)
+	if err != nil {
+		log.Printf("Point query failed for %s: %v", layer, err)
+		writeWMSException(w, q, http.StatusBadGateway, "NoApplicableCode", err.Error())
+		return
+	}
+
+	decimals := featureInfoDecimals(layer)
+	value := roundValue(pv.Value, decimals)
+	if isGeoJSON(q.Get("INFO_FORMAT")) {
+		w.Header().Set("Content-Type", "application/geo+json")
+		json.NewEncoder(w).Encode(featureInfoGeoJSON(q, lon, lat, map[string]interface{}{
+			"dataset":   dataset,
+			"layer":     layer,
+			"time":      pv.Time,
+			"value":     value,
+			"units":     pv.Units,
+			"formatted": formatValue(value, decimals, pv.Units),
+		}))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dataset":   dataset,
+		"layer":     layer,
+		"lon":       lon,
+		"lat":       lat,
+		"time":      pv.Time,
+		"value":     value,
+		"units":     pv.Units,
+		"formatted": formatValue(value, decimals, pv.Units),
+	})
+}
+
+func isGeoJSON(format string) bool {
+	return strings.EqualFold(format, "application/geo+json") || strings.EqualFold(format, "application/vnd.geo+json")
+}
+
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	BBox     []float64        `json:"bbox"`
+	CRS      *geoJSONCRS      `json:"crs,omitempty"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	BBox       []float64              `json:"bbox"`
+	Geometry   geoJSONPoint           `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// geoJSONCRS is the pre-RFC 7946 named CRS member
+type geoJSONCRS struct {
+	Type       string            `json:"type"`
+	Properties map[string]string `json:"properties"`
+}
+
+// featureInfoGeoJSON wraps the queried point as a FeatureCollection. RFC
+// 7946 coordinates are WGS84 lon,lat; with GEOJSON_NAMED_CRS a Web
+// Mercator request gets its own CRS back, labelled with a crs member.
+func featureInfoGeoJSON(q url.Values, lon, lat float64, props map[string]interface{}) geoJSONCollection {
+	x, y := lon, lat
+	var crs *geoJSONCRS
+	if config().GeoJSONNamedCRS && isWebMercator(requestCRS(q)) {
+		x, y = lonLatToMercator(lon, lat)
+		crs = &geoJSONCRS{Type: "name", Properties: map[string]string{"name": "urn:ogc:def:crs:EPSG::3857"}}
+	}
+	bbox := []float64{x, y, x, y}
+	return geoJSONCollection{
+		Type: "FeatureCollection",
+		BBox: bbox,
+		CRS:  crs,
+		Features: []geoJSONFeature{{
+			Type:       "Feature",
+			BBox:       bbox,
+			Geometry:   geoJSONPoint{Type: "Point", Coordinates: []float64{x, y}},
+			Properties: props,
+		}},
+	}
+}
+
+// handleFeatureInfoSeries returns the value at the clicked point for every
+// available timestamp of the layer (meteogram data)
+func handleFeatureInfoSeries(w http.ResponseWriter, r *http.Request, dataset string, q url.Values) {
+	layer, _, err := splitDataset(dataset)
+	if err != nil {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	if layer == "" {
+		layer = featureInfoLayer(q)
+	}
+	if layer == "" {
+		writeWMSException(w, q, http.StatusBadRequest, "MissingParameterValue", "QUERY_LAYERS or LAYERS is required")
+		return
+	}
+
+	lon, lat, err := featureInfoPoint(q)
+	if err != nil {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidPoint", err.Error())
+		return
+	}
+
+	li, ok := layerIndex.Layer(layer)
+	if !ok {
+		writeWMSException(w, q, http.StatusNotFound, "LayerNotDefined", fmt.Sprintf("no data for layer %q", layer))
+		return
+	}
+
+	// Query each timestep with bounded concurrency; results keep time order
+	steps := li.timeSteps()
+	decimals := featureInfoDecimals(layer)
+	series := make([]seriesPoint, len(steps))
+	sem := make(chan struct{}, seriesConcurrency)
+	var wg sync.WaitGroup
+	for i, step := range steps {
+		series[i].Time = step.Time.Format(time.RFC3339)
+		wg.Add(1)
+		go func(i int, step timeStep) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			pv, err := queryPointValue(r.Context(), layer, step.File.Name, "", lon, lat, step.Time)
+			if err != nil {
+				log.Printf("Series query failed for %s at %s: %v", layer, series[i].Time, err)
+				return
+			}
+			series[i].Value = roundValue(pv.Value, decimals)
+		}(i, step)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dataset": dataset,
+		"layer":   layer,
+		"lon":     lon,
+		"lat":     lat,
+		"series":  series,
+	})
+}
+
+// featureInfoLayer picks the queried layer from QUERY_LAYERS, then LAYERS
+func featureInfoLayer(q url.Values) string {
+	l := q.Get("QUERY_LAYERS")
+	if l == "" {
+		l = q.Get("LAYERS")
+	}
+	if i := strings.Index(l, ","); i >= 0 {
+		l = l[:i]
+	}
+	return l
+}
+
+// featureInfoPoint resolves the clicked point to lon/lat. Accepts explicit
+// LON/LAT, or the WMS BBOX/WIDTH/HEIGHT with I/J (1.3.0) or X/Y (1.1.1).
+func featureInfoPoint(q url.Values) (lon, lat float64, err error) {
+	if q.Get("LON") != "" && q.Get("LAT") != "" {
+		lon, err1 := strconv.ParseFloat(q.Get("LON"), 64)
+		lat, err2 := strconv.ParseFloat(q.Get("LAT"), 64)
+		if err1 != nil || err2 != nil {
+			return 0, 0, fmt.Errorf("invalid LON/LAT")
+		}
+		return lon, lat, nil
+	}
+
+	if q.Get("BBOX") == "" {
+		return 0, 0, fmt.Errorf("BBOX is required")
+	}
+	if _, err := parseBBoxValues(q.Get("BBOX")); err != nil {
+		return 0, 0, err
+	}
+	bb, _ := requestBBox(q)
+	width, _ := strconv.Atoi(q.Get("WIDTH"))
+	height, _ := strconv.Atoi(q.Get("HEIGHT"))
+	if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("WIDTH and HEIGHT are required")
+	}
+	is, js := q.Get("I"), q.Get("J")
+	if is == "" && js == "" {
+		is, js = q.Get("X"), q.Get("Y")
+	}
+	i, err1 := strconv.Atoi(is)
+	j, err2 := strconv.Atoi(js)
+	if err1 != nil || err2 != nil || i < 0 || j < 0 || i >= width || j >= height {
+		return 0, 0, fmt.Errorf("invalid I/J pixel coordinates")
+	}
+
+	// Pixel centre in CRS units, then to lon/lat
+	x := bb[0] + (float64(i)+0.5)/float64(width)*(bb[2]-bb[0])
+	y := bb[3] - (float64(j)+0.5)/float64(height)*(bb[3]-bb[1])
+	if isWebMercator(requestCRS(q)) {
+		x, y = mercatorToLonLat(x, y)
+	}
+	return x, y, nil
+}
+
+// pointValue is the processor's answer to a point query
+type pointValue struct {
+	Value *float64 `json:"value"` // nil means no-data at that point
+	Units string   `json:"units"`
+	Time  string   `json:"time"`
+}
+
+// queryPointValue asks the processor for the grid value at lon/lat. File
+// and elevation are optional; the processor picks the vertical level.
+func queryPointValue(ctx context.Context, layer, file, elevation string, lon, lat float64, t time.Time) (pointValue, error) {
+	var pv pointValue
+
+	v := url.Values{}
+	v.Set("layer", layer)
+	if file != "" {
+		v.Set("file", file)
+	}
+	if elevation != "" {
+		v.Set("elevation", elevation)
+	}
+	v.Set("lon", strconv.FormatFloat(lon, 'f', -1, 64))
+	v.Set("lat", strconv.FormatFloat(lat, 'f', -1, 64))
+	if !t.IsZero() {
+		v.Set("time", t.Format(time.RFC3339))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config().ProcessorURL+config().ProcessorPointPath+"?"+processorQuery(v), nil)
+	if err != nil {
+		return pv, err
+	}
+	resp, err := processorDo(req)
+	if err != nil {
+		return pv, fmt.Errorf("point query backend error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		// A 404 here almost always means the endpoint itself is missing
+		// (an unknown layer is reported in the JSON body instead)
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != "" && body.Error != "Not found" {
+			return pv, fmt.Errorf("processor: %s", body.Error)
+		}
+		return pv, fmt.Errorf("processor does not support point queries (%s returned %s); check PROCESSOR_POINT_PATH",
+			config().ProcessorPointPath, resp.Status)
+	default:
+		return pv, fmt.Errorf("processor returned %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&pv); err != nil {
+		return pv, fmt.Errorf("invalid processor response: %v", err)
+	}
+	return pv, nil
+}
+
+// featureInfoDecimals is the display precision for a layer's values
+func featureInfoDecimals(layer string) int {
+	if lc, ok := config().Layers[layer]; ok && lc.Decimals != nil {
+		return *lc.Decimals
+	}
+	return config().FeatureInfoDecimals
+}
+
+// roundValue rounds v to the given decimals; nil (no-data) and non-finite
+// values come back as nil
+func roundValue(v *float64, decimals int) *float64 {
+	if v == nil || math.IsNaN(*v) || math.IsInf(*v, 0) {
+		return nil
+	}
+	p := math.Pow(10, float64(decimals))
+	r := math.Round(*v*p) / p
+	if math.IsInf(*v*p, 0) {
+		r = *v // too large to scale; already beyond the requested precision
+	}
+	return &r
+}
+
+// formatValue renders a rounded value with its units for display
+func formatValue(v *float64, decimals int, units string) *string {
+	if v == nil {
+		return nil
+	}
+	s := strconv.FormatFloat(*v, 'f', decimals, 64)
+	if units != "" {
+		s += " " + units
+	}
+	return &s
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRoundValue(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name     string
+		v        *float64
+		decimals int
+		want     *float64
+	}{
+		{"no-data", nil, 2, nil},
+		{"NaN", f(math.NaN()), 2, nil},
+		{"+Inf", f(math.Inf(1)), 2, nil},
+		{"-Inf", f(math.Inf(-1)), 2, nil},
+		{"rounds down", f(12.344), 2, f(12.34)},
+		{"rounds half away from zero", f(12.345), 2, f(12.35)},
+		{"negative half", f(-0.5), 0, f(-1)},
+		{"zero decimals", f(287.6), 0, f(288)},
+		{"already precise", f(1.5), 3, f(1.5)},
+		{"too large to scale", f(1e308), 10, f(1e308)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := roundValue(tt.v, tt.decimals)
+			switch {
+			case tt.want == nil && got != nil:
+				t.Errorf("roundValue = %v, want nil", *got)
+			case tt.want != nil && got == nil:
+				t.Errorf("roundValue = nil, want %v", *tt.want)
+			case tt.want != nil && *got != *tt.want:
+				t.Errorf("roundValue = %v, want %v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name     string
+		v        *float64
+		decimals int
+		units    string
+		want     string // "" for nil
+	}{
+		{"no-data", nil, 2, "K", ""},
+		{"units", f(287.15), 2, "K", "287.15 K"},
+		{"pads zeros", f(1.5), 3, "m/s", "1.500 m/s"},
+		{"rounds", roundValue(f(0.125), 2), 2, "", "0.13"},
+		{"zero decimals", f(1013), 0, "hPa", "1013 hPa"},
+		{"no units", f(-3.2), 1, "", "-3.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatValue(tt.v, tt.decimals, tt.units)
+			if (got == nil) != (tt.want == "") || (got != nil && *got != tt.want) {
+				t.Errorf("formatValue = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeatureInfoDecimalsValidated(t *testing.T) {
+	t.Setenv("FEATUREINFO_DECIMALS", "-1")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig accepted FEATUREINFO_DECIMALS=-1")
+	}
+	t.Setenv("FEATUREINFO_DECIMALS", "0")
+	if c, err := loadConfig(); err != nil {
+		t.Errorf("loadConfig rejected FEATUREINFO_DECIMALS=0: %v", err)
+	} else if c.FeatureInfoDecimals != 0 {
+		t.Errorf("FeatureInfoDecimals = %d, want 0", c.FeatureInfoDecimals)
+	}
+}
+
+func TestGetFeatureInfoGeoJSON(t *testing.T) {
+	proc := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"value": 287.15, "units": "K", "time": "2026-10-14T00:00:00Z"}`))
+	}
+	// The centre of pixel 0,1 of a 2x2 map over 0,0-2000,2000 is 500,500 m
+	const query = "/wms?SERVICE=WMS&REQUEST=GetFeatureInfo&VERSION=1.3.0&LAYERS=temp_2m&QUERY_LAYERS=temp_2m&STYLES=" +
+		"&CRS=EPSG:3857&BBOX=0,0,2000,2000&WIDTH=2&HEIGHT=2&I=0&J=1&INFO_FORMAT=application/geo%2Bjson"
+	lon, lat := mercatorToLonLat(500, 500)
+
+	tests := []struct {
+		name     string
+		namedCRS string
+		x, y     float64
+		crs      interface{}
+	}{
+		{"WGS84", "false", lon, lat, nil},
+		{"named CRS", "true", 500, 500, map[string]interface{}{
+			"type": "name", "properties": map[string]interface{}{"name": "urn:ogc:def:crs:EPSG::3857"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, map[string]string{"GEOJSON_NAMED_CRS": tt.namedCRS}, proc)
+			rec := e.get(query)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %.200s", rec.Code, rec.Body.String())
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/geo+json" {
+				t.Errorf("Content-Type = %q, want application/geo+json", ct)
+			}
+			var fc map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &fc); err != nil {
+				t.Fatal(err)
+			}
+
+			if fc["type"] != "FeatureCollection" {
+				t.Errorf("type = %v, want FeatureCollection", fc["type"])
+			}
+			crs, hasCRS := fc["crs"]
+			if tt.crs == nil && hasCRS {
+				t.Errorf("WGS84 output has a crs member: %v", crs)
+			} else if !reflect.DeepEqual(crs, tt.crs) {
+				t.Errorf("crs = %v, want %v", crs, tt.crs)
+			}
+			assertCoords(t, "collection bbox", fc["bbox"], tt.x, tt.y, tt.x, tt.y)
+
+			features, _ := fc["features"].([]interface{})
+			if len(features) != 1 {
+				t.Fatalf("features = %v, want one", fc["features"])
+			}
+			f, _ := features[0].(map[string]interface{})
+			if f["type"] != "Feature" {
+				t.Errorf("feature type = %v, want Feature", f["type"])
+			}
+			assertCoords(t, "feature bbox", f["bbox"], tt.x, tt.y, tt.x, tt.y)
+			geom, _ := f["geometry"].(map[string]interface{})
+			if geom["type"] != "Point" {
+				t.Errorf("geometry type = %v, want Point", geom["type"])
+			}
+			assertCoords(t, "coordinates", geom["coordinates"], tt.x, tt.y)
+
+			props, _ := f["properties"].(map[string]interface{})
+			var names []string
+			for k := range props {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			if want := []string{"dataset", "formatted", "layer", "time", "units", "value"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("properties = %v, want %v", names, want)
+			}
+			if props["layer"] != "temp_2m" || props["value"] != 287.15 || props["units"] != "K" {
+				t.Errorf("properties = %v", props)
+			}
+		})
+	}
+}
+
+// assertCoords checks a decoded JSON number array against want
+func assertCoords(t *testing.T, name string, got interface{}, want ...float64) {
+	t.Helper()
+	arr, _ := got.([]interface{})
+	if len(arr) != len(want) {
+		t.Errorf("%s = %v, want %v", name, got, want)
+		return
+	}
+	for i, v := range arr {
+		if f, ok := v.(float64); !ok || math.Abs(f-want[i]) > 1e-6 {
+			t.Errorf("%s = %v, want %v", name, got, want)
+			return
+		}
+	}
+}
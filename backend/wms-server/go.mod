@@ -5,4 +5,5 @@ go 1.21
 require (
 	github.com/gorilla/mux v1.8.1
 	github.com/rs/cors v1.10.1
+	golang.org/x/image v0.18.0
 )
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseLayerGroups parses LAYER_GROUPS, e.g.
+// "wind=wind_speed_10m,wind_speed_50m;surface=temp_2m,mslp"
+func parseLayerGroups(spec string) (map[string][]string, error) {
+	groups := map[string][]string{}
+	for _, def := range strings.Split(spec, ";") {
+		if strings.TrimSpace(def) == "" {
+			continue
+		}
+		name, members, ok := strings.Cut(def, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("LAYER_GROUPS entry %q, expected name=layer1,layer2", def)
+		}
+		groups[name] = splitList(members)
+	}
+	return groups, nil
+}
+
+// expandLayers splits a LAYERS value and replaces group names with their
+// member layers, in order
+func expandLayers(layers string) []string {
+	var out []string
+	for _, name := range splitList(layers) {
+		if members, ok := config().LayerGroups[name]; ok {
+			out = append(out, members...)
+		} else {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// groupNames returns the configured layer group names, sorted
+func groupNames() []string {
+	names := make([]string, 0, len(config().LayerGroups))
+	for name := range config().LayerGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// groupCRS returns the CRSes every member of the group is available in
+func groupCRS(name string) []string {
+	var out []string
+	members := config().LayerGroups[name]
+	if len(members) == 0 {
+		return nil
+	}
+	for _, crs := range config().Layers[members[0]].crsList() {
+		all := true
+		for _, m := range members[1:] {
+			all = all && config().Layers[m].supportsCRS(crs)
+		}
+		if all {
+			out = append(out, crs)
+		}
+	}
+	return out
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxGutter is the widest gutter a style or TILE_GUTTER may ask for
+const maxGutter = tileSize
+
+// Gutters: a render param "gutter=<px>" has the processor draw that many
+// extra pixels around the requested bbox, which are cropped off again, so
+// contour labels and barbs near a tile edge carry on into the next tile
+// instead of being clipped. The param stays in the cache key but never
+// reaches the processor. Renders without a bbox have no edge to extend.
+
+// requestGutter is the gutter for a GetMap in style, or TILE_GUTTER when
+// the style doesn't set one. Only PNG renders get one, as the crop is
+// re-encoded as PNG.
+func requestGutter(style *namedStyle, format string) int {
+	if format != "" && !strings.EqualFold(format, "image/png") {
+		return 0
+	}
+	if style != nil && style.Gutter != nil {
+		return *style.Gutter
+	}
+	return config().TileGutter
+}
+
+// withGutter adds a gutter to render params v
+func withGutter(v url.Values, gutter int) {
+	if gutter > 0 && v.Get("bbox") != "" {
+		v.Set("gutter", strconv.Itoa(gutter))
+	}
+}
+
+// fetchGuttered renders v's bbox grown by its gutter on every side and
+// crops the result back to the requested size. Lon/lat bboxes are kept
+// within the poles and the antimeridian, so the gutter is narrower there.
+func fetchGuttered(ctx context.Context, v url.Values) (cacheEntry, error) {
+	gutter, _ := strconv.Atoi(v.Get("gutter"))
+	width, _ := strconv.Atoi(v.Get("width"))
+	height, _ := strconv.Atoi(v.Get("height"))
+	bb, ok := parseBBox(v.Get("bbox"))
+	out := url.Values{}
+	for k, vals := range v {
+		if k != "gutter" {
+			out[k] = vals
+		}
+	}
+	if !ok || gutter <= 0 || width <= 0 || height <= 0 {
+		return fetchRender(ctx, out)
+	}
+
+	resX, resY := (bb[2]-bb[0])/float64(width), (bb[3]-bb[1])/float64(height)
+	left, right, bottom, top := gutter, gutter, gutter, gutter
+	if v.Get("crs") == "" {
+		left = edgeGutter(gutter, bb[0]+180, resX)
+		right = edgeGutter(gutter, 180-bb[2], resX)
+		bottom = edgeGutter(gutter, bb[1]+90, resY)
+		top = edgeGutter(gutter, 90-bb[3], resY)
+	}
+	grown := [4]float64{
+		bb[0] - float64(left)*resX, bb[1] - float64(bottom)*resY,
+		bb[2] + float64(right)*resX, bb[3] + float64(top)*resY,
+	}
+	out.Set("bbox", fmt.Sprintf("%f,%f,%f,%f", grown[0], grown[1], grown[2], grown[3]))
+	out.Set("width", strconv.Itoa(width+left+right))
+	out.Set("height", strconv.Itoa(height+bottom+top))
+
+	e, err := fetchRender(ctx, out)
+	if err != nil {
+		return e, err
+	}
+	cropped, err := cropEntry(e, image.Rect(left, top, left+width, top+height))
+	if err != nil {
+		return cacheEntry{}, fmt.Errorf("cropping gutter: %w", err)
+	}
+	cropped.NoData, cropped.RenderTime = e.NoData, e.RenderTime
+	return cropped, nil
+}
+
+// edgeGutter is how many of gutter pixels of size res fit in room degrees
+func edgeGutter(gutter int, room, res float64) int {
+	return max(0, min(gutter, int(room/res)))
+}
+
+// cropEntry cuts rect out of a rendered image, re-encoding it as PNG
+func cropEntry(e cacheEntry, rect image.Rectangle) (cacheEntry, error) {
+	img, _, err := image.Decode(bytes.NewReader(e.Body))
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	b := img.Bounds()
+	if rect = rect.Add(b.Min); !rect.In(b) {
+		return cacheEntry{}, fmt.Errorf("processor returned %dx%d, expected %dx%d", b.Dx(), b.Dy(), rect.Max.X-b.Min.X, rect.Max.Y-b.Min.Y)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return cacheEntry{}, err
+	}
+	return cacheEntry{ContentType: "image/png", Body: buf.Bytes()}, nil
+}
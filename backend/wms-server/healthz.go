@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dependencyCheck is one /healthz?verbose=true probe
+type dependencyCheck struct {
+	Status    string  `json:"status"` // ok, slow or down
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// healthzHandler is /health plus, with verbose=true, a probe of each
+// dependency. Slow but working dependencies make the status "degraded";
+// a failed one makes it "unhealthy" and the response 503.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fields := healthFields()
+	if !strings.EqualFold(r.URL.Query().Get("verbose"), "true") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fields)
+		return
+	}
+
+	checks := map[string]func(context.Context) error{
+		"processor": checkProcessor,
+		"dataDir":   checkDataDir,
+	}
+	results := map[string]dependencyCheck{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			res := timeCheck(r.Context(), check)
+			mu.Lock()
+			results[name] = res
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := "healthy"
+	for _, res := range results {
+		switch {
+		case res.Status == "down":
+			status = "unhealthy"
+		case res.Status == "slow" && status == "healthy":
+			status = "degraded"
+		}
+	}
+	if maintenance.Load() && status == "healthy" {
+		status = "maintenance"
+	}
+	fields["status"] = status
+	fields["dependencies"] = results
+
+	entries := tiles.Len()
+	cache := map[string]interface{}{
+		"entries": entries,
+		"limit":   config().CacheSize,
+		"bytes":   tiles.Bytes(),
+	}
+	if config().CacheSize > 0 {
+		cache["fill"] = float64(entries) / float64(config().CacheSize)
+	}
+	fields["cache"] = cache
+
+	w.Header().Set("Content-Type", "application/json")
+	if status == "unhealthy" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(fields)
+}
+
+// timeCheck runs check with a timeout and grades its latency against
+// HEALTHZ_SLOW_MS
+func timeCheck(ctx context.Context, check func(context.Context) error) dependencyCheck {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := check(ctx)
+	elapsed := time.Since(start)
+	res := dependencyCheck{Status: "ok", LatencyMs: float64(elapsed.Microseconds()) / 1000}
+	switch {
+	case err != nil:
+		res.Status, res.Error = "down", err.Error()
+	case config().HealthSlow > 0 && elapsed > config().HealthSlow:
+		res.Status = "slow"
+	}
+	return res
+}
+
+// checkProcessor round-trips the processor's /health endpoint
+func checkProcessor(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config().ProcessorURL+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := processorDo(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("processor /health returned %s", resp.Status)
+	}
+	return nil
+}
+
+// checkDataDir stats DATA_DIR, which is slow when the volume is
+func checkDataDir(ctx context.Context) error {
+	fi, err := os.Stat(config().DataDir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", config().DataDir)
+	}
+	return nil
+}
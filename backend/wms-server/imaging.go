@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// scaleImage resizes img to width x height (nearest neighbour)
+func scaleImage(img image.Image, width, height int) *image.RGBA {
+	src := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy := src.Min.Y + y*src.Dy()/height
+		for x := 0; x < width; x++ {
+			sx := src.Min.X + x*src.Dx()/width
+			dst.Set(x, y, img.At(sx, sy))
+		}
+	}
+	return dst
+}
+
+// upscaleEntry decodes a rendered image and resizes it to width x height,
+// re-encoding as PNG
+func upscaleEntry(e cacheEntry, width, height int) (cacheEntry, error) {
+	img, _, err := image.Decode(bytes.NewReader(e.Body))
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleImage(img, width, height)); err != nil {
+		return cacheEntry{}, err
+	}
+	return cacheEntry{ContentType: "image/png", Body: buf.Bytes()}, nil
+}
+
+// compositeEntries alpha-blends rendered images in order (first at the
+// bottom) into a single width x height PNG
+func compositeEntries(entries []cacheEntry, width, height int) (cacheEntry, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for _, e := range entries {
+		img, _, err := image.Decode(bytes.NewReader(e.Body))
+		if err != nil {
+			return cacheEntry{}, err
+		}
+		if b := img.Bounds(); b.Dx() != width || b.Dy() != height {
+			img = scaleImage(img, width, height)
+		}
+		draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return cacheEntry{}, err
+	}
+	return cacheEntry{ContentType: "image/png", Body: buf.Bytes()}, nil
+}
+
+// isTransparentImage reports whether every pixel of the encoded image is
+// fully transparent
+func isTransparentImage(data []byte) bool {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return false
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// maskImageColors makes pixels matching any of colors transparent
+func maskImageColors(entry cacheEntry, colors []color.RGBA) (cacheEntry, error) {
+	img, _, err := image.Decode(bytes.NewReader(entry.Body))
+	if err != nil {
+		return entry, fmt.Errorf("masking: %v", err)
+	}
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+	for i := 0; i < len(out.Pix); i += 4 {
+		px := out.Pix[i : i+4]
+		for _, c := range colors {
+			if px[0] == c.R && px[1] == c.G && px[2] == c.B {
+				px[3] = 0
+				break
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out); err != nil {
+		return entry, fmt.Errorf("masking: %v", err)
+	}
+	return cacheEntry{ContentType: "image/png", Body: buf.Bytes(), NoData: entry.NoData}, nil
+}
+
+// debugBorders reports whether a tile gets the debug overlay, from
+// DEBUG_TILE_BORDERS or a debug=border request param
+func debugBorders(param string) bool {
+	return config().DebugTileBorders || strings.EqualFold(param, "border")
+}
+
+// drawTileBorder outlines a rendered tile and writes label in its top-left
+// corner, one line per entry, re-encoding as PNG. The result is never
+// flagged no-data so it isn't swapped for a 204.
+func drawTileBorder(e cacheEntry, label []string) (cacheEntry, error) {
+	img, _, err := image.Decode(bytes.NewReader(e.Body))
+	if err != nil {
+		return e, err
+	}
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+
+	line := image.NewUniform(color.RGBA{0xff, 0, 0xff, 0xff})
+	for _, edge := range []image.Rectangle{
+		image.Rect(b.Min.X, b.Min.Y, b.Max.X, b.Min.Y+1),
+		image.Rect(b.Min.X, b.Max.Y-1, b.Max.X, b.Max.Y),
+		image.Rect(b.Min.X, b.Min.Y, b.Min.X+1, b.Max.Y),
+		image.Rect(b.Max.X-1, b.Min.Y, b.Max.X, b.Max.Y),
+	} {
+		draw.Draw(out, edge, line, image.Point{}, draw.Src)
+	}
+
+	// Dark backing so the text reads over any palette
+	face := basicfont.Face7x13
+	d := font.Drawer{Dst: out, Src: line, Face: face}
+	y := b.Min.Y + 3
+	for _, s := range label {
+		if s == "" {
+			continue
+		}
+		w := d.MeasureString(s).Ceil()
+		draw.Draw(out, image.Rect(b.Min.X+2, y, b.Min.X+6+w, y+face.Height), image.NewUniform(color.RGBA{0, 0, 0, 0xa0}), image.Point{}, draw.Over)
+		d.Dot = fixed.P(b.Min.X+4, y+face.Ascent)
+		d.DrawString(s)
+		y += face.Height
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out); err != nil {
+		return e, err
+	}
+	return cacheEntry{ContentType: "image/png", Body: buf.Bytes()}, nil
+}
+
+// postProcessKernels are the 3x3 convolutions POSTPROCESS can apply, with
+// the divisor that keeps each one's weights summing to 1
+var postProcessKernels = map[string]struct {
+	k   [9]int
+	div int
+}{
+	"sharpen": {[9]int{0, -1, 0, -1, 5, -1, 0, -1, 0}, 1},
+	"smooth":  {[9]int{1, 2, 1, 2, 4, 2, 1, 2, 1}, 16},
+}
+
+// postProcessMode validates POSTPROCESS, defaulting to the layer's config;
+// none comes back as ""
+func postProcessMode(param, layer string) (string, error) {
+	mode := strings.ToLower(param)
+	if mode == "" {
+		mode = config().Layers[layer].PostProcess
+	}
+	if mode == "" || mode == "none" {
+		return "", nil
+	}
+	if _, ok := postProcessKernels[mode]; !ok {
+		return "", fmt.Errorf("unsupported POSTPROCESS %q, expected sharpen, smooth or none", param)
+	}
+	return mode, nil
+}
+
+// postProcessEntry convolves a rendered PNG with the mode's kernel, edges
+// clamped. Other formats are returned untouched, as re-encoding them as
+// PNG would change what the client asked for.
+func postProcessEntry(e cacheEntry, mode string) (cacheEntry, error) {
+	if e.ContentType != "image/png" {
+		return e, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(e.Body))
+	if err != nil {
+		return e, err
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Premultiplied, so transparent no-data pixels don't bleed color
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(src.Bounds())
+
+	kern := postProcessKernels[mode]
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]int
+			for i, weight := range kern.k {
+				if weight == 0 {
+					continue
+				}
+				sx := min(max(x+i%3-1, 0), w-1)
+				sy := min(max(y+i/3-1, 0), h-1)
+				px := src.Pix[src.PixOffset(sx, sy):]
+				for c := 0; c < 4; c++ {
+					sum[c] += weight * int(px[c])
+				}
+			}
+			out := dst.Pix[dst.PixOffset(x, y):]
+			a := min(max(sum[3]/kern.div, 0), 255)
+			out[3] = uint8(a)
+			for c := 0; c < 3; c++ {
+				out[c] = uint8(min(max(sum[c]/kern.div, 0), a))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return e, err
+	}
+	return cacheEntry{ContentType: "image/png", Body: buf.Bytes(), NoData: e.NoData}, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// LayerIndex is the shared, concurrency-safe view of discovered layers and
+// their timesteps. It is built lazily on first access and rebuilt by
+// Refresh; readers never observe a half-built index.
+type LayerIndex struct {
+	dataDir string
+
+	once      sync.Once
+	refreshMu sync.Mutex // serializes rebuilds
+
+	mu       sync.RWMutex
+	layers   []layerInfo
+	warnings []string // unreadable parts of the last scan
+	dups     []string // files the last scan ignored as duplicates
+	err      error
+	updated  time.Time
+	digest   [sha256.Size]byte
+	sequence int64
+
+	// onChange, if set, runs after a rebuild that found different files
+	// (but not the first build) with the previous and new layers
+	onChange func(prev, cur []layerInfo)
+}
+
+// NewLayerIndex returns an index over dataDir; nothing is scanned until
+// first use
+func NewLayerIndex(dataDir string) *LayerIndex {
+	return &LayerIndex{dataDir: dataDir}
+}
+
+// Refresh rescans the data directory and atomically swaps in the result.
+// On error the previous layers are kept.
+func (ix *LayerIndex) Refresh() error {
+	ix.refreshMu.Lock()
+	defer ix.refreshMu.Unlock()
+
+	layers, warnings, dups, err := discoverLayers(ix.dataDir)
+
+	ix.mu.Lock()
+	ix.err = err
+	if err != nil {
+		ix.mu.Unlock()
+		log.Printf("Layer discovery failed: %v", err)
+		return err
+	}
+	prev, first := ix.layers, ix.updated.IsZero()
+	// Logged when they change, not on every rescan
+	if !slices.Equal(warnings, ix.warnings) {
+		for _, w := range warnings {
+			log.Printf("Layer discovery: %s", w)
+		}
+	}
+	if !slices.Equal(dups, ix.dups) {
+		for _, d := range dups {
+			log.Printf("Layer discovery: %s", d)
+		}
+	}
+	ix.warnings, ix.dups = warnings, dups
+	ix.layers = layers
+	ix.updated = time.Now().UTC()
+	// The sequence only moves when the content does, so polling clients
+	// aren't told about rescans that found nothing new
+	changed := false
+	if d := indexDigest(layers); d != ix.digest {
+		ix.digest = d
+		seq := ix.updated.Unix()
+		if seq <= ix.sequence {
+			seq = ix.sequence + 1
+		}
+		ix.sequence = seq
+		changed = true
+	}
+	ix.mu.Unlock()
+
+	if changed && !first && ix.onChange != nil {
+		ix.onChange(prev, layers)
+	}
+	return nil
+}
+
+// indexDigest hashes every file's identity and mtime
+func indexDigest(layers []layerInfo) [sha256.Size]byte {
+	h := sha256.New()
+	for _, l := range layers {
+		for _, f := range l.Files {
+			fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\n", l.Name, f.Path, f.ModTime.UnixNano(), f.Size)
+		}
+	}
+	var d [sha256.Size]byte
+	h.Sum(d[:0])
+	return d
+}
+
+func (ix *LayerIndex) ensureBuilt() {
+	ix.once.Do(func() { ix.Refresh() })
+}
+
+// Layers returns all layers sorted by name. The result must be treated as
+// read-only.
+func (ix *LayerIndex) Layers() []layerInfo {
+	ix.ensureBuilt()
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.layers
+}
+
+// Layer returns the named layer
+func (ix *LayerIndex) Layer(name string) (layerInfo, bool) {
+	return findLayer(ix.Layers(), name)
+}
+
+// LastModified is the newest file modification time across all layers
+func (ix *LayerIndex) LastModified() time.Time {
+	return newestModTime(ix.Layers())
+}
+
+// Updated is when the index was last successfully rebuilt
+func (ix *LayerIndex) Updated() time.Time {
+	ix.ensureBuilt()
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.updated
+}
+
+// UpdateSequence identifies the current index content for capabilities'
+// updateSequence. It increases whenever a rebuild finds different files.
+func (ix *LayerIndex) UpdateSequence() int64 {
+	ix.ensureBuilt()
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.sequence
+}
+
+// Warnings lists what the last rebuild couldn't read and left out
+func (ix *LayerIndex) Warnings() []string {
+	ix.ensureBuilt()
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.warnings
+}
+
+// Err is the error from the most recent rebuild, if any
+func (ix *LayerIndex) Err() error {
+	ix.ensureBuilt()
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.err
+}
+
+// refreshEvery rebuilds the index periodically so new data is picked up
+func (ix *LayerIndex) refreshEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		ix.Refresh()
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRefreshLogsDuplicatesOnce(t *testing.T) {
+	e := newTestEnv(t, nil, nil, "temp_2m_2026101400.nc", "copy/temp_2m_2026101400.nc")
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	duplicateLines := func() int {
+		defer logs.Reset()
+		return strings.Count(logs.String(), "has two files")
+	}
+	for i := 0; i < 3; i++ {
+		if err := layerIndex.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := duplicateLines(); n != 1 {
+		t.Errorf("3 rescans logged the duplicate %d times, want once", n)
+	}
+
+	if err := os.WriteFile(filepath.Join(e.dataDir, "copy", "temp_2m_2026101406.nc"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(e.dataDir, "temp_2m_2026101406.nc"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	layerIndex.Refresh()
+	if n := duplicateLines(); n != 2 {
+		t.Errorf("a new duplicate logged %d lines, want the 2 current duplicates", n)
+	}
+	layerIndex.Refresh()
+	if n := duplicateLines(); n != 0 {
+		t.Errorf("an unchanged rescan logged %d duplicates, want none", n)
+	}
+	if li, _ := layerIndex.Layer("temp_2m"); len(li.Files) != 2 {
+		t.Errorf("temp_2m has %d files, want one per run", len(li.Files))
+	}
+}
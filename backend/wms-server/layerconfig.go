@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// layerConfig holds per-layer settings from LAYER_CONFIG, a JSON object
+// keyed by layer name, e.g. {"temp_2m": {"decimals": 1}}
+type layerConfig struct {
+	Decimals *int `json:"decimals"` // GetFeatureInfo precision
+	// Values outside validRange are masked as no-data. The processor does
+	// it when it supports masking; otherwise pixels in maskColors (the
+	// colors it paints fill values, "#rrggbb") are made transparent here.
+	ValidRange *[2]float64 `json:"validRange"`
+	MaskColors []string    `json:"maskColors"`
+	// Color the processor paints no-data with ("#rrggbb"), forwarded as
+	// nodatacolor; with nodataTransparent set, pixels of that color are
+	// also made transparent here for processors that ignore it
+	NodataColor       string `json:"nodataColor"`
+	NodataTransparent bool   `json:"nodataTransparent"`
+	// CRSes GetMap accepts for the layer, out of SUPPORTED_CRS; empty means
+	// all of them. Other than EPSG:4326 and EPSG:3857 they are forwarded
+	// with the BBOX untouched for the processor to handle.
+	SupportedCRS []string `json:"supportedCRS"`
+	// Set on a three-layer group, makes it an RGB composite (STYLES=rgb)
+	// with these default red, green and blue ranges
+	RGBRanges *[3][2]float64 `json:"rgbRanges"`
+	// GetMap size when WIDTH/HEIGHT are omitted, e.g. larger for
+	// high-resolution regional layers; DEFAULT_TILE_SIZE otherwise
+	DefaultWidth  int `json:"defaultWidth"`
+	DefaultHeight int `json:"defaultHeight"`
+	// POSTPROCESS default for GetMap: sharpen, smooth or none
+	PostProcess string `json:"postprocess"`
+	// Continuous color ramps that would band if quantized, so QUANTIZE
+	// and PNG_QUANTIZE pass the layer's renders through untouched
+	SmoothGradients bool `json:"smoothGradients"`
+	// Advertised in capabilities as suited to LOGSCALE=true, for fields
+	// spanning orders of magnitude such as precipitation or CAPE
+	LogScale bool `json:"logScale"`
+	// Memory cache entries the layer may hold, overriding CACHE_LAYER_QUOTA;
+	// 0 exempts it
+	CacheQuota *int `json:"cacheQuota"`
+	// Render WMTS tiles of a new run in the background once it's indexed
+	Autowarm *autowarmConfig `json:"autowarm"`
+	// Region the product is valid in, as GeoJSON or a path to a GeoJSON
+	// file; renders are clipped to it (see mask.go)
+	MaskPolygon json.RawMessage `json:"maskPolygon"`
+
+	maskRGB   []color.RGBA
+	nodataRGB *color.RGBA
+	mask      maskPolygon
+	maskJSON  string
+}
+
+// autowarmConfig picks the tiles to pre-render: every tile at zoomLevels
+// covering bbox (lon/lat minx,miny,maxx,maxy; the layer extent if unset)
+type autowarmConfig struct {
+	ZoomLevels []int       `json:"zoomLevels"`
+	BBox       *[4]float64 `json:"bbox"`
+}
+
+// loadLayerConfig reads the per-layer settings file, checking it against
+// the rest of cfg; no path means none
+func loadLayerConfig(path string, cfg *Config) (map[string]layerConfig, error) {
+	layers := map[string]layerConfig{}
+	if path == "" {
+		return layers, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &layers); err != nil {
+		return nil, err
+	}
+	for name, lc := range layers {
+		if lc.ValidRange != nil && lc.ValidRange[0] >= lc.ValidRange[1] {
+			return nil, fmt.Errorf("%s: validRange min must be below max", name)
+		}
+		for _, crs := range lc.SupportedCRS {
+			if !crsInList(cfg.SupportedCRS, crs) {
+				return nil, fmt.Errorf("%s: supportedCRS %s is not in SUPPORTED_CRS", name, crs)
+			}
+		}
+		if lc.RGBRanges != nil {
+			if n := len(cfg.LayerGroups[name]); n != 3 {
+				return nil, fmt.Errorf("%s: rgbRanges needs a LAYER_GROUPS group of three layers, it has %d", name, n)
+			}
+			for i, r := range lc.RGBRanges {
+				if r[0] >= r[1] {
+					return nil, fmt.Errorf("%s: rgbRanges[%d] min must be below max", name, i)
+				}
+			}
+		}
+		if _, ok := postProcessKernels[lc.PostProcess]; !ok && lc.PostProcess != "" && lc.PostProcess != "none" {
+			return nil, fmt.Errorf("%s: postprocess %q, expected sharpen, smooth or none", name, lc.PostProcess)
+		}
+		if aw := lc.Autowarm; aw != nil {
+			if len(aw.ZoomLevels) == 0 {
+				return nil, fmt.Errorf("%s: autowarm needs zoomLevels", name)
+			}
+			for _, z := range aw.ZoomLevels {
+				if z < 0 || z > maxTileZoom {
+					return nil, fmt.Errorf("%s: autowarm zoom level %d is outside 0..%d", name, z, maxTileZoom)
+				}
+			}
+			if b := aw.BBox; b != nil && (b[0] >= b[2] || b[1] >= b[3]) {
+				return nil, fmt.Errorf("%s: autowarm bbox min must be below max", name)
+			}
+		}
+		if lc.Decimals != nil && *lc.Decimals < 0 {
+			return nil, fmt.Errorf("%s: decimals must not be negative", name)
+		}
+		if lc.CacheQuota != nil && *lc.CacheQuota < 0 {
+			return nil, fmt.Errorf("%s: cacheQuota must not be negative", name)
+		}
+		if lc.DefaultWidth < 0 || (cfg.MaxWidth > 0 && lc.DefaultWidth > cfg.MaxWidth) {
+			return nil, fmt.Errorf("%s: defaultWidth %d is outside 0..MAX_WIDTH (%d)", name, lc.DefaultWidth, cfg.MaxWidth)
+		}
+		if lc.DefaultHeight < 0 || (cfg.MaxHeight > 0 && lc.DefaultHeight > cfg.MaxHeight) {
+			return nil, fmt.Errorf("%s: defaultHeight %d is outside 0..MAX_HEIGHT (%d)", name, lc.DefaultHeight, cfg.MaxHeight)
+		}
+		for _, s := range lc.MaskColors {
+			c, err := parseHexColor(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			lc.maskRGB = append(lc.maskRGB, c)
+		}
+		if lc.NodataColor != "" {
+			c, err := parseHexColor(lc.NodataColor)
+			if err != nil {
+				return nil, fmt.Errorf("%s: nodataColor: %v", name, err)
+			}
+			lc.nodataRGB = &c
+		} else if lc.NodataTransparent {
+			return nil, fmt.Errorf("%s: nodataTransparent needs a nodataColor", name)
+		}
+		if len(lc.MaskPolygon) > 0 {
+			if lc.mask, err = parseMaskPolygon(lc.MaskPolygon, filepath.Dir(path)); err != nil {
+				return nil, fmt.Errorf("%s: maskPolygon: %v", name, err)
+			}
+			lc.maskJSON = lc.mask.geoJSON()
+		}
+		layers[name] = lc
+	}
+	return layers, nil
+}
+
+// parseHexColor parses "#rrggbb"
+func parseHexColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, expected #rrggbb", s)
+	}
+	return color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 0xff}, nil
+}
+
+// crsList returns the CRSes the layer is available in
+func (lc layerConfig) crsList() []string {
+	if len(lc.SupportedCRS) == 0 {
+		return config().SupportedCRS
+	}
+	return lc.SupportedCRS
+}
+
+// supportsCRS reports whether the layer may be requested in crs
+func (lc layerConfig) supportsCRS(crs string) bool {
+	return crsInList(lc.crsList(), crs)
+}
+
+// crsInList matches crs against list, treating the Web Mercator codes as one
+func crsInList(list []string, crs string) bool {
+	for _, c := range list {
+		if strings.EqualFold(c, crs) || (isWebMercator(c) && isWebMercator(crs)) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultImageSize is the GetMap size used for an omitted WIDTH/HEIGHT
+func defaultImageSize(layer string) (width, height int) {
+	width, height = config().DefaultTileSize, config().DefaultTileSize
+	lc := config().Layers[layer]
+	if lc.DefaultWidth > 0 {
+		width = lc.DefaultWidth
+	}
+	if lc.DefaultHeight > 0 {
+		height = lc.DefaultHeight
+	}
+	return width, height
+}
+
+// layerCacheQuota is the most memory cache entries the layer may hold,
+// 0 for no limit beyond CACHE_SIZE
+func layerCacheQuota(layer string) int {
+	if layer == "" {
+		return 0
+	}
+	if q := config().Layers[layer].CacheQuota; q != nil {
+		return *q
+	}
+	return config().CacheLayerQuota
+}
+
+// maskingMode says who masks the layer's out-of-range values: processor,
+// server, or none when nothing can
+func (lc layerConfig) maskingMode() string {
+	switch {
+	case lc.ValidRange == nil:
+		return ""
+	case procInfo().Masking:
+		return "processor"
+	case len(lc.maskRGB) > 0:
+		return "server"
+	}
+	return "none"
+}
+
+// serverMaskColors are the colors the server makes transparent in the
+// layer's renders: its maskColors when masking falls to the server, plus
+// nodataColor with nodataTransparent
+func (lc layerConfig) serverMaskColors() []color.RGBA {
+	var colors []color.RGBA
+	if lc.maskingMode() == "server" {
+		colors = append(colors, lc.maskRGB...)
+	}
+	if lc.NodataTransparent && lc.nodataRGB != nil {
+		colors = append(colors, *lc.nodataRGB)
+	}
+	return colors
+}
+
+// masksOnServer reports whether the layer's renders are altered here after
+// the processor, so they can't be streamed
+func (lc layerConfig) masksOnServer() bool {
+	return len(lc.serverMaskColors()) > 0 || lc.serverClip() != nil
+}
+
+// withLayerParams adds the layer's validrange, nodatacolor and, for a
+// processor that clips, maskpolygon to render params v
+func withLayerParams(v url.Values) url.Values {
+	lc, ok := config().Layers[v.Get("layer")]
+	sendMask := lc.mask != nil && procInfo().MaskPolygon
+	if !ok || (lc.ValidRange == nil && lc.nodataRGB == nil && !sendMask) {
+		return v
+	}
+	out := make(url.Values, len(v)+3)
+	for k, vals := range v {
+		out[k] = vals
+	}
+	if lc.ValidRange != nil {
+		out.Set("validrange", strconv.FormatFloat(lc.ValidRange[0], 'g', -1, 64)+","+strconv.FormatFloat(lc.ValidRange[1], 'g', -1, 64))
+	}
+	if c := lc.nodataRGB; c != nil {
+		out.Set("nodatacolor", fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B))
+	}
+	if sendMask {
+		out.Set("maskpolygon", lc.maskJSON)
+	}
+	return out
+}
@@ -1,17 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -19,251 +30,1658 @@ import (
 )
 
 type Config struct {
-	DataDir string
-	Port    string
+	DataDir            string
+	Port               string
+	ProcessorURL       string
+	ProcessorPointPath string
+	ProcessorStatsPath string
+	ProcessorInfoPath  string
+	ProcessorRender    *template.Template
+	Debug              bool
+	Favicon            string
+	Profiles           map[string]url.Values
+	BasePath           string
+	CacheSize          int
+	CacheLayerQuota    int
+	RenderBudget       time.Duration
+	RenderDegrade      string
+	FilenamePattern    *regexp.Regexp
+	FilenameTimeLayout string
+	EnsembleControl    string
+	TileCacheDir       string
+	TileCacheWrite     bool
+	IndexRefresh       time.Duration
+	RefTimeDimension   bool
+	LayerGroups        map[string][]string
+	MaxLayers          int
+	MaxWidth           int
+	MaxHeight          int
+	EnableIndex        bool
+	Styles             map[string]namedStyle
+	LogFile            string
+	LogMaxSizeMB       int
+	LogMaxBackups      int
+	// Per-layer overrides from the LAYER_CONFIG JSON file
+	Layers              map[string]layerConfig
+	FeatureInfoDecimals int
+	AnimateConcurrency  int
+	AutowarmConcurrency int
+	AutowarmMaxTiles    int
+	AnimateMaxFrames    int
+	CacheDiskDir        string
+	CacheDiskMaxMB      int
+	ProcessorParams     map[string]string
+	// Credentials for a processor behind its own auth; never logged
+	ProcessorAuthHeader   string
+	ProcessorAuthToken    string
+	ProcessorAuthUser     string
+	ProcessorAuthPassword string
+	AdminToken            string
+	MaintenanceRetry      int
+	NoDataResponse        string
+	MaxPostBodyKB         int
+	GzipLevel             int
+	GzipMinBytes          int
+	OTLPEndpoint          string
+	ProcessorCanaryURL    string
+	CanaryPercent         int
+	TileGutter            int
+	RegionStatsMaxArea    float64
+	DefaultWMSVersion     string
+	StrictWMS             bool
+	CapabilitiesMaxAge    time.Duration
+	CacheControl          map[string]string // by endpoint category
+	PNGQuantize           bool
+	PNGQuantizeColors     int
+	ServiceName           string
+	TraceSampleRatio      float64
+	BufferThreshold       int
+	TimeFallback          bool
+	TimeTolerance         time.Duration
+	HealthSlow            time.Duration
+	GeoJSONNamedCRS       bool
+	DefaultTileSize       int
+	DebugHeaders          bool
+	DebugTileBorders      bool
+	// http.Server timeouts; WriteTimeout has to outlast the slowest render
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxConnections    int
+	KeepAlive         bool
+	// Per-request deadline; X-Timeout-Ms overrides it up to the max
+	RequestTimeout    time.Duration
+	MaxRequestTimeout time.Duration
+	SupportedCRS      []string
+	// ENV_FILE and the environment as this config read them
+	env envSource
 }
 
-var config Config
+// currentConfig is swapped whole on reload; a Config is never modified
+// once stored, so readers never see a half-applied reload
+var currentConfig atomic.Pointer[Config]
+
+// config returns the settings in effect
+func config() *Config { return currentConfig.Load() }
+
+// tiles caches rendered images between requests
+var tiles *tileCache
+
+// layerIndex is the shared layer/time index built from DataDir
+var layerIndex *LayerIndex
 
 func init() {
-	config = Config{
-		DataDir: getEnv("DATA_DIR", "/data/weather"),
-		Port:    getEnv("PORT", "8080"),
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
 	}
+	currentConfig.Store(c)
 }
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// loadConfig reads the environment, ENV_FILE and the files it names into a
+// new Config, at startup and on every SIGHUP
+func loadConfig() (*Config, error) {
+	env, err := readEnvFile(os.Getenv("ENV_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("ENV_FILE: %v", err)
+	}
+	c := &Config{
+		env:                env,
+		DataDir:            env.get("DATA_DIR", "/data/weather"),
+		Port:               env.get("PORT", "8080"),
+		ProcessorURL:       strings.TrimRight(env.get("PROCESSOR_URL", "http://weather-processor:8081"), "/"),
+		ProcessorPointPath: env.get("PROCESSOR_POINT_PATH", "/api/value"),
+		ProcessorStatsPath: env.get("PROCESSOR_STATS_PATH", "/api/stats"),
+		ProcessorInfoPath:  env.get("PROCESSOR_INFO_PATH", "/api/info"),
+		Debug:              env.get("DEBUG", "false") == "true",
+		Favicon:            env.get("FAVICON", "embedded"),
+		BasePath:           normalizeBasePath(env.get("BASE_PATH", "")),
+		CacheSize:          env.getInt("CACHE_SIZE", 1000),
+		// Most CACHE_SIZE entries one layer may hold; 0 is no quota
+		CacheLayerQuota: env.getInt("CACHE_LAYER_QUOTA", 0),
+		RenderBudget:    time.Duration(env.getInt("RENDER_BUDGET_MS", 0)) * time.Millisecond,
+		// What to do when a render misses the budget: retry-lowres|serve-stale|error
+		RenderDegrade: env.get("RENDER_DEGRADE", "retry-lowres"),
+		// Go time layout for the filename pattern's time group
+		FilenameTimeLayout: env.get("FILENAME_TIME_LAYOUT", "2006010215"),
+		// Member used when MEMBER is omitted for ensemble layers
+		EnsembleControl: env.get("ENSEMBLE_CONTROL_MEMBER", "c00"),
+		// Pre-rendered XYZ tiles: <dir>/<layer>/<time>/<z>/<x>/<y>.png
+		TileCacheDir:   env.get("TILE_CACHE_DIR", ""),
+		TileCacheWrite: env.get("TILE_CACHE_WRITE", "false") == "true",
+		IndexRefresh:   time.Duration(env.getInt("INDEX_REFRESH_SECONDS", 60)) * time.Second,
+		// Advertise model runs as a reference_time dimension
+		RefTimeDimension: env.get("REFERENCE_TIME_DIMENSION", "false") == "true",
+		MaxLayers:        env.getInt("MAX_LAYERS_PER_REQUEST", 5),
+		MaxWidth:         env.getInt("MAX_WIDTH", 4096),
+		MaxHeight:        env.getInt("MAX_HEIGHT", 4096),
+		EnableIndex:      env.get("ENABLE_INDEX", "false") == "true",
+		// Access log goes to stdout unless LOG_FILE is set
+		LogFile:       env.get("LOG_FILE", ""),
+		LogMaxSizeMB:  env.getInt("LOG_MAX_SIZE_MB", 100),
+		LogMaxBackups: env.getInt("LOG_MAX_BACKUPS", 3),
+		// Decimals in GetFeatureInfo values unless the layer config says otherwise
+		FeatureInfoDecimals: env.getInt("FEATUREINFO_DECIMALS", 2),
+		// Frame renders in flight per /animate request
+		AnimateConcurrency: env.getInt("ANIMATE_CONCURRENCY", 4),
+		// Background tile renders for a layer's autowarm, kept low so live
+		// requests get the processor first, and the most tiles per new run
+		AutowarmConcurrency: env.getInt("AUTOWARM_CONCURRENCY", 2),
+		AutowarmMaxTiles:    env.getInt("AUTOWARM_MAX_TILES", 500),
+		AnimateMaxFrames:    env.getInt("ANIMATE_MAX_FRAMES", 48),
+		// Second cache tier for entries evicted from the CACHE_SIZE LRU
+		CacheDiskDir:   env.get("CACHE_DISK_DIR", ""),
+		CacheDiskMaxMB: env.getInt("CACHE_DISK_MAX_MB", 1024),
+		// Bearer token (or raw value for a custom header), or basic auth
+		ProcessorAuthHeader:   env.get("PROCESSOR_AUTH_HEADER", "Authorization"),
+		ProcessorAuthToken:    env.get("PROCESSOR_AUTH_TOKEN", ""),
+		ProcessorAuthUser:     env.get("PROCESSOR_AUTH_USER", ""),
+		ProcessorAuthPassword: env.get("PROCESSOR_AUTH_PASSWORD", ""),
+		// Bearer token for /admin endpoints; unset disables them
+		AdminToken:       env.get("ADMIN_TOKEN", ""),
+		MaintenanceRetry: env.getInt("MAINTENANCE_RETRY_AFTER", 300),
+		// "204" answers all-no-data GetMap tiles with 204 No Content
+		NoDataResponse: env.get("NODATA_RESPONSE", ""),
+		// Largest form-encoded POST body wmsHandler reads, e.g. for SLD_BODY
+		MaxPostBodyKB: env.getInt("MAX_POST_BODY_KB", 1024),
+		// GetMap renders this large or of unknown size are streamed instead
+		// of buffered and cached; 0 always buffers
+		BufferThreshold: env.getInt("BUFFER_THRESHOLD_BYTES", 0),
+		// Render the previous timestep when TIME has no data; off for
+		// conformance testing, which expects strict matching
+		TimeFallback: env.get("TIME_FALLBACK", "false") == "true",
+		// /healthz?verbose=true reports degraded past this dependency latency
+		HealthSlow: time.Duration(env.getInt("HEALTHZ_SLOW_MS", 500)) * time.Millisecond,
+		// GeoJSON FeatureInfo in the request's projected CRS with a named
+		// crs member, instead of WGS84
+		GeoJSONNamedCRS: env.get("GEOJSON_NAMED_CRS", "false") == "true",
+		// WIDTH/HEIGHT when omitted, unless the layer config sets its own
+		DefaultTileSize: env.getInt("DEFAULT_TILE_SIZE", 256),
+		// Median-cut palette for GetMap PNGs: always, or with QUANTIZE=true,
+		// at this many colors unless QUANTIZE gives a count
+		PNGQuantize:       env.get("PNG_QUANTIZE", "false") == "true",
+		PNGQuantizeColors: env.getInt("PNG_QUANTIZE_COLORS", 64),
+		// How long clients and proxies may reuse a capabilities document
+		// before revalidating it against its ETag
+		CapabilitiesMaxAge: time.Duration(env.getInt("CAPABILITIES_MAX_AGE_SECONDS", 60)) * time.Second,
+		// Hold GetMap to the spec's required params instead of defaulting
+		// the missing ones; off for clients that lean on the defaults
+		StrictWMS: env.get("STRICT_WMS", "false") == "true",
+		// X-Data-File/X-Data-Time on GetMap naming the data behind a render
+		DebugHeaders: env.get("DEBUG_HEADERS", "false") == "true",
+		// Outline every GetMap/WMTS tile and label it with its bounds, as
+		// &debug=border does per request; never cached
+		DebugTileBorders: env.get("DEBUG_TILE_BORDERS", "false") == "true",
+		// Connection timeouts against slowloris and stalled clients
+		ReadTimeout:       time.Duration(env.getInt("READ_TIMEOUT_SECONDS", 30)) * time.Second,
+		ReadHeaderTimeout: time.Duration(env.getInt("READ_HEADER_TIMEOUT_SECONDS", 10)) * time.Second,
+		WriteTimeout:      time.Duration(env.getInt("WRITE_TIMEOUT_SECONDS", 300)) * time.Second,
+		IdleTimeout:       time.Duration(env.getInt("IDLE_TIMEOUT_SECONDS", 120)) * time.Second,
+		// Open connections at once (0 is unlimited); more wait to be accepted
+		MaxConnections: env.getInt("MAX_CONNECTIONS", 0),
+		KeepAlive:      env.get("KEEP_ALIVE", "true") == "true",
+		// How long a request may take end to end (0 is no limit), and the
+		// most a client can ask for with X-Timeout-Ms
+		RequestTimeout:    time.Duration(env.getInt("REQUEST_TIMEOUT_MS", 0)) * time.Millisecond,
+		MaxRequestTimeout: time.Duration(env.getInt("MAX_REQUEST_TIMEOUT_MS", 300000)) * time.Millisecond,
+		// CRSes advertised and accepted; a layer's supportedCRS narrows it
+		SupportedCRS: splitList(env.get("SUPPORTED_CRS", "EPSG:4326,EPSG:3857")),
+		// Response compression: gzip level 1 (fastest) to 9 (smallest), and
+		// the body size below which text responses aren't worth compressing
+		GzipLevel:    env.getInt("GZIP_LEVEL", 6),
+		GzipMinBytes: env.getInt("GZIP_MIN_BYTES", 1024),
+		// Second processor taking this percentage of GetMap renders, for
+		// rolling out a new version
+		ProcessorCanaryURL: strings.TrimRight(env.get("PROCESSOR_CANARY_URL", ""), "/"),
+		CanaryPercent:      env.getInt("PROCESSOR_CANARY_PERCENT", 0),
+		// Pixels rendered past each tile edge and cropped off, so labels and
+		// barbs continue across tiles; styles may set their own
+		TileGutter: env.getInt("TILE_GUTTER", 0),
+		// Largest /stats-region bbox in square degrees; 0 is no limit
+		RegionStatsMaxArea: float64(env.getInt("REGION_STATS_MAX_AREA", 2500)),
+		// WMS version assumed when a request has no VERSION; it decides the
+		// capabilities document and EPSG:4326 BBOX axis order
+		DefaultWMSVersion: env.get("DEFAULT_WMS_VERSION", wms130),
+		// OTLP/HTTP collector for request traces, e.g.
+		// http://otel-collector:4318; unset turns tracing off
+		OTLPEndpoint: strings.TrimRight(env.get("OTEL_EXPORTER_OTLP_ENDPOINT", ""), "/"),
+		ServiceName:  env.get("OTEL_SERVICE_NAME", "weather-wms"),
+	}
+
+	switch c.RenderDegrade {
+	case "retry-lowres", "serve-stale", "error":
+	default:
+		return nil, fmt.Errorf("RENDER_DEGRADE %q, expected retry-lowres, serve-stale or error", c.RenderDegrade)
+	}
+	if len(c.SupportedCRS) == 0 {
+		return nil, fmt.Errorf("SUPPORTED_CRS must list at least one CRS")
+	}
+	if c.CanaryPercent < 0 || c.CanaryPercent > 100 {
+		return nil, fmt.Errorf("PROCESSOR_CANARY_PERCENT %d, expected 0-100", c.CanaryPercent)
+	}
+	if c.CanaryPercent > 0 && c.ProcessorCanaryURL == "" {
+		return nil, fmt.Errorf("PROCESSOR_CANARY_PERCENT needs PROCESSOR_CANARY_URL")
+	}
+	if c.TileGutter < 0 || c.TileGutter > maxGutter {
+		return nil, fmt.Errorf("TILE_GUTTER %d, expected 0-%d", c.TileGutter, maxGutter)
 	}
-	return defaultValue
+	if c.DefaultWMSVersion != wms111 && c.DefaultWMSVersion != wms130 {
+		return nil, fmt.Errorf("DEFAULT_WMS_VERSION %q, expected %s or %s", c.DefaultWMSVersion, wms111, wms130)
+	}
+	if c.FeatureInfoDecimals < 0 {
+		return nil, fmt.Errorf("FEATUREINFO_DECIMALS %d, expected 0 or more", c.FeatureInfoDecimals)
+	}
+	if c.PNGQuantizeColors < 2 || c.PNGQuantizeColors > 256 {
+		return nil, fmt.Errorf("PNG_QUANTIZE_COLORS %d, expected 2-256", c.PNGQuantizeColors)
+	}
+	if c.GzipLevel < 1 || c.GzipLevel > 9 {
+		log.Printf("Invalid GZIP_LEVEL=%d, expected 1-9, using default 6", c.GzipLevel)
+		c.GzipLevel = 6
+	}
+	// Rendering profiles: processor options forwarded for PROFILE=<name>
+	c.Profiles = map[string]url.Values{}
+	for name, def := range map[string]string{
+		"fast":    "interpolation=nearest&antialias=false&downsample=2",
+		"quality": "interpolation=bilinear&antialias=true&downsample=1",
+	} {
+		if c.Profiles[name], err = parseProfile(name, env.get("PROFILE_"+strings.ToUpper(name), def)); err != nil {
+			return nil, err
+		}
+	}
+	if c.LayerGroups, err = parseLayerGroups(env.get("LAYER_GROUPS", "")); err != nil {
+		return nil, err
+	}
+	// Outgoing processor param renames, e.g. "colorscalerange=range,bbox=extent"
+	if c.ProcessorParams, err = parseParamNames(env.get("PROCESSOR_PARAM_NAMES", "")); err != nil {
+		return nil, err
+	}
+	// Path and query of processor renders, e.g. "/render/{{path .Layer}}?{{.QueryWithout \"layer\"}}"
+	if c.ProcessorRender, err = parseRenderTemplate(env.get("PROCESSOR_RENDER_TEMPLATE", defaultRenderTemplate), c.ProcessorParams); err != nil {
+		return nil, fmt.Errorf("PROCESSOR_RENDER_TEMPLATE: %v", err)
+	}
+	// Cache-Control per endpoint category, e.g. CACHE_CONTROL_TILES_PAST="public, max-age=604800, immutable"
+	if c.CacheControl, err = parseCacheControl(env, c.CapabilitiesMaxAge); err != nil {
+		return nil, err
+	}
+	// Fraction of new traces exported; a client's traceparent decides for its own
+	c.TraceSampleRatio = 1
+	if s := env.get("OTEL_TRACES_SAMPLER_ARG", ""); s != "" {
+		if c.TraceSampleRatio, err = strconv.ParseFloat(s, 64); err != nil || c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+			return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG %q, expected a ratio from 0 to 1", s)
+		}
+	}
+	// How far TIME may be from a timestep and still snap to it, e.g. 1h30m;
+	// unset leaves matching to the processor
+	if s := env.get("TIME_TOLERANCE", ""); s != "" {
+		if c.TimeTolerance, err = time.ParseDuration(s); err != nil || c.TimeTolerance < 0 {
+			return nil, fmt.Errorf("TIME_TOLERANCE %q, expected a duration such as 1h30m", s)
+		}
+	}
+	if c.FilenamePattern, err = compileFilenamePattern(env.get("FILENAME_PATTERN", defaultFilenamePattern)); err != nil {
+		return nil, fmt.Errorf("FILENAME_PATTERN: %v", err)
+	}
+	// Named styles: STYLES=<name> applies the bundle from STYLES_DIR/<name>.json
+	if c.Styles, err = loadStyles(env.get("STYLES_DIR", "")); err != nil {
+		return nil, fmt.Errorf("STYLES_DIR: %v", err)
+	}
+	if c.Layers, err = loadLayerConfig(env.get("LAYER_CONFIG", ""), c); err != nil {
+		return nil, fmt.Errorf("LAYER_CONFIG: %v", err)
+	}
+	return c, nil
+}
+
+// normalizeBasePath turns "weather/wms/" into "/weather/wms" ("" for root)
+func normalizeBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// publicPath returns the path prefix clients must use to reach this server:
+// any prefix stripped by a reverse proxy (X-Forwarded-Prefix) plus BASE_PATH
+func publicPath(r *http.Request) string {
+	return normalizeBasePath(r.Header.Get("X-Forwarded-Prefix")) + config().BasePath
+}
+
+// parseParamNames parses PROCESSOR_PARAM_NAMES' comma-separated
+// ours=theirs pairs
+func parseParamNames(spec string) (map[string]string, error) {
+	names := map[string]string{}
+	for _, pair := range splitList(spec) {
+		ours, theirs, ok := strings.Cut(pair, "=")
+		ours, theirs = strings.TrimSpace(ours), strings.TrimSpace(theirs)
+		if !ok || ours == "" || theirs == "" {
+			return nil, fmt.Errorf("PROCESSOR_PARAM_NAMES entry %q, expected name=processor_name", pair)
+		}
+		names[ours] = theirs
+	}
+	return names, nil
+}
+
+func parseProfile(name, spec string) (url.Values, error) {
+	v, err := url.ParseQuery(spec)
+	if err != nil {
+		return nil, fmt.Errorf("PROFILE_%s: %v", strings.ToUpper(name), err)
+	}
+	return v, nil
+}
+
+// profileNames returns the configured profile names in stable order
+func profileNames() []string {
+	names := make([]string, 0, len(config().Profiles))
+	for name := range config().Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":  "healthy",
-		"service": "weather-wms-server",
-		"time":    time.Now().UTC().Format(time.RFC3339),
+	json.NewEncoder(w).Encode(healthFields())
+}
+
+// healthFields is the /health payload, which /healthz builds on
+func healthFields() map[string]interface{} {
+	status := "healthy"
+	if maintenance.Load() {
+		status = "maintenance"
+	}
+	return map[string]interface{}{
+		"status":      status,
+		"maintenance": maintenance.Load(),
+		"service":     "weather-wms-server",
+		"time":        time.Now().UTC().Format(time.RFC3339),
 		"config": map[string]string{
-			"dataDir": config.DataDir,
-			"port":    config.Port,
+			"dataDir": config().DataDir,
+			"port":    config().Port,
 		},
-	})
+	}
 }
 
 func wmsHandler(w http.ResponseWriter, r *http.Request) {
-	request := r.URL.Query().Get("REQUEST")
-	vars := mux.Vars(r)
-	dataset := vars["dataset"]
+	q := wmsParams(r.URL.RawQuery)
+	if r.Method == http.MethodPost {
+		// Body params come first so they win over the URL's
+		body, status, err := readFormBody(w, r)
+		if err != nil {
+			writeWMSException(w, q, status, "InvalidRequest", err.Error())
+			return
+		}
+		q = wmsParams(body + "&" + r.URL.RawQuery)
+	}
+	request := q.Get("REQUEST")
+	// A bare ?SERVICE=WMS is how many clients ask what the server offers
+	if request == "" && strings.EqualFold(q.Get("SERVICE"), "WMS") {
+		request = "GetCapabilities"
+	}
+	dataset := datasetPath(r)
 	log.Printf("WMS Request: %s, dataset: %s", request, dataset)
 
+	// EXCEPTIONS is checked first so every later error can honor it
+	if _, ok := exceptionsFormat(q.Get("EXCEPTIONS")); !ok {
+		writeServiceException(w, http.StatusBadRequest, "InvalidParameterValue",
+			fmt.Sprintf("unsupported EXCEPTIONS %q, expected XML, INIMAGE, BLANK or JSON", q.Get("EXCEPTIONS")))
+		return
+	}
+
+	// SERVICE is optional for leniency, but anything other than WMS is a
+	// client pointed at the wrong endpoint
+	if service := q.Get("SERVICE"); service != "" && !strings.EqualFold(service, "WMS") {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue",
+			fmt.Sprintf("unsupported SERVICE %q, this endpoint only serves WMS", service))
+		return
+	}
+
 	switch request {
 	case "GetCapabilities":
-		handleGetCapabilities(w, r, dataset)
+		handleGetCapabilities(w, r, dataset, q)
 	case "GetMap":
-		handleGetMap(w, r, dataset)
+		handleGetMap(w, r, dataset, q)
 	case "GetFeatureInfo":
-		handleGetFeatureInfo(w, r, dataset)
+		handleGetFeatureInfo(w, r, dataset, q)
 	default:
-		http.Error(w, "Invalid REQUEST parameter. Use GetCapabilities, GetMap, or GetFeatureInfo", http.StatusBadRequest)
-	}
-}
-
-func handleGetCapabilities(w http.ResponseWriter, r *http.Request, dataset string) {
-	w.Header().Set("Content-Type", "text/xml")
-
-	// Generate a simple time dimension list: now to +48h in 3h steps
-	times := make([]string, 0, 17)
-	now := time.Now().UTC().Truncate(time.Hour)
-	for i := 0; i <= 48; i += 3 {
-		t := now.Add(time.Duration(i) * time.Hour)
-		times = append(times, t.Format(time.RFC3339))
-	}
-	timeList := strings.Join(times, ",")
-
-	// Basic capabilities including a time Dimension
-	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
-<WMS_Capabilities version="1.3.0" xmlns="http://www.opengis.net/wms">
-  <Service>
-    <Name>WMS</Name>
-    <Title>Weather Visualization WMS Server</Title>
-    <Abstract>Custom Golang WMS server for NOAA GFS weather data</Abstract>
-  </Service>
-  <Capability>
-    <Request>
-      <GetCapabilities>
-        <Format>text/xml</Format>
-      </GetCapabilities>
-      <GetMap>
-        <Format>image/png</Format>
-      </GetMap>
-      <GetFeatureInfo>
-        <Format>application/json</Format>
-      </GetFeatureInfo>
-    </Request>
-    <Layer>
-      <Title>Weather Data Layers</Title>
-      <CRS>EPSG:4326</CRS>
-      <CRS>EPSG:3857</CRS>
-      <Dimension name="time" units="ISO8601">%s</Dimension>
-    </Layer>
-  </Capability>
-</WMS_Capabilities>`, timeList)
-}
-
-func handleGetMap(w http.ResponseWriter, r *http.Request, dataset string) {
-	q := r.URL.Query()
-
-	// Dimensions
+		writeWMSException(w, q, http.StatusBadRequest, "OperationNotSupported",
+			"Invalid REQUEST parameter. Use GetCapabilities, GetMap, or GetFeatureInfo")
+	}
+}
+
+// wmsParams builds a case-insensitive view of the query string: keys are
+// upper-cased and, when a param appears more than once (in any case), the
+// first occurrence wins.
+func wmsParams(rawQuery string) url.Values {
+	params := url.Values{}
+	for _, kv := range strings.Split(rawQuery, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			continue
+		}
+		value, err := url.QueryUnescape(v)
+		if err != nil {
+			continue
+		}
+		key = strings.ToUpper(key)
+		if _, seen := params[key]; !seen {
+			params.Set(key, value)
+		}
+	}
+	return params
+}
+
+// readFormBody reads a form-encoded POST body of at most MAX_POST_BODY_KB,
+// returning the status to answer with when it can't
+func readFormBody(w http.ResponseWriter, r *http.Request) (string, int, error) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct != "application/x-www-form-urlencoded" {
+		return "", http.StatusUnsupportedMediaType,
+			fmt.Errorf("unsupported Content-Type %q, POST bodies must be application/x-www-form-urlencoded", ct)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(config().MaxPostBodyKB)*1024))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return "", http.StatusRequestEntityTooLarge,
+				fmt.Errorf("request body exceeds %d KB", config().MaxPostBodyKB)
+		}
+		return "", http.StatusBadRequest, fmt.Errorf("reading request body: %v", err)
+	}
+	return strings.TrimSpace(string(body)), 0, nil
+}
+
+// serviceURL returns the absolute WMS endpoint URL as seen by the client,
+// honoring X-Forwarded-Proto/X-Forwarded-Host from a reverse proxy
+func serviceURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := firstHeaderValue(r, "X-Forwarded-Proto"); p != "" {
+		scheme = p
+	}
+	host := r.Host
+	if h := firstHeaderValue(r, "X-Forwarded-Host"); h != "" {
+		host = h
+	}
+	return scheme + "://" + host + publicPath(r) + "/wms"
+}
+
+// firstHeaderValue returns the first entry of a comma-separated header
+// (proxies append one value per hop)
+func firstHeaderValue(r *http.Request, name string) string {
+	v, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(v)
+}
+
+// xmlEscape escapes s for use in XML text and attribute values
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func handleGetMap(w http.ResponseWriter, r *http.Request, dataset string, q url.Values) {
+	timing := newServerTiming()
+	r = routeGetMap(w, r)
+
+	// Parse dataset path to get layer (param name) and file name
+	layer, file, err := splitDataset(dataset)
+	if err != nil {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	pathFile := file
+	if config().StrictWMS {
+		if missing := missingGetMapParams(q, layer != ""); len(missing) > 0 {
+			writeWMSException(w, q, http.StatusBadRequest, "MissingParameterValue",
+				fmt.Sprintf("GetMap requires %s", strings.Join(missing, ", ")))
+			return
+		}
+	}
+	// Fallback: allow LAYERS param to map to our logical layer(s). Groups
+	// expand to their members; several layers are composited in order.
+	var layerList []string
+	if layer == "" {
+		layerList = expandLayers(q.Get("LAYERS"))
+		if len(layerList) > 0 {
+			layer = layerList[0]
+		}
+	}
+	// Without a layer the processor would fail with something far less clear
+	if layer == "" {
+		writeWMSException(w, q, http.StatusBadRequest, "LayerNotDefined",
+			"GetMap needs a layer: set LAYERS or request /wms/<dir>/<layer>/<file>")
+		return
+	}
+	for _, name := range append([]string{layer}, layerList...) {
+		if _, ok := layerIndex.Layer(name); !ok {
+			writeWMSException(w, q, http.StatusNotFound, "LayerNotDefined", fmt.Sprintf("no data for layer %q", name))
+			return
+		}
+	}
+
+	// Dimensions; omitted ones default per layer
 	width, _ := strconv.Atoi(q.Get("WIDTH"))
 	height, _ := strconv.Atoi(q.Get("HEIGHT"))
+	defWidth, defHeight := defaultImageSize(layer)
 	if width <= 0 {
-		width = 256
+		width = defWidth
 	}
 	if height <= 0 {
-		height = 256
+		height = defHeight
+	}
+	if config().MaxWidth > 0 && width > config().MaxWidth {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue",
+			fmt.Sprintf("WIDTH %d exceeds MaxWidth %d", width, config().MaxWidth))
+		return
+	}
+	if config().MaxHeight > 0 && height > config().MaxHeight {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue",
+			fmt.Sprintf("HEIGHT %d exceeds MaxHeight %d", height, config().MaxHeight))
+		return
+	}
+	if config().MaxLayers > 0 && len(layerList) > config().MaxLayers {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue",
+			fmt.Sprintf("too many layers: %d requested (after expanding groups), maximum is %d", len(layerList), config().MaxLayers))
+		return
 	}
 
-	// Parse dataset path to get layer (param name) and file name
-	// Expected: weather/<layer>/<file>.nc (e.g., weather/temp_2m/temp_2m_YYYYMMDDHH.nc)
-	layer := ""
-	file := ""
-	if dataset != "" {
-		parts := strings.Split(dataset, "/")
-		if len(parts) >= 2 {
-			layer = parts[len(parts)-2]
-			file = parts[len(parts)-1]
-		} else if len(parts) == 1 {
-			file = parts[0]
+	// Refuse a CRS the layer isn't available in rather than render a
+	// projected-only product distorted
+	crs := requestCRS(q)
+	if crs == "" {
+		crs = "EPSG:4326"
+	}
+	crsLayers := layerList
+	if len(crsLayers) == 0 && layer != "" {
+		crsLayers = []string{layer}
+	}
+	for _, name := range crsLayers {
+		if lc := config().Layers[name]; !lc.supportsCRS(crs) {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidCRS",
+				fmt.Sprintf("layer %s is not available in CRS %s; supported: %s", name, crs, strings.Join(lc.crsList(), ", ")))
+			return
 		}
 	}
-	// Fallback: allow LAYERS param to map to our logical layer if needed
-	if layer == "" {
-		if l := q.Get("LAYERS"); l != "" {
-			layer = l
+
+	// Map WMS BBOX/CRS -> processor bbox (EPSG:4326)
+	if s := q.Get("BBOX"); s != "" {
+		if _, err := parseBBoxValues(s); err != nil {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+			return
 		}
 	}
-	// Normalize file to base name only
-	if file != "" {
-		file = path.Base(file)
+	var bbox4326, resolution, nativeCRS string
+	if bb, ok := parseBBox(q.Get("BBOX")); ok && !isServerCRS(crs) {
+		// Only the processor can reproject this CRS, so the BBOX goes as-is
+		nativeCRS = crs
+		bbox4326 = fmt.Sprintf("%f,%f,%f,%f", bb[0], bb[1], bb[2], bb[3])
+		resolution = groundResolution(bb, width)
+	} else if bb, ok := requestBBox(q); ok {
+		if err := checkBBoxCRS(bb, requestCRS(q)); err != nil {
+			log.Printf("Rejecting GetMap BBOX %s: %v", q.Get("BBOX"), err)
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+			return
+		}
+		minx, miny, maxx, maxy := bboxToLonLat(bb, requestCRS(q))
+		bbox4326 = fmt.Sprintf("%f,%f,%f,%f", minx, miny, maxx, maxy)
+		resolution = groundResolution(bb, width)
+	} else if q.Get("BBOX") == "" && layer != "" {
+		// No BBOX: render the whole layer (all of them for a composite)
+		names := layerList
+		if len(names) == 0 {
+			names = []string{layer}
+		}
+		ext := layersExtent(names)
+		bbox4326 = fmt.Sprintf("%f,%f,%f,%f", ext[0], ext[1], ext[2], ext[3])
+		resolution = groundResolution(ext, width)
 	}
 
-	// Map WMS BBOX/CRS -> processor bbox (EPSG:4326)
-	bbox := q.Get("BBOX")
-	crs := q.Get("CRS")
-	if crs == "" {
-		// Some clients use SRS
-		crs = q.Get("SRS")
-	}
-
-	var bbox4326 string
-	if bbox != "" {
-		parts := strings.Split(bbox, ",")
-		if len(parts) == 4 {
-			minx, _ := strconv.ParseFloat(parts[0], 64)
-			miny, _ := strconv.ParseFloat(parts[1], 64)
-			maxx, _ := strconv.ParseFloat(parts[2], 64)
-			maxy, _ := strconv.ParseFloat(parts[3], 64)
-
-			// If WebMercator, convert to lon/lat
-			if strings.EqualFold(crs, "EPSG:3857") || strings.EqualFold(crs, "EPSG:900913") {
-				m2lon := func(mx float64) float64 { return (mx / 6378137.0) * 180.0 / math.Pi }
-				m2lat := func(my float64) float64 { return (2*math.Atan(math.Exp(my/6378137.0)) - math.Pi/2) * 180.0 / math.Pi }
-				lon1 := m2lon(minx)
-				lat1 := m2lat(miny)
-				lon2 := m2lon(maxx)
-				lat2 := m2lat(maxy)
-				minx, miny, maxx, maxy = lon1, lat1, lon2, lat2
-			}
-			bbox4326 = fmt.Sprintf("%f,%f,%f,%f", minx, miny, maxx, maxy)
+	li, _ := layerIndex.Layer(layer)
+	li.Name = layer
+
+	// ELEVATION picks a vertical level, narrowing the files the time and
+	// member params resolve against (the first level when omitted). A layer
+	// without levels rejects it rather than forwarding a param nothing reads.
+	elevation := q.Get("ELEVATION")
+	for _, name := range crsLayers {
+		if l, _ := layerIndex.Layer(name); elevation != "" && len(l.levels()) == 0 {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidDimensionValue",
+				fmt.Sprintf("layer %s has no elevation dimension", name))
+			return
+		}
+	}
+	if levels := li.levels(); len(levels) > 0 && len(layerList) <= 1 {
+		level := elevation
+		if level == "" {
+			level = levels[0]
+		} else if !containsString(levels, level) {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidDimensionValue",
+				fmt.Sprintf("unknown ELEVATION %q for layer %s, expected one of: %s", elevation, layer, strings.Join(levels, ", ")))
+			return
+		}
+		if file == "" {
+			li = li.atLevel(level)
 		}
 	}
 
 	// Map optional params
 	timeParam := q.Get("TIME")
+
+	// Pinned model run and/or forecast hour (default: latest run)
+	var run time.Time
+	refParam, fhParam := q.Get("DIM_REFERENCE_TIME"), q.Get("DIM_FORECAST_HOUR")
+	if refParam != "" || fhParam != "" {
+		var err error
+		if run, err = resolveReferenceTime(li, refParam); err != nil {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidDimensionValue", err.Error())
+			return
+		}
+		if files := li.runFiles(run); len(files) > 0 {
+			file = files[0].Name
+		}
+		if fhParam != "" {
+			step, err := forecastHourStep(li, run, fhParam)
+			if err != nil {
+				writeWMSException(w, q, http.StatusBadRequest, "InvalidDimensionValue", err.Error())
+				return
+			}
+			timeParam = step.Time.Format(time.RFC3339)
+			file = step.File.Name
+		}
+	}
+
+	// Relative TIME (e.g. PT6H) is an offset from the model run
+	if isRelativeTime(timeParam) {
+		step, err := resolveRelativeTime(li, run, timeParam)
+		if err != nil {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidDimensionValue", err.Error())
+			return
+		}
+		timeParam = step.Time.Format(time.RFC3339)
+		file = step.File.Name
+	}
+
+	// A TIME without an exact timestep renders the nearest earlier one
+	// with TIME_FALLBACK, or the nearest within TIME_TOLERANCE; further
+	// off than the tolerance either way is a miss
+	if t, err := time.Parse(time.RFC3339, timeParam); err == nil && (config().TimeFallback || config().TimeTolerance > 0) && file == "" && len(layerList) <= 1 {
+		steps := li.timeSteps()
+		if !run.IsZero() {
+			steps = li.runSteps(run)
+		}
+		var step timeStep
+		var ok bool
+		if config().TimeFallback {
+			step, ok = previousTimeStep(steps, t)
+		} else {
+			step, ok = closestTimeStep(steps, t)
+		}
+		if ok && config().TimeTolerance > 0 && absDuration(step.Time.Sub(t)) > config().TimeTolerance {
+			ok = false
+		}
+		if !ok && config().TimeTolerance > 0 {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidDimensionValue",
+				fmt.Sprintf("no data for layer %s within %s of TIME %s", layer, config().TimeTolerance, timeParam))
+			return
+		}
+		if ok && !step.Time.Equal(t) {
+			timeParam = step.Time.Format(time.RFC3339)
+			file = step.File.Name
+			w.Header().Set("X-Time-Substituted", timeParam)
+		}
+	}
+
+	// Ensemble member: pick that member's file for the valid time (control by default)
+	var memberFiles []string
+	member := q.Get("MEMBER")
+	if layer != "" {
+		var err error
+		if member, file, memberFiles, err = resolveMember(li, member, file, timeParam); err != nil {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidDimensionValue", err.Error())
+			return
+		}
+	}
 	colorRange := q.Get("COLORSCALERANGE")
 	styles := q.Get("STYLES")
 	palette := q.Get("PALETTE")
 	gammaParam := q.Get("GAMMA")
-	if gammaParam == "" {
-		gammaParam = q.Get("gamma")
+
+	// Rendering profile (fast for interactive panning, quality for exports)
+	profileName := strings.ToLower(q.Get("PROFILE"))
+	profile, ok := config().Profiles[profileName]
+	if profileName != "" && !ok {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue",
+			fmt.Sprintf("unknown PROFILE %q, expected one of: %s", q.Get("PROFILE"), strings.Join(profileNames(), ", ")))
+		return
+	}
+
+	format := q.Get("FORMAT")
+	if format != "" && !procInfo().supportsFormat(format) {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidFormat",
+			fmt.Sprintf("unsupported FORMAT %q, expected one of: %s", format, strings.Join(procInfo().Formats, ", ")))
+		return
+	}
+
+	formatOptions, err := parseFormatOptions(q.Get("FORMAT_OPTIONS"))
+	if err != nil {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	colorScale, err := ncwmsParams(q)
+	if err != nil {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+
+	// Sharpen/smooth after rendering; "" when there's nothing to do
+	postprocess, err := postProcessMode(q.Get("POSTPROCESS"), layer)
+	if err != nil {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	// Palette size to quantize the PNG to; 0 leaves it as rendered
+	quantize, err := quantizeColors(q.Get("QUANTIZE"), format, layer)
+	if err != nil {
+		writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+
+	// STYLES=rgb maps three layers to the color channels of one render
+	var rgb url.Values
+	if strings.EqualFold(styles, rgbStyle) {
+		if rgb, err = rgbParams(layerList, q.Get("LAYERS"), colorRange); err != nil {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+			return
+		}
+	}
+
+	// Named style from the registry; composites need it valid for every layer
+	var style *namedStyle
+	styleLayers := layerList
+	if len(styleLayers) == 0 {
+		styleLayers = []string{layer}
+	}
+	if rgb != nil {
+		styleLayers = nil // rgb isn't a registry style
+	}
+	for _, l := range styleLayers {
+		if style, err = resolveStyle(styles, l); err != nil {
+			writeWMSException(w, q, http.StatusBadRequest, "StyleNotDefined", err.Error())
+			return
+		}
 	}
 
 	// Build processor render URL
 	v := url.Values{}
+	for key, values := range profile {
+		v[key] = values
+	}
+	// FORMAT_OPTIONS override the profile, a named style overrides both and
+	// explicit params below win over everything
+	for key, value := range formatOptions {
+		v.Set(key, value)
+	}
+	if style != nil {
+		for key, values := range style.params() {
+			v[key] = values
+		}
+	}
 	if layer != "" {
 		v.Set("layer", layer)
 	}
 	if file != "" {
 		v.Set("file", file)
 	}
+	// PNG is the processor default; leaving it out keeps cache keys stable
+	if format != "" && !strings.EqualFold(format, "image/png") {
+		v.Set("format", format)
+	}
 	v.Set("width", strconv.Itoa(width))
 	v.Set("height", strconv.Itoa(height))
 	if bbox4326 != "" {
 		v.Set("bbox", bbox4326)
 	}
+	if nativeCRS != "" {
+		v.Set("crs", nativeCRS)
+	}
+	// Lets the processor pick a decimated grid for coarse output
+	if resolution != "" {
+		v.Set("resolution", resolution)
+	}
 	if colorRange != "" {
 		v.Set("colorscalerange", colorRange)
 	}
+	for key, values := range colorScale {
+		v[key] = values
+	}
 	if timeParam != "" {
 		v.Set("time", timeParam)
 	}
-	// Forward style/palette to processor for high-contrast rendering
-	if styles != "" {
-		v.Set("styles", styles)
-	} else if palette != "" {
+	// STYLES is a registry style (applied above), an ncWMS <mode>/<palette>
+	// or a processor style or palette name; PALETTE, when given, always
+	// sets the palette, whichever form STYLES took
+	if styles != "" && style == nil {
+		for key, values := range styleParams(styles) {
+			v[key] = values
+		}
+	}
+	if palette != "" {
 		v.Set("palette", palette)
 	}
 	// Forward gamma (contrast tuning) if provided
 	if gammaParam != "" {
 		v.Set("gamma", gammaParam)
 	}
+	if member != "" {
+		v.Set("member", member)
+	}
+	if elevation != "" {
+		v.Set("elevation", elevation)
+	}
+	// A processor that post-processes itself does it before encoding
+	if postprocess != "" && procInfo().supportsPostProcess(postprocess) {
+		v.Set("postprocess", postprocess)
+		postprocess = ""
+	}
+	withGutter(v, requestGutter(style, format))
+	// Ensemble mean: the processor composites every member file of the run
+	if len(memberFiles) > 0 {
+		v.Del("file")
+		v.Set("files", strings.Join(memberFiles, ","))
+	}
 
-	renderURL := "http://weather-processor:8081/api/render?" + v.Encode()
-	resp, err := http.Get(renderURL)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("render backend error: %v", err), http.StatusBadGateway)
+	// The band layers replace the single-layer selection
+	if rgb != nil {
+		for _, k := range []string{"file", "files", "member", "colorscalerange", "palette"} {
+			v.Del(k)
+		}
+		for k, vals := range rgb {
+			v[k] = vals
+		}
+	}
+
+	if rgb == nil {
+		if err := checkLogScale(v, styleLayers); err != nil {
+			writeWMSException(w, q, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+			return
+		}
+	}
+
+	// A file deleted since discovery would only get an opaque processor
+	// error; a file named in the path is the layer itself going missing
+	if name, ok := missingDataFile(li, v); !ok {
+		code := "InvalidDimensionValue"
+		if name == pathFile {
+			code = "LayerNotQueryable"
+		}
+		writeWMSException(w, q, http.StatusNotFound, code,
+			fmt.Sprintf("data file %s of layer %s is no longer available", name, layer))
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		w.WriteHeader(http.StatusBadGateway)
-		io.Copy(w, resp.Body)
+	if config().DebugHeaders && len(layerList) <= 1 {
+		setDataHeaders(w, li, v)
+	}
+
+	timing.phase("param-parse")
+
+	var entry cacheEntry
+	var streamed bool
+	overlay := debugBorders(q.Get("DEBUG"))
+	switch {
+	case len(layerList) > 1 && rgb == nil:
+		entry, ok = renderComposite(w, r, q, v, layerList, width, height, timing)
+	case overlay || postprocess != "" || quantize > 0:
+		// These need the whole image, so never stream
+		entry, ok = renderCached(w, r, q, v, width, height, timing)
+	default:
+		entry, streamed, ok = renderOrStream(w, r, q, v, width, height, timing)
+	}
+	if !ok || streamed {
+		return
+	}
+	if postprocess != "" {
+		if entry, err = postProcessEntry(entry, postprocess); err != nil {
+			writeRenderError(w, q, fmt.Errorf("post-processing: %w", err), timing)
+			return
+		}
+		timing.phase("postprocess")
+	}
+	if quantize > 0 {
+		before := len(entry.Body)
+		if entry, err = quantizeEntry(entry, quantize); err != nil {
+			writeRenderError(w, q, fmt.Errorf("quantizing: %w", err), timing)
+			return
+		}
+		timing.phase("quantize")
+		if config().DebugHeaders {
+			w.Header().Set("X-Quantize", fmt.Sprintf("%d colors; %d -> %d bytes (%.0f%% smaller)",
+				quantize, before, len(entry.Body), 100*float64(before-len(entry.Body))/float64(max(before, 1))))
+		}
+	}
+	if overlay {
+		bbox := q.Get("BBOX")
+		if bbox == "" {
+			bbox = v.Get("bbox")
+		}
+		label := []string{crs, bbox, fmt.Sprintf("%dx%d res %s", width, height, v.Get("resolution"))}
+		if entry, err = drawTileBorder(entry, label); err != nil {
+			writeRenderError(w, q, fmt.Errorf("drawing debug overlay: %w", err), timing)
+			return
+		}
+	}
+
+	w.Header().Set("Server-Timing", timing.header())
+	// Tile clients skip drawing a 204, saving the transparent PNG's bytes
+	if (q.Get("NODATA") == "204" || config().NoDataResponse == "204") && (entry.NoData || isTransparentImage(entry.Body)) {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
+	if config().BufferThreshold > 0 {
+		w.Header().Set("X-Response-Mode", "buffered")
+	}
+	// Buffered, so the body's length and hash are known up front
+	w.Header().Set("Content-Type", entry.ContentType)
+	setDisposition(w, entry.ContentType, v)
+	w.Header().Set("ETag", entryETag(entry))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(entry.Body))
+}
 
-	// Stream PNG back to client
-	w.Header().Set("Content-Type", "image/png")
-	io.Copy(w, resp.Body)
+// renderTimes is where a cachedRender's time went, for Server-Timing
+type renderTimes struct {
+	lookup time.Duration // tile cache lookup
+	fetch  time.Duration // processor render, on a miss
 }
 
-func handleGetFeatureInfo(w http.ResponseWriter, r *http.Request, dataset string) {
-	w.Header().Set("Content-Type", "application/json")
-	// Minimal stub response
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"dataset": dataset,
-		"value":   nil,
-		"info":    "FeatureInfo not implemented yet",
-	})
+// cachedRender serves processor params v from the tile cache or renders
+// them within the time budget; degraded results aren't cached. Times, if
+// not nil, gets the lookup and fetch durations.
+func cachedRender(ctx context.Context, v url.Values, width, height int, times *renderTimes) (entry cacheEntry, hit bool, degraded string, err error) {
+	if times == nil {
+		times = &renderTimes{}
+	}
+	v = withLayerParams(v)
+	cacheKey := v.Encode()
+	lookupStart := time.Now()
+	entry, hit = tiles.Get(cacheKey)
+	times.lookup = time.Since(lookupStart)
+	if hit {
+		stats.hit(cacheKey)
+		return entry, true, "", nil
+	}
+	if maintenance.Load() {
+		return entry, false, "", errMaintenance
+	}
+	start := time.Now()
+	entry, degraded, err = renderWithBudget(ctx, v, width, height)
+	times.fetch = time.Since(start)
+	stats.miss(cacheKey, time.Since(start), entry.RenderTime)
+	backendRender(ctx, time.Since(start), err)
+	if colors := config().Layers[v.Get("layer")].serverMaskColors(); err == nil && len(colors) > 0 {
+		entry, err = maskImageColors(entry, colors)
+	}
+	if m := config().Layers[v.Get("layer")].serverClip(); err == nil && m != nil {
+		entry, err = clipToMask(entry, m, v)
+	}
+	if err == nil && degraded == "" {
+		tiles.Put(cacheKey, entry)
+		putStale(v, entry)
+	}
+	return entry, false, degraded, err
+}
+
+// renderCached is cachedRender for a handler: it sets the cache headers and
+// on failure writes the ServiceException itself and returns false
+func renderCached(w http.ResponseWriter, r *http.Request, q, v url.Values, width, height int, timing *serverTiming) (cacheEntry, bool) {
+	var times renderTimes
+	entry, hit, degraded, err := cachedRender(r.Context(), v, width, height, &times)
+	timing.measured("cache-lookup", times.lookup)
+	if !hit {
+		timing.measured("processor-fetch", times.fetch)
+		timing.overlap("processor", entry.RenderTime)
+	}
+	if err != nil {
+		writeRenderError(w, q, err, timing)
+		return entry, false
+	}
+	setRenderHeaders(w, hit, degraded)
+	return entry, true
+}
+
+// renderComposite renders each layer concurrently with the shared params
+// and blends them bottom-to-top. File and member pinning only apply to
+// single-layer requests.
+func renderComposite(w http.ResponseWriter, r *http.Request, q, v url.Values, layers []string, width, height int, timing *serverTiming) (cacheEntry, bool) {
+	entries := make([]cacheEntry, len(layers))
+	errs := make([]error, len(layers))
+	var wg sync.WaitGroup
+	allHit := true
+	var degraded string
+	var slowest renderTimes
+	var processor time.Duration
+	var mu sync.Mutex
+	for i, layer := range layers {
+		lv := url.Values{}
+		for k, vals := range v {
+			lv[k] = vals
+		}
+		lv.Set("layer", layer)
+		lv.Del("file")
+		lv.Del("files")
+		lv.Del("member")
+
+		wg.Add(1)
+		go func(i int, lv url.Values) {
+			defer wg.Done()
+			var times renderTimes
+			e, hit, d, err := cachedRender(r.Context(), lv, width, height, &times)
+			entries[i], errs[i] = e, err
+			mu.Lock()
+			allHit = allHit && hit
+			if d != "" {
+				degraded = d
+			}
+			slowest.lookup = max(slowest.lookup, times.lookup)
+			if !hit {
+				slowest.fetch = max(slowest.fetch, times.fetch)
+				processor = max(processor, e.RenderTime)
+			}
+			mu.Unlock()
+		}(i, lv)
+	}
+	wg.Wait()
+	// Layers render concurrently, so the slowest is what the client waited on
+	timing.measured("cache-lookup", slowest.lookup)
+	if !allHit {
+		timing.measured("processor-fetch", slowest.fetch)
+	}
+	timing.overlap("processor", processor)
+
+	for i, err := range errs {
+		if err != nil {
+			writeRenderError(w, q, fmt.Errorf("layer %s: %w", layers[i], err), timing)
+			return cacheEntry{}, false
+		}
+	}
+	entry, err := compositeEntries(entries, width, height)
+	timing.phase("composite")
+	if err != nil {
+		writeRenderError(w, q, fmt.Errorf("compositing layers: %w", err), timing)
+		return cacheEntry{}, false
+	}
+	setRenderHeaders(w, allHit, degraded)
+	return entry, true
+}
+
+func writeRenderError(w http.ResponseWriter, q url.Values, err error, timing *serverTiming) {
+	w.Header().Set("Server-Timing", timing.header())
+	writeWMSException(w, q, renderErrorStatus(w, err), "NoApplicableCode", err.Error())
+}
+
+// renderErrorStatus maps a render failure to its HTTP status, setting
+// Retry-After while in maintenance
+func renderErrorStatus(w http.ResponseWriter, err error) int {
+	switch {
+	case errors.Is(err, errMaintenance):
+		w.Header().Set("Retry-After", strconv.Itoa(config().MaintenanceRetry))
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errRenderBudget), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func setRenderHeaders(w http.ResponseWriter, hit bool, degraded string) {
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	if degraded != "" {
+		// Don't let the lower-quality substitute stick anywhere
+		w.Header().Set("X-Render-Degraded", degraded)
+		w.Header().Set("Cache-Control", "no-store")
+	}
+}
+
+// setDataHeaders names the file(s) and valid time a render uses. Without a
+// pinned file that is the index's file for the requested time, else the
+// latest run's, which is what the processor falls back to.
+func setDataHeaders(w http.ResponseWriter, li layerInfo, v url.Values) {
+	file := v.Get("file")
+	if files := v.Get("files"); files != "" {
+		file = files
+	}
+	if t, err := time.Parse(time.RFC3339, v.Get("time")); err == nil {
+		w.Header().Set("X-Data-Time", t.UTC().Format(time.RFC3339))
+		if file == "" {
+			for _, st := range li.timeSteps() {
+				if st.Time.Equal(t) {
+					file = st.File.Name
+					break
+				}
+			}
+		}
+	}
+	if file == "" && len(li.Files) > 0 {
+		file = li.Files[len(li.Files)-1].Name
+	}
+	if file != "" {
+		w.Header().Set("X-Data-File", file)
+	}
+}
+
+// missingDataFile checks that the files a render names still exist,
+// returning the first that doesn't. Renders that leave the file to the
+// processor have nothing to check.
+func missingDataFile(li layerInfo, v url.Values) (string, bool) {
+	var names []string
+	if file := v.Get("file"); file != "" {
+		names = append(names, file)
+	}
+	if files := v.Get("files"); files != "" {
+		names = append(names, strings.Split(files, ",")...)
+	}
+	for _, name := range names {
+		// The processor looks up a file it wasn't told the path of in DATA_DIR
+		p := filepath.Join(config().DataDir, name)
+		if f, ok := li.fileByName(name); ok {
+			p = f.Path
+		}
+		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+			return name, false
+		}
+	}
+	return "", true
+}
+
+// resolveMember validates MEMBER against the layer's ensemble members and
+// returns the member and file to render: the member's file at the valid
+// time of the requested file or TIME, looked up as for a layer without
+// members, else the first of the run. For "mean", files lists every
+// member's for the processor to composite.
+func resolveMember(li layerInfo, member, file, timeParam string) (string, string, []string, error) {
+	members := li.members()
+	if len(members) == 0 {
+		if member != "" {
+			return "", "", nil, fmt.Errorf("layer %s has no member dimension", li.Name)
+		}
+		return "", file, nil, nil
+	}
+	if member == "" {
+		member = li.defaultMember()
+	}
+	if member != "mean" && !containsString(members, member) {
+		return "", "", nil, fmt.Errorf("unknown MEMBER %q for layer %s, expected mean or one of: %s",
+			member, li.Name, strings.Join(members, ", "))
+	}
+
+	// Run of the requested file, else the latest; a valid time from the
+	// file's forecast hour or TIME, else none
+	run := li.Files[len(li.Files)-1].RunTime
+	var valid time.Time
+	pinned := false
+	if f, ok := li.fileByName(file); ok {
+		run, pinned = f.RunTime, true
+		if f.ForecastHour >= 0 {
+			valid = f.RunTime.Add(time.Duration(f.ForecastHour) * time.Hour)
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, timeParam); err == nil {
+		valid = t
+	}
+	if valid.IsZero() {
+		pinned = true
+	}
+
+	pick := func(m string) (dataFile, bool) {
+		ml := layerInfo{Name: li.Name}
+		for _, f := range li.Files {
+			if f.Member == m && (!pinned || f.RunTime.Equal(run)) {
+				ml.Files = append(ml.Files, f)
+			}
+		}
+		if valid.IsZero() {
+			if len(ml.Files) == 0 {
+				return dataFile{}, false
+			}
+			return ml.Files[0], true
+		}
+		for _, st := range ml.timeSteps() {
+			if st.Time.Equal(valid) {
+				return st.File, true
+			}
+		}
+		return dataFile{}, false
+	}
+	notAvailable := func(m string) error {
+		if valid.IsZero() {
+			return fmt.Errorf("MEMBER %s is not available for the %s run of layer %s", m, run.Format(time.RFC3339), li.Name)
+		}
+		return fmt.Errorf("MEMBER %s has no data for layer %s at %s", m, li.Name, valid.Format(time.RFC3339))
+	}
+
+	if member != "mean" {
+		f, ok := pick(member)
+		if !ok {
+			return "", "", nil, notAvailable(member)
+		}
+		return member, f.Name, nil, nil
+	}
+	var files []string
+	for _, m := range members {
+		if f, ok := pick(m); ok {
+			files = append(files, f.Name)
+		}
+	}
+	if len(files) == 0 {
+		return "", "", nil, notAvailable(member)
+	}
+	return member, "", files, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// datasetPath returns the /wms/{dataset} part of the request path still
+// percent-encoded, so an encoded slash stays inside its segment. The mux
+// var is already decoded and can't tell the two apart.
+func datasetPath(r *http.Request) string {
+	p := strings.TrimPrefix(r.URL.EscapedPath(), config().BasePath)
+	if raw, ok := strings.CutPrefix(p, "/wms/"); ok {
+		return raw
+	}
+	return mux.Vars(r)["dataset"]
+}
+
+// splitDataset parses a percent-encoded dataset path into layer (param
+// name) and file name, decoding each segment.
+// Expected: weather/<layer>/<file>.nc (e.g., weather/temp_2m/temp_2m_YYYYMMDDHH.nc)
+func splitDataset(dataset string) (layer, file string, err error) {
+	if dataset != "" {
+		parts := strings.Split(dataset, "/")
+		if len(parts) >= 2 {
+			layer = parts[len(parts)-2]
+			file = parts[len(parts)-1]
+		} else if len(parts) == 1 {
+			file = parts[0]
+		}
+	}
+	if layer, err = decodeDatasetSegment(layer); err != nil {
+		return "", "", err
+	}
+	if file, err = decodeDatasetSegment(file); err != nil {
+		return "", "", err
+	}
+	return layer, file, nil
+}
+
+// decodeDatasetSegment unescapes one path segment, refusing anything that
+// would decode into a different path (slashes, dot segments, NUL)
+func decodeDatasetSegment(seg string) (string, error) {
+	if seg == "" {
+		return "", nil
+	}
+	s, err := url.PathUnescape(seg)
+	if err != nil {
+		return "", fmt.Errorf("invalid dataset path segment %q: %v", seg, err)
+	}
+	if s == "." || s == ".." || strings.ContainsAny(s, "/\\\x00") {
+		return "", fmt.Errorf("invalid dataset path segment %q", seg)
+	}
+	return s, nil
+}
+
+// missingGetMapParams lists the params WMS requires of every GetMap that q
+// lacks, all of them so a client can fix its request in one go. STYLES
+// may be empty but must be present; a layer in the path stands in for
+// LAYERS.
+func missingGetMapParams(q url.Values, pathLayer bool) []string {
+	crs := "CRS"
+	if requestVersion(q) == wms111 {
+		crs = "SRS"
+	}
+	var missing []string
+	for _, p := range []string{"LAYERS", "STYLES", crs, "BBOX", "WIDTH", "HEIGHT", "FORMAT"} {
+		_, present := q[p]
+		switch {
+		case p == "LAYERS" && pathLayer:
+		case p == "STYLES" && present:
+		case p == crs && requestCRS(q) != "":
+		case q.Get(p) == "":
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// requestCRS returns the CRS param, falling back to SRS used by some clients
+func requestCRS(q url.Values) string {
+	if crs := q.Get("CRS"); crs != "" {
+		return crs
+	}
+	return q.Get("SRS")
+}
+
+// WMS versions the server speaks
+const (
+	wms111 = "1.1.1"
+	wms130 = "1.3.0"
+)
+
+// requestVersion is the WMS version to answer in: VERSION (WMTVER from
+// pre-1.1 clients), else DEFAULT_WMS_VERSION. Per the version negotiation
+// rules, anything below 1.3.0 gets 1.1.1 and anything newer 1.3.0.
+func requestVersion(q url.Values) string {
+	s := q.Get("VERSION")
+	if s == "" {
+		s = q.Get("WMTVER")
+	}
+	cmp, ok := compareVersion(s, wms130)
+	switch {
+	case !ok:
+		return config().DefaultWMSVersion
+	case cmp < 0:
+		return wms111
+	default:
+		return wms130
+	}
+}
+
+// compareVersion compares dotted version numbers such as 1.1.1
+func compareVersion(a, b string) (int, bool) {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		var err error
+		if i < len(as) {
+			if x, err = strconv.Atoi(as[i]); err != nil || x < 0 {
+				return 0, false
+			}
+		}
+		if i < len(bs) {
+			if y, err = strconv.Atoi(bs[i]); err != nil || y < 0 {
+				return 0, false
+			}
+		}
+		if x != y {
+			if x < y {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+// swapsAxes reports whether a BBOX in crs is given lat,lon: WMS 1.3.0
+// follows the EPSG axis order for EPSG:4326, while 1.1.1 always has x,y
+func swapsAxes(version, crs string) bool {
+	return version == wms130 && strings.EqualFold(crs, "EPSG:4326")
+}
+
+// requestBBox parses BBOX in x,y order for the request's CRS
+func requestBBox(q url.Values) ([4]float64, bool) {
+	bb, ok := parseBBox(q.Get("BBOX"))
+	if ok && swapsAxes(requestVersion(q), requestCRS(q)) {
+		bb = [4]float64{bb[1], bb[0], bb[3], bb[2]}
+	}
+	return bb, ok
+}
+
+// parseBBox parses a "minx,miny,maxx,maxy" string
+func parseBBox(bbox string) ([4]float64, bool) {
+	bb, err := parseBBoxValues(bbox)
+	return bb, err == nil
+}
+
+// bboxFields name the BBOX components in errors
+var bboxFields = [4]string{"minx", "miny", "maxx", "maxy"}
+
+// parseBBoxValues is parseBBox with an error naming the component that
+// isn't a number. Space around values is ignored, so " -1.2e2 , 3.4,..."
+// parses.
+func parseBBoxValues(bbox string) ([4]float64, error) {
+	var bb [4]float64
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return bb, fmt.Errorf("invalid BBOX %q, expected minx,miny,maxx,maxy", bbox)
+	}
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return bb, fmt.Errorf("invalid BBOX %s %q, expected a number", bboxFields[i], p)
+		}
+		bb[i] = f
+	}
+	return bb, nil
+}
+
+// FORMAT_OPTIONS keys forwarded to the processor; others are ignored
+var formatOptionKeys = map[string]bool{"antialias": true, "quantizer": true, "palette": true}
+
+// parseFormatOptions parses GeoServer-style "key:value;key2:value2"
+// rendering hints, keeping the recognized keys
+func parseFormatOptions(s string) (map[string]string, error) {
+	opts := map[string]string{}
+	for _, kv := range strings.Split(s, ";") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, ":")
+		k = strings.ToLower(strings.TrimSpace(k))
+		if !ok || k == "" {
+			return nil, fmt.Errorf("malformed FORMAT_OPTIONS entry %q, expected key:value", kv)
+		}
+		if formatOptionKeys[k] {
+			opts[k] = strings.TrimSpace(v)
+		}
+	}
+	return opts, nil
+}
+
+// groundResolution is the BBOX width in CRS units per output pixel
+func groundResolution(bb [4]float64, width int) string {
+	return strconv.FormatFloat((bb[2]-bb[0])/float64(width), 'g', 6, 64)
+}
+
+// checkBBoxCRS catches a BBOX given in the wrong units for its CRS.
+// Degrees sent as EPSG:3857 would render a sub-kilometre blank tile off
+// Africa; only zoom 17+ tiles touching 0,0 legitimately look like that.
+func checkBBoxCRS(bb [4]float64, crs string) error {
+	inDegrees := true
+	for i, v := range bb {
+		limit := 180.0
+		if i%2 == 1 {
+			limit = 90
+		}
+		if math.Abs(v) > limit {
+			inDegrees = false
+		}
+	}
+	if isWebMercator(crs) {
+		if inDegrees && bb[2]-bb[0] >= 1 && bb[3]-bb[1] >= 1 {
+			return fmt.Errorf("BBOX %g,%g,%g,%g looks like degrees but CRS is %s (metres); use CRS=EPSG:4326 or convert the BBOX",
+				bb[0], bb[1], bb[2], bb[3], crs)
+		}
+		return nil
+	}
+	if !inDegrees && math.Abs(bb[0]) <= 90 && math.Abs(bb[2]) <= 90 && math.Abs(bb[1]) <= 180 && math.Abs(bb[3]) <= 180 {
+		// lat,lon order; still degrees
+		return nil
+	}
+	if !inDegrees {
+		return fmt.Errorf("BBOX %g,%g,%g,%g is outside the degree range of %s; did you mean CRS=EPSG:3857?",
+			bb[0], bb[1], bb[2], bb[3], crs)
+	}
+	return nil
+}
+
+// bboxToLonLat converts a BBOX in the given CRS to lon/lat (EPSG:4326)
+func bboxToLonLat(bb [4]float64, crs string) (minx, miny, maxx, maxy float64) {
+	minx, miny, maxx, maxy = bb[0], bb[1], bb[2], bb[3]
+	// If WebMercator, convert to lon/lat
+	if isWebMercator(crs) {
+		minx, miny = mercatorToLonLat(minx, miny)
+		maxx, maxy = mercatorToLonLat(maxx, maxy)
+	}
+	return minx, miny, maxx, maxy
+}
+
+// isServerCRS reports whether bboxToLonLat can convert from crs
+func isServerCRS(crs string) bool {
+	return strings.EqualFold(crs, "EPSG:4326") || isWebMercator(crs)
+}
+
+func isWebMercator(crs string) bool {
+	return strings.EqualFold(crs, "EPSG:3857") || strings.EqualFold(crs, "EPSG:900913")
+}
+
+// Web Mercator is undefined at the poles; clamp to its usual latitude limit
+const maxMercatorLat = 85.0511287798
+
+func lonLatToMercator(lon, lat float64) (mx, my float64) {
+	lat = math.Max(-maxMercatorLat, math.Min(maxMercatorLat, lat))
+	mx = lon * math.Pi / 180.0 * 6378137.0
+	my = math.Log(math.Tan(math.Pi/4+lat*math.Pi/360.0)) * 6378137.0
+	return mx, my
+}
+
+func mercatorToLonLat(mx, my float64) (lon, lat float64) {
+	lon = (mx / 6378137.0) * 180.0 / math.Pi
+	lat = (2*math.Atan(math.Exp(my/6378137.0)) - math.Pi/2) * 180.0 / math.Pi
+	return lon, lat
+}
+
+// middleware wraps the routes in what every request goes through. Panics
+// are recovered outside everything but the access log, so one in the gzip
+// or tracing code still gets its 500, span and log line.
+func middleware(logOut io.Writer, next http.Handler) http.Handler {
+	return accessLog(logOut, recoverPanics(traceRequests(compress(cacheControl(next)))))
 }
 
 func main() {
-	log.Printf("Starting Weather WMS Server on port %s", config.Port)
+	log.Printf("Starting Weather WMS Server on port %s", config().Port)
 
-	router := mux.NewRouter()
+	maintenance.Store(config().env.get("MAINTENANCE_MODE", "false") == "true")
+	if maintenance.Load() {
+		log.Printf("Starting in maintenance mode: cache misses will return 503")
+	}
+	tiles = newTileCache(config().CacheSize)
+	go stats.aggregate()
+	if config().CacheDiskDir != "" {
+		disk, err := newDiskCache(config().CacheDiskDir, int64(config().CacheDiskMaxMB)<<20)
+		if err != nil {
+			log.Fatalf("Opening CACHE_DISK_DIR: %v", err)
+		}
+		tiles.disk = disk
+	}
+	layerIndex = NewLayerIndex(config().DataDir)
+	autowarmSlots = make(chan struct{}, max(config().AutowarmConcurrency, 1))
+	layerIndex.onChange = autowarmNewData
+	if config().IndexRefresh > 0 {
+		go layerIndex.refreshEvery(config().IndexRefresh)
+	}
+	info := probeProcessorInfo(context.Background())
+	currentProcInfo.Store(&info)
+	go watchReload()
+
+	root := mux.NewRouter()
+	router := root
+	if config().BasePath != "" {
+		log.Printf("Serving under base path %s", config().BasePath)
+		router = root.PathPrefix(config().BasePath).Subrouter()
+	}
 	router.HandleFunc("/health", healthHandler).Methods("GET")
-	router.HandleFunc("/wms", wmsHandler).Methods("GET", "HEAD", "OPTIONS")
-	router.HandleFunc("/wms/{dataset:.*}", wmsHandler).Methods("GET", "HEAD", "OPTIONS")
+	router.HandleFunc("/healthz", healthzHandler).Methods("GET")
+	router.HandleFunc("/favicon.ico", faviconHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/wms", wmsHandler).Methods("GET", "HEAD", "POST", "OPTIONS")
+	router.HandleFunc("/wms/{dataset:.*}", wmsHandler).Methods("GET", "HEAD", "POST", "OPTIONS")
+	router.HandleFunc("/wmts/{layer}/{time}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", wmtsTileHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/preview/{layer}", previewHandler).Methods("GET")
+	router.HandleFunc("/animate", animateHandler).Methods("GET")
+	router.HandleFunc("/availability/{layer}", availabilityHandler).Methods("GET")
+	router.HandleFunc("/datasets", datasetsHandler).Methods("GET")
+	router.HandleFunc("/value", valueHandler).Methods("GET", "POST")
+	router.HandleFunc("/stats-region/{layer}", regionStatsHandler).Methods("GET")
+	router.HandleFunc("/collections", collectionsHandler).Methods("GET")
+	router.HandleFunc("/collections/{layer}/map", collectionMapHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/meta/{layer}", metaHandler).Methods("GET")
+	router.HandleFunc("/admin/maintenance", maintenanceHandler).Methods("GET", "POST")
+	router.HandleFunc("/stats", statsHandler).Methods("GET")
+	router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	router.HandleFunc("/openapi.json", openapiHandler).Methods("GET")
 
 	handler := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "HEAD", "OPTIONS"},
+		AllowedMethods: []string{"GET", "HEAD", "POST", "OPTIONS"},
 		AllowedHeaders: []string{"*"},
-	}).Handler(router)
+	}).Handler(requestDeadline(root))
+
+	var logOut io.Writer = os.Stdout
+	if config().LogFile != "" {
+		rf, err := openRotatingFile(config().LogFile, config().LogMaxSizeMB, config().LogMaxBackups)
+		if err != nil {
+			log.Fatalf("Opening LOG_FILE: %v", err)
+		}
+		logOut = rf
+	}
+	handler = middleware(logOut, handler)
 
-	if err := http.ListenAndServe(":"+config.Port, handler); err != nil {
+	if config().WriteTimeout > 0 && config().RenderBudget >= config().WriteTimeout {
+		log.Printf("WRITE_TIMEOUT_SECONDS (%s) is shorter than RENDER_BUDGET_MS (%s); slow renders will be cut off", config().WriteTimeout, config().RenderBudget)
+	}
+	srv := &http.Server{
+		Addr:              ":" + config().Port,
+		Handler:           handler,
+		ReadTimeout:       config().ReadTimeout,
+		ReadHeaderTimeout: config().ReadHeaderTimeout,
+		WriteTimeout:      config().WriteTimeout,
+		IdleTimeout:       config().IdleTimeout,
+	}
+	srv.SetKeepAlivesEnabled(config().KeepAlive)
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config().MaxConnections > 0 {
+		ln = newLimitListener(ln, config().MaxConnections)
+	}
+	if err := srv.Serve(ln); err != nil {
 		log.Fatal(err)
 	}
 }
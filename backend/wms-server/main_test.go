@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// useConfig loads the config from env as at startup and makes it current
+// for the rest of the test
+func useConfig(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	prev := currentConfig.Load()
+	currentConfig.Store(c)
+	t.Cleanup(func() { currentConfig.Store(prev) })
+	return c
+}
+
+// testEnv is a server over a data directory of empty files, rendering
+// through a fake processor
+type testEnv struct {
+	dataDir string
+	proc    *httptest.Server
+	router  *mux.Router
+
+	mu      sync.Mutex
+	renders []*http.Request // what reached the processor
+}
+
+// newTestEnv indexes files in a new DATA_DIR and points PROCESSOR_URL at
+// proc, or at a processor answering every render with a PNG when nil
+func newTestEnv(t *testing.T, env map[string]string, proc http.HandlerFunc, files ...string) *testEnv {
+	t.Helper()
+	e := &testEnv{dataDir: t.TempDir()}
+	for _, f := range files {
+		p := filepath.Join(e.dataDir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if proc == nil {
+		proc = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(testPNG(t, 4, 4))
+		}
+	}
+	e.proc = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		e.renders = append(e.renders, r)
+		e.mu.Unlock()
+		proc(w, r)
+	}))
+	t.Cleanup(e.proc.Close)
+
+	all := map[string]string{"DATA_DIR": e.dataDir, "PROCESSOR_URL": e.proc.URL}
+	for k, v := range env {
+		all[k] = v
+	}
+	useConfig(t, all)
+
+	prevIndex, prevTiles := layerIndex, tiles
+	layerIndex = NewLayerIndex(e.dataDir)
+	tiles = newTileCache(config().CacheSize)
+	t.Cleanup(func() { layerIndex, tiles = prevIndex, prevTiles })
+
+	e.router = mux.NewRouter()
+	e.router.HandleFunc("/wms", wmsHandler)
+	e.router.HandleFunc("/wms/{dataset:.*}", wmsHandler)
+	return e
+}
+
+// get serves a request for target, e.g. "/wms?REQUEST=GetMap&..."
+func (e *testEnv) get(target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+// renderCount is how many requests reached the processor
+func (e *testEnv) renderCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.renders)
+}
+
+// lastRender is the latest request to reach the processor
+func (e *testEnv) lastRender() *http.Request {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.renders[len(e.renders)-1]
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// serviceExceptionCode is the code of a ServiceExceptionReport body
+func serviceExceptionCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var report struct {
+		Exception struct {
+			Code string `xml:"code,attr"`
+		} `xml:"ServiceException"`
+	}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("response is not a ServiceExceptionReport (%v): %.200s", err, rec.Body.String())
+	}
+	return report.Exception.Code
+}
+
+func TestWMSParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  map[string]string
+	}{
+		{"upper", "SERVICE=WMS&REQUEST=GetMap", map[string]string{"SERVICE": "WMS", "REQUEST": "GetMap"}},
+		{"lower", "service=WMS&request=GetMap", map[string]string{"SERVICE": "WMS", "REQUEST": "GetMap"}},
+		{"mixed", "Service=WMS&ReQuEsT=GetMap&layers=temp_2m", map[string]string{"SERVICE": "WMS", "REQUEST": "GetMap", "LAYERS": "temp_2m"}},
+		{"values keep case", "STYLES=Rainbow", map[string]string{"STYLES": "Rainbow"}},
+		{"duplicate first wins", "TIME=a&TIME=b", map[string]string{"TIME": "a"}},
+		{"duplicate across case", "time=a&TIME=b&Time=c", map[string]string{"TIME": "a"}},
+		{"encoded", "BBOX=0%2C1%2C2%2C3&LAYERS=a%20b", map[string]string{"BBOX": "0,1,2,3", "LAYERS": "a b"}},
+		{"empty value", "STYLES=&LAYERS=x", map[string]string{"STYLES": "", "LAYERS": "x"}},
+		{"empty pairs", "&&LAYERS=x&", map[string]string{"LAYERS": "x"}},
+		{"bad escape skipped", "LAYERS=%zz&LAYERS=ok", map[string]string{"LAYERS": "ok"}},
+		{"empty", "", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := wmsParams(tt.query)
+			got := map[string]string{}
+			for k, vals := range params {
+				if len(vals) != 1 {
+					t.Errorf("wmsParams(%q)[%s] = %q, want a single value", tt.query, k, vals)
+				}
+				got[k] = params.Get(k)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wmsParams(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveMemberMatchesValidTime(t *testing.T) {
+	var files []string
+	for _, run := range []string{"2026101400", "2026101406"} {
+		for _, m := range []string{"c00", "p01"} {
+			for _, fh := range []string{"000", "006", "012"} {
+				files = append(files, "t2m_"+run+"_"+m+"_f"+fh+".nc")
+			}
+		}
+	}
+	newTestEnv(t, map[string]string{
+		"FILENAME_PATTERN": `^(?P<layer>[a-z0-9]+)_(?P<time>\d{10})_(?P<member>[a-z]\d+)_f(?P<fhour>\d{3})\.nc$`,
+	}, nil, files...)
+	li, ok := layerIndex.Layer("t2m")
+	if !ok {
+		t.Fatal("layer t2m not indexed")
+	}
+
+	tests := []struct {
+		name, member, file, time string
+		wantFile                 string
+		wantFiles                []string
+	}{
+		{"control, no time", "", "", "", "t2m_2026101406_c00_f000.nc", nil},
+		{"member at TIME", "p01", "", "2026-10-14T18:00:00Z", "t2m_2026101406_p01_f012.nc", nil},
+		{"member at TIME of older run only", "p01", "", "2026-10-14T00:00:00Z", "t2m_2026101400_p01_f000.nc", nil},
+		{"member at file's valid time", "p01", "t2m_2026101400_c00_f012.nc", "", "t2m_2026101400_p01_f012.nc", nil},
+		{"mean at TIME", "mean", "", "2026-10-14T12:00:00Z", "", []string{"t2m_2026101406_c00_f006.nc", "t2m_2026101406_p01_f006.nc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, file, memberFiles, err := resolveMember(li, tt.member, tt.file, tt.time)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file != tt.wantFile || !reflect.DeepEqual(memberFiles, tt.wantFiles) {
+				t.Errorf("resolveMember = %q, %q; want %q, %q", file, memberFiles, tt.wantFile, tt.wantFiles)
+			}
+		})
+	}
+
+	if _, _, _, err := resolveMember(li, "p01", "", "2026-10-20T00:00:00Z"); err == nil {
+		t.Error("a TIME no member file covers resolved anyway")
+	}
+}
+
+func TestGetMapMaxLayersBoundary(t *testing.T) {
+	e := newTestEnv(t, map[string]string{"MAX_LAYERS_PER_REQUEST": "2"}, nil,
+		"a_2026101400.nc", "b_2026101400.nc", "c_2026101400.nc")
+	getMap := func(layers string) *httptest.ResponseRecorder {
+		return e.get("/wms?SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&STYLES=&CRS=EPSG:4326&BBOX=0,0,10,10&WIDTH=4&HEIGHT=4&FORMAT=image/png&LAYERS=" + layers)
+	}
+
+	if rec := getMap("a,b"); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("2 layers at MAX_LAYERS_PER_REQUEST=2: %d %s, want a PNG: %.200s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	renders := e.renderCount()
+	rec := getMap("a,b,c")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("3 layers at MAX_LAYERS_PER_REQUEST=2: status %d, want 400", rec.Code)
+	}
+	if code := serviceExceptionCode(t, rec); code != "InvalidParameterValue" {
+		t.Errorf("exception code = %q, want InvalidParameterValue", code)
+	}
+	if e.renderCount() != renders {
+		t.Error("a rejected request still reached the processor")
+	}
+}
+
+func TestGetMapForwardsGroundResolution(t *testing.T) {
+	e := newTestEnv(t, nil, nil, "temp_2m_2026101400.nc")
+	tests := []struct {
+		name, version, crs, bbox string
+		want                     string
+	}{
+		// 1.3.0 EPSG:4326 is lat,lon: the width is the longitude span,
+		// in degrees whatever the latitude. Distinct BBOXes so none is a
+		// cache hit.
+		{"equator", "1.3.0", "EPSG:4326", "-10,-20,10,20", "0.1"},
+		{"high latitude", "1.3.0", "EPSG:4326", "70,0,80,40", "0.1"},
+		{"1.1.1 lon,lat", "1.1.1", "EPSG:4326", "0,60,40,70", "0.1"},
+		{"web mercator", "1.3.0", "EPSG:3857", "-20037508.342789244,-20037508.342789244,20037508.342789244,20037508.342789244", "100188"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			renders := e.renderCount()
+			crsParam := "CRS"
+			if tt.version == "1.1.1" {
+				crsParam = "SRS"
+			}
+			rec := e.get("/wms?SERVICE=WMS&REQUEST=GetMap&VERSION=" + tt.version + "&LAYERS=temp_2m&STYLES=&" +
+				crsParam + "=" + tt.crs + "&BBOX=" + tt.bbox + "&WIDTH=400&HEIGHT=200&FORMAT=image/png")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %.200s", rec.Code, rec.Body.String())
+			}
+			if e.renderCount() != renders+1 {
+				t.Fatal("GetMap didn't reach the processor")
+			}
+			if got := e.lastRender().URL.Query().Get("resolution"); got != tt.want {
+				t.Errorf("resolution = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitDataset(t *testing.T) {
+	tests := []struct {
+		dataset, layer, file string
+	}{
+		{"", "", ""},
+		{"temp_2m_2026101400.nc", "", "temp_2m_2026101400.nc"},
+		{"temp_2m/temp_2m_2026101400.nc", "temp_2m", "temp_2m_2026101400.nc"},
+		{"weather/temp_2m/temp_2m_2026101400.nc", "temp_2m", "temp_2m_2026101400.nc"},
+		{"my%20layer/my%20layer_2026101400.nc", "my layer", "my layer_2026101400.nc"},
+		{"t%2Bd/t+d%20%28%C2%B0C%29%25_2026101400.nc", "t+d", "t+d (°C)%_2026101400.nc"},
+		{"..%2E/a.nc", "...", "a.nc"},
+	}
+	for _, tt := range tests {
+		layer, file, err := splitDataset(tt.dataset)
+		if err != nil || layer != tt.layer || file != tt.file {
+			t.Errorf("splitDataset(%q) = %q, %q, %v; want %q, %q", tt.dataset, layer, file, err, tt.layer, tt.file)
+		}
+	}
+
+	for _, dataset := range []string{
+		"temp_2m/..%2F..%2Fetc%2Fpasswd",
+		"temp_2m/..%5Csecret.nc",
+		"%2E%2E/temp_2m_2026101400.nc",
+		"temp_2m/%2E",
+		"temp_2m/a%00.nc",
+		"temp_2m/a%zz.nc",
+		"temp_2m/a%2",
+	} {
+		if layer, file, err := splitDataset(dataset); err == nil {
+			t.Errorf("splitDataset(%q) = %q, %q; want an error", dataset, layer, file)
+		}
+	}
+}
+
+func TestGetMapEncodedDatasetPath(t *testing.T) {
+	e := newTestEnv(t, nil, nil, "my layer_2026101400.nc")
+	rec := e.get("/wms/my%20layer/my%20layer_2026101400.nc?SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&STYLES=&CRS=EPSG:4326&BBOX=0,0,10,10&WIDTH=4&HEIGHT=4&FORMAT=image/png")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %.200s", rec.Code, rec.Body.String())
+	}
+	if got := e.lastRender().URL.Query().Get("file"); got != "my layer_2026101400.nc" {
+		t.Errorf("processor file = %q, want the decoded name", got)
+	}
+
+	// Encoded slashes in a dot segment are redirected by the router's
+	// path cleaning; an encoded backslash reaches splitDataset
+	rec = e.get("/wms/my%20layer/..%5Csecret.nc?SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&STYLES=&CRS=EPSG:4326&BBOX=0,0,10,10&WIDTH=4&HEIGHT=4&FORMAT=image/png")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("encoded traversal: status %d, want 400", rec.Code)
+	}
+}
+
+func TestGetMapLayerNotDefined(t *testing.T) {
+	e := newTestEnv(t, nil, nil, "temp_2m_2026101400.nc")
+	const params = "SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&STYLES=&CRS=EPSG:4326&BBOX=0,0,10,10&WIDTH=4&HEIGHT=4&FORMAT=image/png"
+	tests := []struct {
+		name, target string
+		status       int
+	}{
+		{"no LAYERS", "/wms?" + params, http.StatusBadRequest},
+		{"empty LAYERS", "/wms?LAYERS=&" + params, http.StatusBadRequest},
+		{"file alone in path", "/wms/temp_2m_2026101400.nc?" + params, http.StatusBadRequest},
+		{"unknown LAYERS", "/wms?LAYERS=nosuch&" + params, http.StatusNotFound},
+		{"unknown composite member", "/wms?LAYERS=temp_2m,nosuch&" + params, http.StatusNotFound},
+		{"unknown layer in path", "/wms/nosuch/nosuch_2026101400.nc?" + params, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := e.get(tt.target)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if code := serviceExceptionCode(t, rec); code != "LayerNotDefined" {
+				t.Errorf("exception code = %q, want LayerNotDefined", code)
+			}
+		})
+	}
+	if n := e.renderCount(); n != 0 {
+		t.Errorf("%d requests without a known layer reached the processor", n)
+	}
+}
+
+func TestGetMapTimeToleranceBoundary(t *testing.T) {
+	// The run's timesteps are 3-hourly from 06Z
+	e := newTestEnv(t, map[string]string{"TIME_TOLERANCE": "1h"}, nil, "temp_2m_2026101406.nc")
+	tests := []struct {
+		time        string
+		substituted string // "" for the TIME itself
+		miss        bool
+	}{
+		{"2026-10-14T06:00:00Z", "", false},
+		{"2026-10-14T05:00:00Z", "2026-10-14T06:00:00Z", false},
+		{"2026-10-14T07:00:00Z", "2026-10-14T06:00:00Z", false},
+		{"2026-10-14T08:00:00Z", "2026-10-14T09:00:00Z", false},
+		{"2026-10-14T04:59:59Z", "", true},
+		{"2026-10-14T07:00:01Z", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.time, func(t *testing.T) {
+			rec := e.get("/wms?SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&LAYERS=temp_2m&STYLES=&CRS=EPSG:4326&BBOX=0,0,10,10&WIDTH=4&HEIGHT=4&FORMAT=image/png&TIME=" + tt.time)
+			if tt.miss {
+				if rec.Code != http.StatusBadRequest {
+					t.Errorf("status = %d, want 400", rec.Code)
+				}
+				if code := serviceExceptionCode(t, rec); code != "InvalidDimensionValue" {
+					t.Errorf("exception code = %q, want InvalidDimensionValue", code)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %.200s", rec.Code, rec.Body.String())
+			}
+			if got := rec.Header().Get("X-Time-Substituted"); got != tt.substituted {
+				t.Errorf("X-Time-Substituted = %q, want %q", got, tt.substituted)
+			}
+		})
+	}
+}
+
+func TestParseBBoxValues(t *testing.T) {
+	tests := []struct {
+		bbox string
+		want [4]float64
+	}{
+		{"-10,-20,10,20", [4]float64{-10, -20, 10, 20}},
+		{" -1.2e2 , 3.4,\t5 ,6 ", [4]float64{-120, 3.4, 5, 6}},
+		{"1e1,-1.5E+01,2.5e-1,+7", [4]float64{10, -15, 0.25, 7}},
+		{"-2.0037508342789244E7,0,2.0037508342789244e+07,1E0", [4]float64{-20037508.342789244, 0, 20037508.342789244, 1}},
+		{".5,-.5,5.,0", [4]float64{0.5, -0.5, 5, 0}},
+	}
+	for _, tt := range tests {
+		got, err := parseBBoxValues(tt.bbox)
+		if err != nil || got != tt.want {
+			t.Errorf("parseBBoxValues(%q) = %v, %v; want %v", tt.bbox, got, err, tt.want)
+		}
+	}
+
+	errs := []struct {
+		bbox, mention string
+	}{
+		{"0,0,10", "expected minx,miny,maxx,maxy"},
+		{"0,0,10,10,5", "expected minx,miny,maxx,maxy"},
+		{"x,0,10,10", "minx"},
+		{"0,,10,10", "miny"},
+		{"0,0,1e,10", "maxx"},
+		{"0,0,10,NaN", "maxy"},
+		{"Inf,0,10,10", "minx"},
+		{"0,-Infinity,10,10", "miny"},
+		{"0,0,1 0,10", "maxx"},
+	}
+	for _, tt := range errs {
+		_, err := parseBBoxValues(tt.bbox)
+		if err == nil || !strings.Contains(err.Error(), tt.mention) {
+			t.Errorf("parseBBoxValues(%q) error = %v, want one mentioning %s", tt.bbox, err, tt.mention)
+		}
+	}
+}
+
+func TestGetMapServerTimingPhases(t *testing.T) {
+	const params = "SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&STYLES=&CRS=EPSG:4326&BBOX=0,0,10,10&WIDTH=4&HEIGHT=4&FORMAT=image/png"
+	tests := []struct {
+		name    string
+		env     map[string]string
+		layers  string
+		want    []string // on the miss; the hit only looks up
+		missing []string // on the hit
+	}{
+		{"single layer", nil, "a", []string{"cache-lookup", "processor-fetch"}, []string{"processor-fetch"}},
+		{"buffered under the threshold", map[string]string{"BUFFER_THRESHOLD_BYTES": "1000000"}, "a", []string{"cache-lookup", "processor-fetch"}, []string{"processor-fetch"}},
+		{"composite", nil, "a,b", []string{"cache-lookup", "processor-fetch", "composite"}, []string{"processor-fetch"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"DEBUG": "true"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			e := newTestEnv(t, env, nil, "a_2026101400.nc", "b_2026101400.nc")
+			for _, round := range []struct {
+				name            string
+				present, absent []string
+			}{{"miss", tt.want, nil}, {"hit", []string{"cache-lookup"}, tt.missing}} {
+				rec := e.get("/wms?LAYERS=" + tt.layers + "&" + params)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: status %d: %.200s", round.name, rec.Code, rec.Body.String())
+				}
+				header := rec.Header().Get("Server-Timing")
+				for _, phase := range round.present {
+					if !strings.Contains(header, phase+";dur=") {
+						t.Errorf("%s: Server-Timing %q lacks %s", round.name, header, phase)
+					}
+				}
+				for _, phase := range round.absent {
+					if strings.Contains(header, phase+";dur=") {
+						t.Errorf("%s: Server-Timing %q has %s", round.name, header, phase)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Mask polygons: a layer's maskPolygon is the true domain of a regional
+// product, as GeoJSON in lon/lat (a Polygon, MultiPolygon, Feature or
+// FeatureCollection), inline or as a path relative to LAYER_CONFIG. A
+// processor whose info reports maskPolygon is sent it as the maskpolygon
+// param; for any other, pixels outside it are made transparent here.
+
+// maskPolygon holds polygons of rings, outer ring first, of lon/lat points
+type maskPolygon [][][][2]float64
+
+// geoJSONObject is the part of a GeoJSON object a mask is read from
+type geoJSONObject struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSONObject  `json:"geometry"`
+	Features    []geoJSONObject `json:"features"`
+}
+
+// parseMaskPolygon reads a layer's maskPolygon setting: inline GeoJSON, or
+// a string naming a GeoJSON file relative to dir
+func parseMaskPolygon(raw json.RawMessage, dir string) (maskPolygon, error) {
+	data := []byte(raw)
+	var path string
+	if json.Unmarshal(raw, &path) == nil {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	var obj geoJSONObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %v", err)
+	}
+	var m maskPolygon
+	if err := m.add(obj); err != nil {
+		return nil, err
+	}
+	if len(m) == 0 {
+		return nil, fmt.Errorf("GeoJSON has no polygons")
+	}
+	for i, poly := range m {
+		for j, ring := range poly {
+			if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+				return nil, fmt.Errorf("polygon %d ring %d must be closed with at least 4 positions", i, j)
+			}
+			for _, p := range ring {
+				if math.Abs(p[0]) > 180 || math.Abs(p[1]) > 90 {
+					return nil, fmt.Errorf("polygon %d ring %d has position %g,%g outside lon/lat range", i, j, p[0], p[1])
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// add appends the polygons of a GeoJSON object
+func (m *maskPolygon) add(obj geoJSONObject) error {
+	switch obj.Type {
+	case "Polygon":
+		var poly [][][2]float64
+		if err := json.Unmarshal(obj.Coordinates, &poly); err != nil {
+			return fmt.Errorf("invalid Polygon coordinates: %v", err)
+		}
+		*m = append(*m, poly)
+	case "MultiPolygon":
+		var polys [][][][2]float64
+		if err := json.Unmarshal(obj.Coordinates, &polys); err != nil {
+			return fmt.Errorf("invalid MultiPolygon coordinates: %v", err)
+		}
+		*m = append(*m, polys...)
+	case "Feature":
+		if obj.Geometry == nil {
+			return fmt.Errorf("Feature has no geometry")
+		}
+		return m.add(*obj.Geometry)
+	case "FeatureCollection":
+		for _, f := range obj.Features {
+			if err := m.add(f); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("GeoJSON type %q, expected Polygon, MultiPolygon, Feature or FeatureCollection", obj.Type)
+	}
+	return nil
+}
+
+// geoJSON is the mask as a compact MultiPolygon geometry
+func (m maskPolygon) geoJSON() string {
+	coords, _ := json.Marshal([][][][2]float64(m))
+	return `{"type":"MultiPolygon","coordinates":` + string(coords) + `}`
+}
+
+// raster marks the pixels of a width x height lon/lat bbox whose centres
+// fall inside the mask. Each row is scan-filled per polygon by the
+// even-odd rule, so holes stay out and polygons add up.
+func (m maskPolygon) raster(bb [4]float64, width, height int) []bool {
+	inside := make([]bool, width*height)
+	dx, dy := (bb[2]-bb[0])/float64(width), (bb[3]-bb[1])/float64(height)
+	var xs []float64
+	for j := 0; j < height; j++ {
+		lat := bb[3] - (float64(j)+0.5)*dy
+		row := inside[j*width : (j+1)*width]
+		for _, poly := range m {
+			xs = xs[:0]
+			for _, ring := range poly {
+				for k := 1; k < len(ring); k++ {
+					a, b := ring[k-1], ring[k]
+					if (a[1] > lat) != (b[1] > lat) {
+						xs = append(xs, a[0]+(lat-a[1])*(b[0]-a[0])/(b[1]-a[1]))
+					}
+				}
+			}
+			sort.Float64s(xs)
+			for k := 0; k+1 < len(xs); k += 2 {
+				from := int(math.Max(0, math.Ceil((xs[k]-bb[0])/dx-0.5)))
+				to := int(math.Min(float64(width), math.Ceil((xs[k+1]-bb[0])/dx-0.5)))
+				for i := from; i < to; i++ {
+					row[i] = true
+				}
+			}
+		}
+	}
+	return inside
+}
+
+// serverClip is the layer's mask when the server has to apply it
+func (lc layerConfig) serverClip() maskPolygon {
+	if lc.mask == nil || procInfo().MaskPolygon {
+		return nil
+	}
+	return lc.mask
+}
+
+// clipToMask makes the pixels of a render outside the mask transparent.
+// Only PNG renders of a lon/lat bbox are clipped: other formats have no
+// alpha to clear, and projected bboxes aren't rasterized here. A render
+// left with nothing inside is flagged no-data.
+func clipToMask(entry cacheEntry, m maskPolygon, v url.Values) (cacheEntry, error) {
+	bb, ok := parseBBox(v.Get("bbox"))
+	if f := v.Get("format"); !ok || v.Get("crs") != "" || (f != "" && !strings.EqualFold(f, "image/png")) {
+		return entry, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(entry.Body))
+	if err != nil {
+		return entry, fmt.Errorf("clipping to mask: %v", err)
+	}
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+	kept := false
+	for i, in := range m.raster(bb, b.Dx(), b.Dy()) {
+		if in {
+			kept = kept || out.Pix[i*4+3] != 0
+		} else {
+			out.Pix[i*4+3] = 0
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out); err != nil {
+		return entry, fmt.Errorf("clipping to mask: %v", err)
+	}
+	return cacheEntry{ContentType: "image/png", Body: buf.Bytes(), NoData: entry.NoData || !kept, RenderTime: entry.RenderTime}, nil
+}
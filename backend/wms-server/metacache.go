@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// metaCache memoizes parsed sidecars per layer. Every lookup stats the
+// candidate files and reparses only those whose mtime or size changed, so
+// a rewritten sidecar is picked up without a restart while unchanged ones
+// cost a stat. Each lookup replaces the layer's entries, dropping files
+// that are gone or from an older run.
+type metaCache struct {
+	mu     sync.RWMutex
+	layers map[string]map[string]metaEntry // layer, sidecar path
+}
+
+type metaEntry struct {
+	modTime time.Time
+	size    int64
+	meta    sidecarDataset
+	err     error
+}
+
+var sidecars = &metaCache{layers: map[string]map[string]metaEntry{}}
+
+// lookup returns the layer's parsed sidecars among paths, in order. A
+// corrupt sidecar is logged once per version and skipped.
+func (c *metaCache) lookup(layer string, paths []string) []sidecarDataset {
+	c.mu.RLock()
+	prev := c.layers[layer]
+	c.mu.RUnlock()
+
+	next := make(map[string]metaEntry, len(paths))
+	changed := false
+	var out []sidecarDataset
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			_, had := prev[p]
+			changed = changed || had
+			continue
+		}
+		e, ok := prev[p]
+		if !ok || !e.modTime.Equal(fi.ModTime()) || e.size != fi.Size() {
+			e = metaEntry{modTime: fi.ModTime(), size: fi.Size()}
+			e.meta, e.err = loadSidecar(p)
+			if e.err != nil && !errors.Is(e.err, fs.ErrNotExist) {
+				log.Printf("Ignoring sidecar %s: %v", p, e.err)
+			}
+			changed = true
+		}
+		next[p] = e
+		if e.err == nil {
+			out = append(out, e.meta)
+		}
+	}
+	if changed || len(next) != len(prev) {
+		c.mu.Lock()
+		c.layers[layer] = next
+		c.mu.Unlock()
+	}
+	return out
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ncWMS color scale params GetMap forwards so ncWMS clients work unchanged.
+// COLORSCALERANGE is handled with the other render params; these are:
+//
+//	NUMCOLORBANDS  1..256 discrete bands (palettes have 256 entries)
+//	ABOVEMAXCOLOR  out-of-range color: extend, transparent, 0xRRGGBB,
+//	BELOWMINCOLOR  0xAARRGGBB or #rrggbb
+//	LOGSCALE       true or false
+const maxColorBands = 256
+
+// ncwmsParams validates the ncWMS color scale params in q, returning them
+// as processor params. Colors are normalized to lowercase 0x form and
+// LOGSCALE=false is dropped, so equivalent requests share cache entries.
+func ncwmsParams(q url.Values) (url.Values, error) {
+	v := url.Values{}
+	if s := q.Get("NUMCOLORBANDS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxColorBands {
+			return nil, fmt.Errorf("invalid NUMCOLORBANDS %q, expected 1 to %d", s, maxColorBands)
+		}
+		v.Set("numcolorbands", strconv.Itoa(n))
+	}
+	for _, p := range []string{"ABOVEMAXCOLOR", "BELOWMINCOLOR"} {
+		if s := q.Get(p); s != "" {
+			c, err := parseScaleColor(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q, expected extend, transparent, 0xRRGGBB, 0xAARRGGBB or #rrggbb", p, s)
+			}
+			v.Set(strings.ToLower(p), c)
+		}
+	}
+	if s := q.Get("LOGSCALE"); s != "" {
+		logScale, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LOGSCALE %q, expected true or false", s)
+		}
+		if logScale {
+			v.Set("logscale", "true")
+		}
+	}
+	return v, nil
+}
+
+// checkLogScale rejects LOGSCALE=true when the color scale range it would
+// map, COLORSCALERANGE or else each layer's sidecar default, doesn't start
+// above zero. A range that can't be parsed is left to the processor.
+func checkLogScale(v url.Values, layers []string) error {
+	if v.Get("logscale") != "true" {
+		return nil
+	}
+	if s := v.Get("colorscalerange"); s != "" {
+		if r, ok := parseRange(s); ok && r[0] <= 0 {
+			return fmt.Errorf("LOGSCALE needs a COLORSCALERANGE minimum above zero, got %s", s)
+		}
+		return nil
+	}
+	for _, l := range layers {
+		meta, _ := readSidecar(l)
+		if r := meta.ColorScale.Range; len(r) == 2 && r[0] <= 0 {
+			return fmt.Errorf("LOGSCALE needs a COLORSCALERANGE minimum above zero; layer %s defaults to %g,%g", l, r[0], r[1])
+		}
+	}
+	return nil
+}
+
+// parseRange parses "min,max"
+func parseRange(s string) ([2]float64, bool) {
+	lo, hi, ok := strings.Cut(s, ",")
+	if !ok {
+		return [2]float64{}, false
+	}
+	var r [2]float64
+	var err1, err2 error
+	r[0], err1 = strconv.ParseFloat(strings.TrimSpace(lo), 64)
+	r[1], err2 = strconv.ParseFloat(strings.TrimSpace(hi), 64)
+	return r, err1 == nil && err2 == nil
+}
+
+// parseScaleColor normalizes an ncWMS out-of-range color
+func parseScaleColor(s string) (string, error) {
+	switch lower := strings.ToLower(s); lower {
+	case "extend", "transparent":
+		return lower, nil
+	}
+	hex := strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(hex, "0x"):
+		hex = hex[2:]
+	case strings.HasPrefix(hex, "#"):
+		hex = hex[1:]
+		if len(hex) != 6 {
+			return "", fmt.Errorf("expected #rrggbb")
+		}
+	default:
+		return "", fmt.Errorf("unknown color")
+	}
+	if len(hex) != 6 && len(hex) != 8 {
+		return "", fmt.Errorf("expected 6 or 8 hex digits")
+	}
+	if _, err := strconv.ParseUint(hex, 16, 32); err != nil {
+		return "", err
+	}
+	return "0x" + hex, nil
+}
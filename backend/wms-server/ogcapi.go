@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OGC API - Maps: a JSON/REST face over the same layers and render path
+// as WMS. Only collection listing and the collection map resource so far.
+const (
+	ogcMapRel   = "http://www.opengis.net/def/rel/ogc/1.0/map"
+	ogcCRS84    = "http://www.opengis.net/def/crs/OGC/1.3/CRS84"
+	ogcEPSG3857 = "http://www.opengis.net/def/crs/EPSG/0/3857"
+)
+
+type ogcLink struct {
+	Href  string `json:"href"`
+	Rel   string `json:"rel"`
+	Type  string `json:"type,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+type ogcCollection struct {
+	ID     string    `json:"id"`
+	Title  string    `json:"title"`
+	Extent ogcExtent `json:"extent"`
+	Links  []ogcLink `json:"links"`
+}
+
+type ogcExtent struct {
+	Spatial struct {
+		BBox [][4]float64 `json:"bbox"`
+		CRS  string       `json:"crs"`
+	} `json:"spatial"`
+	Temporal *struct {
+		Interval [][2]string `json:"interval"`
+	} `json:"temporal,omitempty"`
+}
+
+// ogcBaseURL is the absolute URL the API is served under
+func ogcBaseURL(r *http.Request) string {
+	return strings.TrimSuffix(serviceURL(r), "/wms")
+}
+
+// collectionsHandler lists every layer as a collection: /collections
+func collectionsHandler(w http.ResponseWriter, r *http.Request) {
+	base := ogcBaseURL(r)
+	layers := layerIndex.Layers()
+	cols := make([]ogcCollection, 0, len(layers))
+	for _, l := range layers {
+		c := ogcCollection{ID: l.Name, Title: l.Name}
+		ext, _ := layerExtent(l.Name)
+		c.Extent.Spatial.BBox = [][4]float64{ext}
+		c.Extent.Spatial.CRS = ogcCRS84
+		if steps := l.timeSteps(); len(steps) > 0 {
+			c.Extent.Temporal = &struct {
+				Interval [][2]string `json:"interval"`
+			}{[][2]string{{steps[0].Time.Format(time.RFC3339), steps[len(steps)-1].Time.Format(time.RFC3339)}}}
+		}
+		c.Links = []ogcLink{{
+			Href:  base + "/collections/" + url.PathEscape(l.Name) + "/map",
+			Rel:   ogcMapRel,
+			Type:  "image/png",
+			Title: "Map of " + l.Name,
+		}}
+		cols = append(cols, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"links":       []ogcLink{{Href: base + "/collections", Rel: "self", Type: "application/json"}},
+		"collections": cols,
+	})
+}
+
+// collectionMapHandler renders a collection:
+// /collections/{layer}/map?bbox=&bbox-crs=&datetime=&width=&height=
+// bbox defaults to the layer extent and is CRS84 unless bbox-crs names
+// EPSG:3857; datetime is a single RFC3339 instant.
+func collectionMapHandler(w http.ResponseWriter, r *http.Request) {
+	layer := mux.Vars(r)["layer"]
+	qs := r.URL.Query()
+	if _, ok := layerIndex.Layer(layer); !ok {
+		writeJSONException(w, http.StatusNotFound, "LayerNotDefined", fmt.Sprintf("no collection %q", layer))
+		return
+	}
+
+	width, height := defaultImageSize(layer)
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"width", &width}, {"height", &height}} {
+		if s := qs.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				writeJSONException(w, http.StatusBadRequest, "InvalidParameterValue", fmt.Sprintf("invalid %s %q", p.name, s))
+				return
+			}
+			*p.dst = n
+		}
+	}
+	if (config().MaxWidth > 0 && width > config().MaxWidth) || (config().MaxHeight > 0 && height > config().MaxHeight) {
+		writeJSONException(w, http.StatusBadRequest, "InvalidParameterValue",
+			fmt.Sprintf("map size %dx%d exceeds MaxWidth/MaxHeight", width, height))
+		return
+	}
+
+	crs := "EPSG:4326"
+	switch c := qs.Get("bbox-crs"); c {
+	case "", ogcCRS84:
+	case ogcEPSG3857:
+		crs = "EPSG:3857"
+	default:
+		writeJSONException(w, http.StatusBadRequest, "InvalidCRS",
+			fmt.Sprintf("unsupported bbox-crs %q, expected %s or %s", c, ogcCRS84, ogcEPSG3857))
+		return
+	}
+	bb, _ := layerExtent(layer)
+	// Resolution in bbox-crs units, as GetMap computes it, so equivalent
+	// requests share cache entries
+	resolution := groundResolution(bb, width)
+	if s := qs.Get("bbox"); s != "" {
+		var ok bool
+		if bb, ok = parseBBox(s); !ok {
+			writeJSONException(w, http.StatusBadRequest, "InvalidParameterValue", "bbox must be minx,miny,maxx,maxy")
+			return
+		}
+		resolution = groundResolution(bb, width)
+		// CRS84 is already lon,lat so no axis swap applies
+		if crs == "EPSG:3857" {
+			bb[0], bb[1], bb[2], bb[3] = bboxToLonLat(bb, crs)
+		}
+	}
+
+	timing := newServerTiming()
+	v := url.Values{}
+	v.Set("layer", layer)
+	v.Set("width", strconv.Itoa(width))
+	v.Set("height", strconv.Itoa(height))
+	v.Set("bbox", fmt.Sprintf("%f,%f,%f,%f", bb[0], bb[1], bb[2], bb[3]))
+	v.Set("resolution", resolution)
+	if dt := qs.Get("datetime"); dt != "" {
+		if _, err := time.Parse(time.RFC3339, dt); err != nil {
+			writeJSONException(w, http.StatusBadRequest, "InvalidDimensionValue", "datetime must be an RFC3339 instant")
+			return
+		}
+		v.Set("time", dt)
+	}
+	timing.phase("param-parse")
+
+	q := url.Values{"EXCEPTIONS": {"JSON"}}
+	entry, ok := renderCached(w, r, q, v, width, height, timing)
+	if !ok {
+		return
+	}
+	w.Header().Set("Server-Timing", timing.header())
+	w.Header().Set("Content-Crs", "<"+ogcCRS84+">")
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("ETag", entryETag(entry))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(entry.Body))
+}
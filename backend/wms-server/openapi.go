@@ -0,0 +1,26 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+)
+
+// openapiSpec describes the non-WMS endpoints; keep it in step with the
+// handlers when adding or changing one
+//
+//go:embed static/openapi.json
+var openapiSpec []byte
+
+// openapiHandler serves the spec with servers pointing at this instance,
+// so generated clients work behind BASE_PATH or a proxy prefix
+func openapiHandler(w http.ResponseWriter, r *http.Request) {
+	var spec map[string]interface{}
+	if err := json.Unmarshal(openapiSpec, &spec); err != nil {
+		writeJSONException(w, http.StatusInternalServerError, "NoApplicableCode", "invalid embedded OpenAPI spec")
+		return
+	}
+	spec["servers"] = []map[string]string{{"url": publicPath(r) + "/"}}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(spec)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// previewPage is a standalone Leaflet map over our XYZ tiles with a time
+// slider; Leaflet comes from the CDN so nothing is built server-side
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Layer}} - preview</title>
+<link rel="stylesheet" href="https://unpkg.com/leaflet@1.9.4/dist/leaflet.css">
+<script src="https://unpkg.com/leaflet@1.9.4/dist/leaflet.js"></script>
+<style>
+  html, body { margin: 0; height: 100%; font-family: sans-serif; }
+  #map { position: absolute; top: 0; bottom: 48px; width: 100%; }
+  #controls { position: absolute; bottom: 0; height: 48px; width: 100%; display: flex; align-items: center; gap: 12px; padding: 0 12px; box-sizing: border-box; }
+  #time { flex: 1; }
+</style>
+</head>
+<body>
+<div id="map"></div>
+<div id="controls">
+  <strong>{{.Layer}}</strong>
+  <input id="time" type="range" min="0" max="{{.Last}}" value="{{.Default}}">
+  <span id="label"></span>
+</div>
+<script>
+  var times = {{.Times}};
+  var base = {{.TileBase}};
+  var map = L.map("map").setView([20, 0], 2);
+  L.tileLayer("https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png", {
+    attribution: "&copy; OpenStreetMap contributors"
+  }).addTo(map);
+  var slider = document.getElementById("time");
+  var label = document.getElementById("label");
+  function tileURL() {
+    var t = times.length ? times[slider.value] : "latest";
+    label.textContent = t;
+    return base + "/" + encodeURIComponent(t) + "/{z}/{x}/{y}.png";
+  }
+  var data = L.tileLayer(tileURL(), { opacity: 0.7 }).addTo(map);
+  slider.addEventListener("input", function () { data.setUrl(tileURL()); });
+</script>
+</body>
+</html>
+`))
+
+// previewHandler serves a quick-look map for one layer (ENABLE_INDEX)
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	if !config().EnableIndex {
+		http.NotFound(w, r)
+		return
+	}
+	layer := mux.Vars(r)["layer"]
+	li, ok := layerIndex.Layer(layer)
+	if !ok {
+		http.Error(w, "unknown layer", http.StatusNotFound)
+		return
+	}
+
+	steps := li.timeSteps()
+	times := make([]string, len(steps))
+	def := 0
+	now := time.Now()
+	for i, s := range steps {
+		times[i] = s.Time.Format(time.RFC3339)
+		if absDuration(s.Time.Sub(now)) < absDuration(steps[def].Time.Sub(now)) {
+			def = i
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	previewPage.Execute(w, map[string]interface{}{
+		"Layer":    layer,
+		"Times":    times,
+		"Last":     len(times) - 1,
+		"Default":  def,
+		"TileBase": publicPath(r) + "/wmts/" + url.PathEscape(layer),
+	})
+}
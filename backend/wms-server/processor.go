@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// processorQuery encodes v for the processor, renaming params per
+// PROCESSOR_PARAM_NAMES. Everything upstream (cache keys included) keeps
+// the canonical names.
+func processorQuery(v url.Values) string {
+	return renameParams(v, config().ProcessorParams)
+}
+
+// renameParams encodes v with the params in names renamed
+func renameParams(v url.Values, names map[string]string) string {
+	if len(names) == 0 {
+		return v.Encode()
+	}
+	out := make(url.Values, len(v))
+	for k, vals := range v {
+		if name, ok := names[k]; ok {
+			k = name
+		}
+		out[k] = vals
+	}
+	return out.Encode()
+}
+
+// processorDo sends a request to the processor, authenticating per
+// PROCESSOR_AUTH_*: basic credentials, or a token in PROCESSOR_AUTH_HEADER
+// (Authorization carries it as a bearer token). The context deadline, if
+// any, is passed along as X-Timeout-Ms, and the trace as traceparent.
+func processorDo(req *http.Request) (*http.Response, error) {
+	switch {
+	case config().ProcessorAuthUser != "":
+		req.SetBasicAuth(config().ProcessorAuthUser, config().ProcessorAuthPassword)
+	case config().ProcessorAuthToken != "":
+		token := config().ProcessorAuthToken
+		if strings.EqualFold(config().ProcessorAuthHeader, "Authorization") {
+			token = "Bearer " + token
+		}
+		req.Header.Set(config().ProcessorAuthHeader, token)
+	}
+	// Let the processor give up when nobody will wait for the answer
+	if deadline, ok := req.Context().Deadline(); ok {
+		req.Header.Set("X-Timeout-Ms", strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10))
+	}
+	sp := traceProcessorCall(req)
+	resp, err := http.DefaultClient.Do(req)
+	endProcessorCall(sp, resp, err)
+	return resp, err
+}
+
+// errMaintenance is returned for cache misses in maintenance mode
+var errMaintenance = errors.New("server is in maintenance mode; only cached tiles are available")
+
+// errRenderBudget is returned when a render misses RENDER_BUDGET_MS and the
+// degradation strategy can't produce a substitute
+var errRenderBudget = errors.New("render exceeded the response time budget")
+
+// fetchRender requests an image from the processor's render endpoint and
+// buffers it
+func fetchRender(ctx context.Context, v url.Values) (cacheEntry, error) {
+	if v.Get("gutter") != "" {
+		return fetchGuttered(ctx, v)
+	}
+	resp, contentType, body, err := openRender(ctx, v)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return cacheEntry{}, fmt.Errorf("render backend error: %w", err)
+	}
+	return cacheEntry{
+		ContentType: contentType,
+		Body:        data,
+		NoData:      strings.EqualFold(resp.Header.Get("X-No-Data"), "true"),
+		RenderTime:  processorRenderTime(resp.Header),
+	}, nil
+}
+
+// processorRenderTime reads the processor's own render duration from
+// X-Render-Time, in milliseconds or as a Go duration; zero when absent or
+// unparseable
+func processorRenderTime(h http.Header) time.Duration {
+	s := strings.TrimSpace(h.Get("X-Render-Time"))
+	if s == "" {
+		return 0
+	}
+	if ms, err := strconv.ParseFloat(s, 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return d
+	}
+	return 0
+}
+
+// openRender starts a processor render and checks that an image is coming
+// back. The returned reader yields the body; the caller closes resp.Body.
+func openRender(ctx context.Context, v url.Values) (*http.Response, string, *bufio.Reader, error) {
+	path, err := renderPath(v)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, renderURL(ctx)+path, nil)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	resp, err := processorDo(req)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("render backend error: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg := processorErrorMessage(resp.Body)
+		log.Printf("Processor render failed (%s): %s", resp.Status, msg)
+		return nil, "", nil, fmt.Errorf("render backend error: %s", msg)
+	}
+
+	// Never label an HTML/JSON error page as an image
+	contentType, body := sniffImage(resp)
+	if contentType == "" {
+		defer resp.Body.Close()
+		msg := processorErrorMessage(body)
+		log.Printf("Processor returned non-image content (%s): %s", resp.Header.Get("Content-Type"), msg)
+		return nil, "", nil, fmt.Errorf("render backend returned non-image content: %s", msg)
+	}
+	return resp, contentType, body, nil
+}
+
+// renderWithBudget renders within RENDER_BUDGET_MS, degrading per
+// RENDER_DEGRADE when the processor is too slow. The returned strategy is
+// non-empty when a degraded result was produced.
+func renderWithBudget(ctx context.Context, v url.Values, width, height int) (cacheEntry, string, error) {
+	if config().RenderBudget <= 0 {
+		e, err := fetchRender(ctx, v)
+		return e, "", err
+	}
+
+	bctx, cancel := context.WithTimeout(ctx, config().RenderBudget)
+	e, err := fetchRender(bctx, v)
+	cancel()
+	if err == nil || ctx.Err() != nil || !errors.Is(bctx.Err(), context.DeadlineExceeded) {
+		return e, "", err
+	}
+
+	log.Printf("Render of %s exceeded %s budget, degrading via %s", v.Get("layer"), config().RenderBudget, config().RenderDegrade)
+	switch config().RenderDegrade {
+	case "retry-lowres":
+		// Half resolution, then upscale to the requested size
+		low := url.Values{}
+		for k, vals := range v {
+			low[k] = vals
+		}
+		low.Set("width", strconv.Itoa(max(width/2, 1)))
+		low.Set("height", strconv.Itoa(max(height/2, 1)))
+		lctx, cancel := context.WithTimeout(ctx, config().RenderBudget)
+		defer cancel()
+		if e, err := fetchRender(lctx, low); err == nil {
+			if up, err := upscaleEntry(e, width, height); err == nil {
+				return up, "retry-lowres", nil
+			}
+		}
+		log.Printf("Low-resolution retry for %s failed", v.Get("layer"))
+	case "serve-stale":
+		if e, ok := tiles.Get(staleCacheKey(v)); ok {
+			e.RenderTime = 0
+			return e, "serve-stale", nil
+		}
+		log.Printf("No stale tile cached for %s", v.Get("layer"))
+	}
+	return cacheEntry{}, "", errRenderBudget
+}
+
+// staleCacheKey identifies the same view regardless of time/file, so the
+// most recent render of a neighbouring timestep can stand in for a slow one
+func staleCacheKey(v url.Values) string {
+	s := url.Values{}
+	for k, vals := range v {
+		if k != "time" && k != "file" {
+			s[k] = vals
+		}
+	}
+	return staleKeyPrefix + s.Encode()
+}
+
+// putStale keeps a render as its view's stale copy, when serve-stale may
+// need one
+func putStale(v url.Values, entry cacheEntry) {
+	if config().RenderDegrade == "serve-stale" {
+		tiles.Put(staleCacheKey(v), entry)
+	}
+}
+
+// Max bytes of a processor error body kept for logging and exceptions
+const maxProcessorErrorBody = 4096
+
+// sniffImage peeks at the processor response and returns the image content
+// type, or "" when the body isn't an image (e.g. an HTML error page sent
+// with status 200). The returned reader still yields the full body.
+func sniffImage(resp *http.Response) (string, *bufio.Reader) {
+	br := bufio.NewReaderSize(resp.Body, 512)
+	head, _ := br.Peek(512)
+	sniffed := http.DetectContentType(head)
+	// DetectContentType doesn't know TIFF, which GeoTIFF renders are
+	if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		sniffed = "image/tiff"
+	}
+	declared := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(sniffed, "image/") {
+		return "", br
+	}
+	if declared != "" && !strings.HasPrefix(declared, "image/") {
+		return "", br
+	}
+	return sniffed, br
+}
+
+var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+
+// processorErrorMessage extracts a readable message from a processor error
+// body: the JSON "error"/"message" field, or the text of an HTML page
+func processorErrorMessage(r io.Reader) string {
+	body, _ := io.ReadAll(io.LimitReader(r, maxProcessorErrorBody))
+
+	var j struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &j) == nil && (j.Error != "" || j.Message != "") {
+		if j.Error != "" && j.Message != "" {
+			return j.Error + ": " + j.Message
+		}
+		return j.Error + j.Message
+	}
+
+	text := strings.Join(strings.Fields(htmlTagRe.ReplaceAllString(string(body), " ")), " ")
+	if len(text) > 200 {
+		text = text[:200] + "..."
+	}
+	if text == "" {
+		text = "empty response"
+	}
+	return text
+}
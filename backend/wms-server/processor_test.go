@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const htmlErrorPage = "<!DOCTYPE html><html><body><h1>Internal Server Error</h1><p>worker crashed</p></body></html>"
+
+func serveHTML(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(htmlErrorPage))
+}
+
+func TestOpenRenderRejectsHTML(t *testing.T) {
+	newTestEnv(t, nil, serveHTML)
+	resp, contentType, _, err := openRender(context.Background(), url.Values{"layer": {"temp_2m"}})
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("openRender accepted a 200 HTML page as %q", contentType)
+	}
+	if !strings.Contains(err.Error(), "non-image") || !strings.Contains(err.Error(), "worker crashed") {
+		t.Errorf("error %q should say the content isn't an image and quote the page", err)
+	}
+}
+
+func TestSniffImage(t *testing.T) {
+	png := string(testPNG(t, 1, 1))
+	tests := []struct {
+		name, declared, body, want string
+	}{
+		{"png", "image/png", png, "image/png"},
+		{"png undeclared", "", png, "image/png"},
+		{"html declared as html", "text/html", htmlErrorPage, ""},
+		{"html declared as png", "image/png", htmlErrorPage, ""},
+		{"png declared as json", "application/json", png, ""},
+		{"tiff", "image/tiff", "II*\x00rest", "image/tiff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(strings.NewReader(tt.body))}
+			if tt.declared != "" {
+				resp.Header.Set("Content-Type", tt.declared)
+			}
+			if got, _ := sniffImage(resp); got != tt.want {
+				t.Errorf("sniffImage = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetMapHTMLFromProcessorIsServiceException(t *testing.T) {
+	e := newTestEnv(t, nil, serveHTML, "temp_2m_2026101400.nc")
+	rec := e.get("/wms?SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&LAYERS=temp_2m&STYLES=&CRS=EPSG:4326&BBOX=0,0,10,10&WIDTH=16&HEIGHT=16&FORMAT=image/png")
+	if e.renderCount() == 0 {
+		t.Fatal("GetMap never reached the processor")
+	}
+	if ct := rec.Header().Get("Content-Type"); strings.HasPrefix(ct, "image/") {
+		t.Fatalf("HTML error page was served as %s", ct)
+	}
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if code := serviceExceptionCode(t, rec); code != "NoApplicableCode" {
+		t.Errorf("exception code = %q, want NoApplicableCode", code)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// processorInfo is what the render backend says it supports
+type processorInfo struct {
+	Formats  []string `json:"formats"`
+	Palettes []string `json:"palettes"`
+	Styles   []string `json:"styles"`
+	Masking  bool     `json:"masking"` // honors validrange
+	// Honors maskpolygon, clearing pixels outside the GeoJSON geometry
+	MaskPolygon bool `json:"maskPolygon"`
+	// POSTPROCESS modes it applies itself when sent postprocess
+	PostProcess []string `json:"postprocess"`
+}
+
+// defaultProcessorInfo matches what api.py's /api/render handles, for
+// processors without an info endpoint
+var defaultProcessorInfo = processorInfo{
+	Formats:  []string{"image/png"},
+	Palettes: []string{"rainbow", "grayscale", "windy", "wind"},
+}
+
+// currentProcInfo is probed at startup and again on reload
+var currentProcInfo atomic.Pointer[processorInfo]
+
+// procInfo returns what the processor last said it supports
+func procInfo() *processorInfo {
+	if p := currentProcInfo.Load(); p != nil {
+		return p
+	}
+	return &defaultProcessorInfo
+}
+
+// probeProcessorInfo asks the processor for its supported formats,
+// palettes and styles, falling back to the defaults for anything missing
+func probeProcessorInfo(ctx context.Context) processorInfo {
+	info, err := fetchProcessorInfo(ctx)
+	if err != nil {
+		log.Printf("Processor info unavailable (%v), using built-in defaults", err)
+		return defaultProcessorInfo
+	}
+	if len(info.Formats) == 0 {
+		info.Formats = defaultProcessorInfo.Formats
+	}
+	if len(info.Palettes) == 0 {
+		info.Palettes = defaultProcessorInfo.Palettes
+	}
+	log.Printf("Processor supports formats %s; palettes %s", strings.Join(info.Formats, ", "), strings.Join(info.Palettes, ", "))
+	return info
+}
+
+func fetchProcessorInfo(ctx context.Context) (processorInfo, error) {
+	var info processorInfo
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config().ProcessorURL+config().ProcessorInfoPath, nil)
+	if err != nil {
+		return info, err
+	}
+	resp, err := processorDo(req)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("%s returned %s", config().ProcessorInfoPath, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return info, fmt.Errorf("invalid %s response: %v", config().ProcessorInfoPath, err)
+	}
+	return info, nil
+}
+
+// supportsFormat reports whether the processor can render the MIME type
+func (p processorInfo) supportsFormat(format string) bool {
+	for _, f := range p.Formats {
+		if strings.EqualFold(f, format) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsPostProcess reports whether the processor applies the mode itself
+func (p processorInfo) supportsPostProcess(mode string) bool {
+	return containsString(p.PostProcess, mode)
+}
+
+// knownPalette reports whether STYLES can be passed straight through as a
+// processor palette or style name
+func (p processorInfo) knownPalette(name string) bool {
+	if name == "" || strings.EqualFold(name, "default") {
+		return true
+	}
+	for _, list := range [][]string{p.Palettes, p.Styles} {
+		for _, s := range list {
+			if strings.EqualFold(s, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
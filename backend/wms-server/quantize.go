@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Quantization: QUANTIZE=true (or a color count) reduces a PNG GetMap to
+// an indexed image of at most that many colors, PNG_QUANTIZE_COLORS by
+// default, picked by median cut. PNG_QUANTIZE=true does it for every PNG
+// GetMap. Categorical-looking fields lose next to nothing and shrink a
+// lot; layers with smoothGradients set are never quantized.
+
+// quantizeColors is the palette size for a GetMap, 0 for none
+func quantizeColors(param, format, layer string) (int, error) {
+	n := 0
+	if config().PNGQuantize {
+		n = config().PNGQuantizeColors
+	}
+	switch s := strings.ToLower(param); s {
+	case "":
+	case "true":
+		n = config().PNGQuantizeColors
+	case "false":
+		n = 0
+	default:
+		count, err := strconv.Atoi(s)
+		if err != nil || count < 2 || count > 256 {
+			return 0, fmt.Errorf("invalid QUANTIZE %q, expected true, false or a color count from 2 to 256", param)
+		}
+		n = count
+	}
+	if (format != "" && !strings.EqualFold(format, "image/png")) || config().Layers[layer].SmoothGradients {
+		return 0, nil
+	}
+	return n, nil
+}
+
+// quantizeEntry re-encodes a rendered PNG with a median-cut palette of at
+// most n colors, fully transparent pixels sharing one entry. The original
+// is kept when it is already as small, e.g. was paletted to begin with.
+func quantizeEntry(e cacheEntry, n int) (cacheEntry, error) {
+	if e.ContentType != "image/png" {
+		return e, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(e.Body))
+	if err != nil {
+		return e, err
+	}
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	// Colors are counted packed as 0xRRGGBBAA
+	counts := map[uint32]int{}
+	transparent := false
+	for i := 0; i < len(src.Pix); i += 4 {
+		if src.Pix[i+3] == 0 {
+			transparent = true
+			continue
+		}
+		counts[binary.BigEndian.Uint32(src.Pix[i:])]++
+	}
+	var pal color.Palette
+	if transparent {
+		pal = append(pal, color.NRGBA{})
+		n--
+	}
+	index := make(map[uint32]uint8, len(counts))
+	for _, box := range medianCut(counts, n) {
+		for _, c := range box.colors {
+			index[c.c] = uint8(len(pal))
+		}
+		pal = append(pal, box.mean())
+	}
+
+	dst := image.NewPaletted(src.Bounds(), pal)
+	for i := 0; i < len(src.Pix); i += 4 {
+		if src.Pix[i+3] != 0 {
+			dst.Pix[i/4] = index[binary.BigEndian.Uint32(src.Pix[i:])]
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return e, err
+	}
+	if buf.Len() >= len(e.Body) {
+		return e, nil
+	}
+	return cacheEntry{ContentType: "image/png", Body: buf.Bytes(), NoData: e.NoData, RenderTime: e.RenderTime}, nil
+}
+
+type colorCount struct {
+	c uint32
+	n int
+}
+
+// colorBox is a set of image colors that will share one palette entry,
+// with the RGBA channel they span most of and that span
+type colorBox struct {
+	colors  []colorCount
+	pixels  int
+	channel int
+	span    int
+}
+
+func newColorBox(colors []colorCount, pixels int) colorBox {
+	b := colorBox{colors: colors, pixels: pixels, span: -1}
+	for ch := 0; ch < 4; ch++ {
+		lo, hi := uint8(255), uint8(0)
+		for _, c := range colors {
+			v := channelOf(c.c, ch)
+			lo, hi = min(lo, v), max(hi, v)
+		}
+		if int(hi)-int(lo) > b.span {
+			b.channel, b.span = ch, int(hi)-int(lo)
+		}
+	}
+	return b
+}
+
+// medianCut splits the colors into at most n boxes, each time halving the
+// box with the widest channel range at its pixel-weighted median
+func medianCut(counts map[uint32]int, n int) []colorBox {
+	if len(counts) == 0 || n < 1 {
+		return nil
+	}
+	var colors []colorCount
+	pixels := 0
+	for c, k := range counts {
+		colors = append(colors, colorCount{c, k})
+		pixels += k
+	}
+	boxes := []colorBox{newColorBox(colors, pixels)}
+	for len(boxes) < n {
+		pick := -1
+		for i, box := range boxes {
+			if len(box.colors) > 1 && box.span > 0 && (pick < 0 || box.span > boxes[pick].span) {
+				pick = i
+			}
+		}
+		if pick < 0 {
+			break
+		}
+		lo, hi := boxes[pick].split()
+		boxes[pick] = lo
+		boxes = append(boxes, hi)
+	}
+	return boxes
+}
+
+// channelOf is channel ch (0 red to 3 alpha) of a packed color
+func channelOf(c uint32, ch int) uint8 {
+	return uint8(c >> (24 - 8*ch))
+}
+
+// split halves the box along its widest channel where half its pixels
+// fall either side, keeping at least one color in each half. Ties sort by
+// the whole color, so the same image always gets the same palette.
+func (b colorBox) split() (colorBox, colorBox) {
+	ch := b.channel
+	sort.Slice(b.colors, func(i, j int) bool {
+		ci, cj := channelOf(b.colors[i].c, ch), channelOf(b.colors[j].c, ch)
+		return ci < cj || (ci == cj && b.colors[i].c < b.colors[j].c)
+	})
+	cut, seen := 1, b.colors[0].n
+	for cut < len(b.colors)-1 && seen+b.colors[cut].n <= b.pixels/2 {
+		seen += b.colors[cut].n
+		cut++
+	}
+	return newColorBox(b.colors[:cut], seen), newColorBox(b.colors[cut:], b.pixels-seen)
+}
+
+// mean is the box's pixel-weighted average color
+func (b colorBox) mean() color.NRGBA {
+	var sum [4]int
+	for _, c := range b.colors {
+		for ch := 0; ch < 4; ch++ {
+			sum[ch] += int(channelOf(c.c, ch)) * c.n
+		}
+	}
+	avg := func(ch int) uint8 { return uint8((sum[ch] + b.pixels/2) / b.pixels) }
+	return color.NRGBA{avg(0), avg(1), avg(2), avg(3)}
+}
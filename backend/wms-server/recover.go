@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics turns a panicking handler into a 500 ServiceException
+// instead of a dropped connection, logging the stack under the request's
+// ID, which the client gets back in X-Request-Id and the message. If the
+// handler had already started its response there's nothing to send, and
+// the connection is aborted as net/http would have done.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			id := requestID(r)
+			log.Printf("panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.RequestURI(), id, p, debug.Stack())
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Set("X-Request-Id", id)
+			writeWMSException(w, wmsParams(r.URL.RawQuery), http.StatusInternalServerError, "NoApplicableCode",
+				fmt.Sprintf("internal error (request %s)", id))
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// requestID is the client's X-Request-Id, else the request's trace ID,
+// else made up, so a panic can be matched to the client that hit it
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 {
+		return safeFilename(id)
+	}
+	if s, ok := r.Context().Value(spanKey{}).(*span); ok {
+		return hex.EncodeToString(s.traceID[:])
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRecoverPanicsServiceException(t *testing.T) {
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		panic("boom")
+	}))
+	tests := []struct {
+		name, clientID string
+		want           *regexp.Regexp
+	}{
+		{"made up", "", regexp.MustCompile(`^[0-9a-f]{16}$`)},
+		{"client's", "req-42", regexp.MustCompile(`^req-42$`)},
+		{"client's sanitized", "a b<c>", regexp.MustCompile(`^a_b_c_$`)},
+		{"client's too long", strings.Repeat("x", 129), regexp.MustCompile(`^[0-9a-f]{16}$`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/wms?SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0", nil)
+			if tt.clientID != "" {
+				req.Header.Set("X-Request-Id", tt.clientID)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusInternalServerError {
+				t.Errorf("status = %d, want 500", rec.Code)
+			}
+			if ct := rec.Header().Get("Content-Type"); strings.HasPrefix(ct, "image/") {
+				t.Errorf("exception served as the handler's %s", ct)
+			}
+			id := rec.Header().Get("X-Request-Id")
+			if !tt.want.MatchString(id) {
+				t.Errorf("X-Request-Id = %q, want %s", id, tt.want)
+			}
+			if code := serviceExceptionCode(t, rec); code != "NoApplicableCode" {
+				t.Errorf("exception code = %q, want NoApplicableCode", code)
+			}
+			if id != "" && !strings.Contains(rec.Body.String(), "request "+id) {
+				t.Errorf("exception doesn't name request %s: %.200s", id, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRecoverPanicsAfterResponseStarted(t *testing.T) {
+	srv := httptest.NewServer(recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ok" {
+			w.Write([]byte("ok"))
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("partial image"))
+		w.(http.Flusher).Flush()
+		panic("boom")
+	})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/wms")
+	if err == nil {
+		body, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr == nil {
+			t.Errorf("a panic mid-response ended it cleanly: %d %q", resp.StatusCode, body)
+		}
+		if strings.Contains(string(body), "ServiceException") {
+			t.Errorf("a ServiceException was appended to the started response: %q", body)
+		}
+	}
+
+	resp, err = http.Get(srv.URL + "/ok")
+	if err != nil {
+		t.Fatalf("server didn't survive the panic: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("next request: %d %q", resp.StatusCode, body)
+	}
+}
+
+// Recovery sits outside compression and tracing, so a panic in either, or
+// one behind a gzip-buffered body, still gets the 500, a span and a log line
+func TestRecoverPanicsWrapsMiddleware(t *testing.T) {
+	useConfig(t, map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://127.0.0.1:1", "OTEL_TRACES_SAMPLER_ARG": "0"})
+	var sp *span
+	var logs bytes.Buffer
+	h := middleware(&logs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sp, _ = r.Context().Value(spanKey{}).(*span)
+		// Under GZIP_MIN_BYTES, so the gzip writer holds it back
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"partial":`))
+		panic("boom")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/wms?SERVICE=WMS&REQUEST=GetMap", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("exception served with Content-Encoding %s", enc)
+	}
+	if code := serviceExceptionCode(t, rec); code != "NoApplicableCode" {
+		t.Errorf("exception code = %q, want NoApplicableCode", code)
+	}
+	if strings.Contains(rec.Body.String(), "partial") {
+		t.Errorf("the panicking handler's buffered body was sent: %.200s", rec.Body.String())
+	}
+
+	if sp == nil {
+		t.Fatal("no server span")
+	}
+	if sp.status != spanStatusError {
+		t.Error("the panicking request's span isn't marked as an error")
+	}
+	var status any
+	for _, a := range sp.attrs {
+		if a.Key == "http.response.status_code" {
+			status = a.Value["intValue"]
+		}
+	}
+	if status != "500" {
+		t.Errorf("span http.response.status_code = %v, want 500", status)
+	}
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("access log line %q: %v", logs.String(), err)
+	}
+	if entry.Status != http.StatusInternalServerError {
+		t.Errorf("access log status = %d, want 500", entry.Status)
+	}
+}
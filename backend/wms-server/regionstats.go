@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// regionStats summarizes a layer's values within a lon/lat box. The
+// statistics are nil when every grid point in it is no-data.
+type regionStats struct {
+	Layer  string     `json:"layer"`
+	BBox   [4]float64 `json:"bbox"` // west, south, east, north
+	Time   string     `json:"time,omitempty"`
+	Min    *float64   `json:"min"`
+	Max    *float64   `json:"max"`
+	Mean   *float64   `json:"mean"`
+	StdDev *float64   `json:"stddev"`
+	Count  int        `json:"count"` // grid points sampled
+	Units  string     `json:"units,omitempty"`
+}
+
+// regionStatsHandler serves GET /stats-region/{layer}?bbox=&time=&elevation=,
+// the processor's min/max/mean/stddev over the grid points in bbox
+// (minlon,minlat,maxlon,maxlat). Boxes larger than REGION_STATS_MAX_AREA
+// square degrees are refused before reaching the processor.
+func regionStatsHandler(w http.ResponseWriter, r *http.Request) {
+	layer := mux.Vars(r)["layer"]
+	qs := r.URL.Query()
+	if _, ok := layerIndex.Layer(layer); !ok {
+		writeJSONException(w, http.StatusNotFound, "LayerNotDefined", fmt.Sprintf("no data for layer %q", layer))
+		return
+	}
+	if qs.Get("bbox") == "" {
+		writeJSONException(w, http.StatusBadRequest, "MissingParameterValue", "bbox is required: minlon,minlat,maxlon,maxlat")
+		return
+	}
+	bb, err := parseRegion(qs.Get("bbox"))
+	if err != nil {
+		writeJSONException(w, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	if area := (bb[2] - bb[0]) * (bb[3] - bb[1]); config().RegionStatsMaxArea > 0 && area > config().RegionStatsMaxArea {
+		writeJSONException(w, http.StatusBadRequest, "InvalidParameterValue",
+			fmt.Sprintf("bbox covers %g square degrees, maximum is %g", area, config().RegionStatsMaxArea))
+		return
+	}
+	var t time.Time
+	if s := qs.Get("time"); s != "" {
+		if t, err = time.Parse(time.RFC3339, s); err != nil {
+			writeJSONException(w, http.StatusBadRequest, "InvalidDimensionValue", fmt.Sprintf("invalid time %q, expected RFC3339", s))
+			return
+		}
+	}
+
+	res, err := queryRegionStats(r.Context(), layer, qs.Get("elevation"), bb, t)
+	if err != nil {
+		log.Printf("Region stats failed for %s: %v", layer, err)
+		writeJSONException(w, http.StatusBadGateway, "NoApplicableCode", err.Error())
+		return
+	}
+	res.Layer, res.BBox = layer, bb
+	if res.Time == "" && !t.IsZero() {
+		res.Time = t.Format(time.RFC3339)
+	}
+	decimals := featureInfoDecimals(layer)
+	res.Min, res.Max = roundValue(res.Min, decimals), roundValue(res.Max, decimals)
+	res.Mean, res.StdDev = roundValue(res.Mean, decimals), roundValue(res.StdDev, decimals)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// parseRegion parses and checks a lon/lat bbox
+func parseRegion(s string) ([4]float64, error) {
+	var bb [4]float64
+	parts := strings.Split(s, ",")
+	ok := len(parts) == 4
+	for i := 0; ok && i < 4; i++ {
+		var err error
+		bb[i], err = strconv.ParseFloat(strings.TrimSpace(parts[i]), 64)
+		ok = err == nil
+	}
+	switch {
+	case !ok:
+		return bb, fmt.Errorf("invalid bbox %q, expected minlon,minlat,maxlon,maxlat", s)
+	case bb[0] >= bb[2] || bb[1] >= bb[3]:
+		return bb, fmt.Errorf("bbox %q is empty: min must be below max", s)
+	case bb[1] < -90 || bb[3] > 90 || bb[0] < -180 || bb[2] > 360:
+		return bb, fmt.Errorf("bbox %q is out of range", s)
+	}
+	return bb, nil
+}
+
+// queryRegionStats asks the processor for statistics over bb
+func queryRegionStats(ctx context.Context, layer, elevation string, bb [4]float64, t time.Time) (regionStats, error) {
+	var res regionStats
+	v := url.Values{}
+	v.Set("layer", layer)
+	v.Set("bbox", fmt.Sprintf("%f,%f,%f,%f", bb[0], bb[1], bb[2], bb[3]))
+	if elevation != "" {
+		v.Set("elevation", elevation)
+	}
+	if !t.IsZero() {
+		v.Set("time", t.Format(time.RFC3339))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config().ProcessorURL+config().ProcessorStatsPath+"?"+processorQuery(v), nil)
+	if err != nil {
+		return res, err
+	}
+	resp, err := processorDo(req)
+	if err != nil {
+		return res, fmt.Errorf("region stats backend error: %v", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return res, fmt.Errorf("processor does not support region statistics (%s returned %s); check PROCESSOR_STATS_PATH",
+			config().ProcessorStatsPath, resp.Status)
+	default:
+		return res, fmt.Errorf("processor returned %s: %s", resp.Status, processorErrorMessage(resp.Body))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return res, fmt.Errorf("invalid processor response: %v", err)
+	}
+	return res, nil
+}
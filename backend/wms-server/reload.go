@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// envSource is ENV_FILE's KEY=VALUE settings over the process
+// environment. A running process never sees changes to its own
+// environment, so this file is how env-backed settings change on SIGHUP.
+// Each loadConfig reads its own, kept in the Config it returns, so a file
+// that fails to load never reaches the running config.
+type envSource map[string]string
+
+// lookup reads a setting from ENV_FILE, then the environment
+func (e envSource) lookup(key string) string {
+	if v, ok := e[key]; ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+func (e envSource) get(key, defaultValue string) string {
+	if value := e.lookup(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func (e envSource) getInt(key string, defaultValue int) int {
+	value := e.lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// readEnvFile loads ENV_FILE: KEY=VALUE lines, blank lines and # comments
+func readEnvFile(path string) (envSource, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	vars := envSource{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		vars[key] = strings.TrimSpace(value)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// configGeneration counts successful reloads, so anything derived from
+// the config, such as capabilities ETags, can tell it changed
+var configGeneration atomic.Int64
+
+// watchReload reloads the config on every SIGHUP
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reloadConfig()
+	}
+}
+
+// reloadConfig swaps in a freshly loaded Config: cache size, limits,
+// request timeouts, profiles, styles, layer config and the processor's
+// palettes take effect for the next request. A config that fails to load
+// leaves the running one in place.
+func reloadConfig() {
+	next, err := loadConfig()
+	if err != nil {
+		log.Printf("Reload failed, keeping the running config: %v", err)
+		return
+	}
+	if changed := keepRestartOnly(config(), next); len(changed) > 0 {
+		log.Printf("Reload: %s changed but only apply on restart", strings.Join(changed, ", "))
+	}
+	currentConfig.Store(next)
+	configGeneration.Add(1)
+	tiles.resize(next.CacheSize)
+	info := probeProcessorInfo(context.Background())
+	currentProcInfo.Store(&info)
+	log.Printf("Reloaded config: %d layer configs, %d styles", len(next.Layers), len(next.Styles))
+}
+
+// keepRestartOnly holds the settings main reads once (the listener, routes,
+// log file, index and disk cache) at their running values in next,
+// returning the env names of those the reload would have changed
+func keepRestartOnly(running, next *Config) []string {
+	var changed []string
+	keepSetting(&changed, "PORT", running.Port, &next.Port)
+	keepSetting(&changed, "BASE_PATH", running.BasePath, &next.BasePath)
+	keepSetting(&changed, "DATA_DIR", running.DataDir, &next.DataDir)
+	if running.FilenamePattern.String() != next.FilenamePattern.String() {
+		changed = append(changed, "FILENAME_PATTERN")
+	}
+	next.FilenamePattern = running.FilenamePattern
+	keepSetting(&changed, "FILENAME_TIME_LAYOUT", running.FilenameTimeLayout, &next.FilenameTimeLayout)
+	keepSetting(&changed, "INDEX_REFRESH_SECONDS", running.IndexRefresh, &next.IndexRefresh)
+	keepSetting(&changed, "AUTOWARM_CONCURRENCY", running.AutowarmConcurrency, &next.AutowarmConcurrency)
+	keepSetting(&changed, "CACHE_DISK_DIR", running.CacheDiskDir, &next.CacheDiskDir)
+	keepSetting(&changed, "CACHE_DISK_MAX_MB", running.CacheDiskMaxMB, &next.CacheDiskMaxMB)
+	keepSetting(&changed, "LOG_FILE", running.LogFile, &next.LogFile)
+	keepSetting(&changed, "LOG_MAX_SIZE_MB", running.LogMaxSizeMB, &next.LogMaxSizeMB)
+	keepSetting(&changed, "LOG_MAX_BACKUPS", running.LogMaxBackups, &next.LogMaxBackups)
+	keepSetting(&changed, "READ_TIMEOUT_SECONDS", running.ReadTimeout, &next.ReadTimeout)
+	keepSetting(&changed, "READ_HEADER_TIMEOUT_SECONDS", running.ReadHeaderTimeout, &next.ReadHeaderTimeout)
+	keepSetting(&changed, "WRITE_TIMEOUT_SECONDS", running.WriteTimeout, &next.WriteTimeout)
+	keepSetting(&changed, "IDLE_TIMEOUT_SECONDS", running.IdleTimeout, &next.IdleTimeout)
+	keepSetting(&changed, "MAX_CONNECTIONS", running.MaxConnections, &next.MaxConnections)
+	keepSetting(&changed, "KEEP_ALIVE", running.KeepAlive, &next.KeepAlive)
+	keepSetting(&changed, "GZIP_LEVEL", running.GzipLevel, &next.GzipLevel)
+	return changed
+}
+
+// keepSetting resets *next to running, noting env in changed if it differed
+func keepSetting[T comparable](changed *[]string, env string, running T, next *T) {
+	if *next != running {
+		*changed = append(*changed, env)
+		*next = running
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// writeEnvFile replaces the ENV_FILE at path with lines
+func writeEnvFile(t *testing.T, path, lines string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reloadEnv is a test server reading its settings from an ENV_FILE that
+// the test rewrites before each reload
+func reloadEnv(t *testing.T) (*testEnv, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wms.env")
+	writeEnvFile(t, path, "CACHE_SIZE=5\n")
+	e := newTestEnv(t, map[string]string{"ENV_FILE": path}, nil, "temp_2m_2026101400.nc")
+	prevInfo := currentProcInfo.Load()
+	t.Cleanup(func() { currentProcInfo.Store(prevInfo) })
+	return e, path
+}
+
+func TestReloadKeepsEnvFileOnFailure(t *testing.T) {
+	_, path := reloadEnv(t)
+	running := config()
+
+	writeEnvFile(t, path, "CACHE_SIZE=7\nTIME_TOLERANCE=soon\n")
+	reloadConfig()
+	if config() != running {
+		t.Fatal("an invalid ENV_FILE was swapped in")
+	}
+	if got := config().env.lookup("CACHE_SIZE"); got != "5" {
+		t.Errorf("after a failed reload CACHE_SIZE reads %q from ENV_FILE, want the running 5", got)
+	}
+
+	writeEnvFile(t, path, "CACHE_SIZE=7\n")
+	reloadConfig()
+	if config().CacheSize != 7 || config().env.lookup("CACHE_SIZE") != "7" {
+		t.Errorf("a valid ENV_FILE wasn't applied: CACHE_SIZE %d", config().CacheSize)
+	}
+}
+
+// TestReloadDuringRequests is for -race: requests read the config while
+// SIGHUP reloads swap it and resize the tile cache
+func TestReloadDuringRequests(t *testing.T) {
+	e, path := reloadEnv(t)
+	const target = "/wms?SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&LAYERS=temp_2m&STYLES=&CRS=EPSG:4326&WIDTH=4&HEIGHT=4&FORMAT=image/png&BBOX="
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Distinct BBOXes so some requests render and fill the cache
+				bbox := []string{"0,0,10,10", "0,0,20,20", "10,10,20,20"}[(i+n)%3]
+				if rec := e.get(target + bbox); rec.Code != http.StatusOK {
+					t.Errorf("GetMap during reload: %d %.200s", rec.Code, rec.Body.String())
+					return
+				}
+			}
+		}(i)
+	}
+	for round := 0; round < 10; round++ {
+		for _, lines := range []string{"CACHE_SIZE=1\n", "CACHE_SIZE=100\nTIME_TOLERANCE=soon\n", "CACHE_SIZE=100\nMAX_LAYERS_PER_REQUEST=3\n", "CACHE_SIZE=2\n"} {
+			writeEnvFile(t, path, lines)
+			reloadConfig()
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if config().CacheSize != 2 {
+		t.Errorf("CacheSize = %d after the last reload, want 2", config().CacheSize)
+	}
+}
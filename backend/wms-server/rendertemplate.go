@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// PROCESSOR_RENDER_TEMPLATE shapes render requests for processors with
+// other APIs: a text/template for the path and query appended to the
+// processor URL. It's executed with a renderRequest, e.g.
+//
+//	/render/{{path .Layer}}/{{path .File}}?{{.QueryWithout "layer" "file"}}
+//
+// path and query escape a value for that part of the URL. The default
+// sends every param in the query string.
+const defaultRenderTemplate = "/api/render?{{.Query}}"
+
+// renderRequest is one render as the template sees it. Params holds every
+// param by its canonical name; Query and QueryWithout encode them as
+// processorQuery does, renamed per PROCESSOR_PARAM_NAMES.
+type renderRequest struct {
+	Layer, File, BBox, Time, Elevation string
+	Width, Height                      string
+	Styles, Palette, ColorScaleRange   string
+	Params                             map[string]string
+
+	v     url.Values
+	names map[string]string
+}
+
+func newRenderRequest(v url.Values, names map[string]string) renderRequest {
+	params := make(map[string]string, len(v))
+	for k := range v {
+		params[k] = v.Get(k)
+	}
+	return renderRequest{
+		Layer: v.Get("layer"), File: v.Get("file"), BBox: v.Get("bbox"), Time: v.Get("time"), Elevation: v.Get("elevation"),
+		Width: v.Get("width"), Height: v.Get("height"),
+		Styles: v.Get("styles"), Palette: v.Get("palette"), ColorScaleRange: v.Get("colorscalerange"),
+		Params: params,
+		v:      v,
+		names:  names,
+	}
+}
+
+// Query is every param as a query string
+func (r renderRequest) Query() string { return renameParams(r.v, r.names) }
+
+// QueryWithout is the query string less the named params, for those the
+// template puts in the path
+func (r renderRequest) QueryWithout(names ...string) string {
+	rest := make(url.Values, len(r.v))
+	for k, vals := range r.v {
+		rest[k] = vals
+	}
+	for _, name := range names {
+		rest.Del(name)
+	}
+	return renameParams(rest, r.names)
+}
+
+var renderTemplateFuncs = template.FuncMap{
+	"path":  url.PathEscape,
+	"query": url.QueryEscape,
+}
+
+// parseRenderTemplate compiles PROCESSOR_RENDER_TEMPLATE and tries it on a
+// sample render, so a misspelled field fails at startup rather than on
+// the first GetMap. names are the PROCESSOR_PARAM_NAMES renames.
+func parseRenderTemplate(text string, names map[string]string) (*template.Template, error) {
+	t, err := template.New("render").Funcs(renderTemplateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := url.Values{"layer": {"layer"}, "file": {"file.nc"}, "bbox": {"-180,-90,180,90"}, "width": {"256"}, "height": {"256"}}
+	var out strings.Builder
+	if err := t.Execute(&out, newRenderRequest(sample, names)); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(out.String(), "/") {
+		return nil, fmt.Errorf("%q must produce a path starting with /", text)
+	}
+	return t, nil
+}
+
+// renderPath is the path and query of the processor request for v
+func renderPath(v url.Values) (string, error) {
+	var out strings.Builder
+	if err := config().ProcessorRender.Execute(&out, newRenderRequest(v, config().ProcessorParams)); err != nil {
+		return "", fmt.Errorf("PROCESSOR_RENDER_TEMPLATE: %v", err)
+	}
+	return out.String(), nil
+}
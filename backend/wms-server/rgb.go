@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// rgbStyle is the STYLES value that renders three layers as the R, G and B
+// channels of one image; the processor composes the bands
+const rgbStyle = "rgb"
+
+// rgbParams validates an rgb request and returns its processor params.
+// Channel ranges come from COLORSCALERANGE as "min,max;min,max;min,max",
+// else from the group's rgbRanges when LAYERS names a configured group.
+func rgbParams(layers []string, requested, colorRange string) (url.Values, error) {
+	if len(layers) != 3 {
+		return nil, fmt.Errorf("STYLES=rgb needs exactly three layers (red, green, blue), got %d", len(layers))
+	}
+	v := url.Values{}
+	v.Set("layer", strings.Join(layers, ","))
+	v.Set("styles", rgbStyle)
+
+	if colorRange == "" {
+		if lc := config().Layers[requested]; lc.RGBRanges != nil {
+			v.Set("bandranges", formatBandRanges(*lc.RGBRanges))
+		}
+		return v, nil
+	}
+	parts := strings.Split(colorRange, ";")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("COLORSCALERANGE for STYLES=rgb must be three min,max ranges separated by ';', got %q", colorRange)
+	}
+	var ranges [3][2]float64
+	for i, p := range parts {
+		lo, hi, ok := strings.Cut(p, ",")
+		var err1, err2 error
+		ranges[i][0], err1 = strconv.ParseFloat(strings.TrimSpace(lo), 64)
+		ranges[i][1], err2 = strconv.ParseFloat(strings.TrimSpace(hi), 64)
+		if !ok || err1 != nil || err2 != nil || ranges[i][0] >= ranges[i][1] {
+			return nil, fmt.Errorf("invalid %s channel range %q, expected min,max with min below max", "RGB"[i:i+1], p)
+		}
+	}
+	v.Set("bandranges", formatBandRanges(ranges))
+	return v, nil
+}
+
+func formatBandRanges(ranges [3][2]float64) string {
+	parts := make([]string, 3)
+	for i, r := range ranges {
+		parts[i] = strconv.FormatFloat(r[0], 'g', -1, 64) + "," + strconv.FormatFloat(r[1], 'g', -1, 64)
+	}
+	return strings.Join(parts, ";")
+}
+
+// isRGBGroup reports whether the group is configured as an RGB composite
+func isRGBGroup(name string) bool {
+	return config().Layers[name].RGBRanges != nil && len(config().LayerGroups[name]) == 3
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache telemetry. Counters are plain atomics on the request path; a
+// background aggregator snapshots them every statsTick into a ring so
+// windowed rates cost nothing per request.
+const (
+	statsTick    = 10 * time.Second
+	statsSlots   = 90 // 15 minutes of ticks
+	topKeysLimit = 10000
+	topKeysShown = 10
+	latencyRing  = 1024 // renders the percentiles are computed over
+)
+
+type cacheCounters struct {
+	hits, misses, evictions uint64
+}
+
+type cacheStats struct {
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+	renders   atomic.Uint64
+	renderNs  atomic.Uint64
+	// Renders where the processor reported its own time, split into that
+	// and everything else (queueing, network, transfer)
+	reported    atomic.Uint64
+	processorNs atomic.Uint64
+	overheadNs  atomic.Uint64
+
+	mu    sync.Mutex
+	ring  []cacheCounters // oldest first
+	keyMu sync.Mutex
+	keys  map[string]uint64
+
+	latMu   sync.Mutex
+	latency [latencyRing]time.Duration // most recent renders, wrapping at latNext
+	latNext int
+	latN    int
+}
+
+var stats = &cacheStats{keys: map[string]uint64{}}
+
+func (s *cacheStats) hit(key string) {
+	s.hits.Add(1)
+	s.countKey(key)
+}
+
+// miss records a render taking render in total, processor of it spent in the
+// processor by its own account (zero if it didn't say)
+func (s *cacheStats) miss(key string, render, processor time.Duration) {
+	s.misses.Add(1)
+	s.renders.Add(1)
+	s.renderNs.Add(uint64(render))
+	if processor > 0 {
+		s.reported.Add(1)
+		s.processorNs.Add(uint64(processor))
+		s.overheadNs.Add(uint64(max(render-processor, 0)))
+	}
+	s.countKey(key)
+
+	s.latMu.Lock()
+	s.latency[s.latNext] = render
+	s.latNext = (s.latNext + 1) % latencyRing
+	s.latN = min(s.latN+1, latencyRing)
+	s.latMu.Unlock()
+}
+
+// percentiles returns the render latency at each quantile (0-1) over the
+// last latencyRing renders, in milliseconds; zeros before any render. The
+// ring is copied and sorted per call, which only /stats and /metrics pay.
+func (s *cacheStats) percentiles(qs ...float64) []float64 {
+	s.latMu.Lock()
+	samples := append([]time.Duration(nil), s.latency[:s.latN]...)
+	s.latMu.Unlock()
+
+	out := make([]float64, len(qs))
+	if len(samples) == 0 {
+		return out
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	for i, q := range qs {
+		// Nearest rank
+		idx := int(math.Ceil(q*float64(len(samples)))) - 1
+		idx = min(max(idx, 0), len(samples)-1)
+		out[i] = float64(samples[idx]) / 1e6
+	}
+	return out
+}
+
+func (s *cacheStats) countKey(key string) {
+	s.keyMu.Lock()
+	s.keys[key]++
+	s.keyMu.Unlock()
+}
+
+func (s *cacheStats) snapshot() cacheCounters {
+	return cacheCounters{s.hits.Load(), s.misses.Load(), s.evictions.Load()}
+}
+
+// aggregate runs forever, recording a snapshot per tick and decaying the
+// key counts once the map grows past topKeysLimit
+func (s *cacheStats) aggregate() {
+	for range time.Tick(statsTick) {
+		snap := s.snapshot()
+		s.mu.Lock()
+		s.ring = append(s.ring, snap)
+		if len(s.ring) > statsSlots+1 {
+			s.ring = s.ring[1:]
+		}
+		s.mu.Unlock()
+
+		s.keyMu.Lock()
+		if len(s.keys) > topKeysLimit {
+			for k, n := range s.keys {
+				if n /= 2; n == 0 {
+					delete(s.keys, k)
+				} else {
+					s.keys[k] = n
+				}
+			}
+		}
+		s.keyMu.Unlock()
+	}
+}
+
+// window returns the counter deltas over roughly the last d
+func (s *cacheStats) window(d time.Duration) cacheCounters {
+	now := s.snapshot()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	back := int(d / statsTick)
+	if back > len(s.ring) {
+		back = len(s.ring)
+	}
+	if back == 0 {
+		return now
+	}
+	then := s.ring[len(s.ring)-back]
+	return cacheCounters{now.hits - then.hits, now.misses - then.misses, now.evictions - then.evictions}
+}
+
+func hitRatio(c cacheCounters) float64 {
+	if c.hits+c.misses == 0 {
+		return 0
+	}
+	return float64(c.hits) / float64(c.hits+c.misses)
+}
+
+type keyCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+func (s *cacheStats) topKeys(n int) []keyCount {
+	s.keyMu.Lock()
+	top := make([]keyCount, 0, len(s.keys))
+	for k, c := range s.keys {
+		top = append(top, keyCount{k, c})
+	}
+	s.keyMu.Unlock()
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// statsReport is the /stats payload
+type statsReport struct {
+	Hits            uint64                    `json:"hits"`
+	Misses          uint64                    `json:"misses"`
+	HitRatio        map[string]float64        `json:"hit_ratio"`
+	EvictionsPerMin float64                   `json:"evictions_per_minute"`
+	Entries         int                       `json:"entries"`
+	BytesCached     int64                     `json:"bytes_cached"`
+	AvgEntryBytes   int64                     `json:"avg_entry_bytes"`
+	AvgRenderMs     float64                   `json:"avg_render_ms"`
+	AvgProcessorMs  float64                   `json:"avg_processor_render_ms"`
+	AvgOverheadMs   float64                   `json:"avg_render_overhead_ms"`
+	ReportedRenders uint64                    `json:"processor_timed_renders"`
+	LatencyP50Ms    float64                   `json:"latency_p50_ms"`
+	LatencyP90Ms    float64                   `json:"latency_p90_ms"`
+	LatencyP99Ms    float64                   `json:"latency_p99_ms"`
+	TopKeys         []keyCount                `json:"top_keys"`
+	CacheSizeLimit  int                       `json:"cache_size_limit"`
+	CacheLayers     map[string]layerOccupancy `json:"cache_layers"`
+	DiskTierEnabled bool                      `json:"disk_tier_enabled"`
+	Backends        map[string]backendReport  `json:"backends"`
+}
+
+func buildStatsReport() statsReport {
+	total := stats.snapshot()
+	entries, bytes := tiles.Len(), tiles.Bytes()
+	r := statsReport{
+		Hits:   total.hits,
+		Misses: total.misses,
+		HitRatio: map[string]float64{
+			"total": hitRatio(total),
+			"1m":    hitRatio(stats.window(time.Minute)),
+			"5m":    hitRatio(stats.window(5 * time.Minute)),
+			"15m":   hitRatio(stats.window(15 * time.Minute)),
+		},
+		EvictionsPerMin: float64(stats.window(5*time.Minute).evictions) / 5,
+		Entries:         entries,
+		BytesCached:     bytes,
+		TopKeys:         stats.topKeys(topKeysShown),
+		CacheSizeLimit:  config().CacheSize,
+		CacheLayers:     tiles.Layers(),
+		DiskTierEnabled: tiles.disk != nil,
+		Backends:        backendReports(),
+	}
+	if entries > 0 {
+		r.AvgEntryBytes = bytes / int64(entries)
+	}
+	if n := stats.renders.Load(); n > 0 {
+		r.AvgRenderMs = float64(stats.renderNs.Load()) / float64(n) / 1e6
+	}
+	p := stats.percentiles(0.5, 0.9, 0.99)
+	r.LatencyP50Ms, r.LatencyP90Ms, r.LatencyP99Ms = p[0], p[1], p[2]
+	if n := stats.reported.Load(); n > 0 {
+		r.ReportedRenders = n
+		r.AvgProcessorMs = float64(stats.processorNs.Load()) / float64(n) / 1e6
+		r.AvgOverheadMs = float64(stats.overheadNs.Load()) / float64(n) / 1e6
+	}
+	return r
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildStatsReport())
+}
+
+// metricsHandler exposes the same numbers in Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	rep := buildStatsReport()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# TYPE wms_cache_hits_total counter\nwms_cache_hits_total %d\n", rep.Hits)
+	fmt.Fprintf(w, "# TYPE wms_cache_misses_total counter\nwms_cache_misses_total %d\n", rep.Misses)
+	fmt.Fprintf(w, "# TYPE wms_cache_evictions_total counter\nwms_cache_evictions_total %d\n", stats.evictions.Load())
+	fmt.Fprintf(w, "# TYPE wms_cache_hit_ratio gauge\n")
+	for _, win := range []string{"1m", "5m", "15m", "total"} {
+		fmt.Fprintf(w, "wms_cache_hit_ratio{window=%q} %g\n", win, rep.HitRatio[win])
+	}
+	fmt.Fprintf(w, "# TYPE wms_cache_evictions_per_minute gauge\nwms_cache_evictions_per_minute %g\n", rep.EvictionsPerMin)
+	fmt.Fprintf(w, "# TYPE wms_cache_entries gauge\nwms_cache_entries %d\n", rep.Entries)
+	fmt.Fprintf(w, "# TYPE wms_cache_bytes gauge\nwms_cache_bytes %d\n", rep.BytesCached)
+	layers := make([]string, 0, len(rep.CacheLayers))
+	for name := range rep.CacheLayers {
+		layers = append(layers, name)
+	}
+	sort.Strings(layers)
+	fmt.Fprintf(w, "# TYPE wms_cache_layer_entries gauge\n")
+	for _, name := range layers {
+		fmt.Fprintf(w, "wms_cache_layer_entries{layer=%q} %d\n", name, rep.CacheLayers[name].Entries)
+	}
+	fmt.Fprintf(w, "# TYPE wms_cache_layer_bytes gauge\n")
+	for _, name := range layers {
+		fmt.Fprintf(w, "wms_cache_layer_bytes{layer=%q} %d\n", name, rep.CacheLayers[name].Bytes)
+	}
+	fmt.Fprintf(w, "# TYPE wms_cache_avg_entry_bytes gauge\nwms_cache_avg_entry_bytes %d\n", rep.AvgEntryBytes)
+	fmt.Fprintf(w, "# TYPE wms_render_avg_ms gauge\nwms_render_avg_ms %g\n", rep.AvgRenderMs)
+	fmt.Fprintf(w, "# TYPE wms_render_latency_ms summary\n")
+	for _, q := range []struct {
+		label string
+		ms    float64
+	}{{"0.5", rep.LatencyP50Ms}, {"0.9", rep.LatencyP90Ms}, {"0.99", rep.LatencyP99Ms}} {
+		fmt.Fprintf(w, "wms_render_latency_ms{quantile=%q} %g\n", q.label, q.ms)
+	}
+	fmt.Fprintf(w, "# TYPE wms_processor_render_seconds_total counter\nwms_processor_render_seconds_total %g\n", float64(stats.processorNs.Load())/1e9)
+	fmt.Fprintf(w, "# TYPE wms_render_overhead_seconds_total counter\nwms_render_overhead_seconds_total %g\n", float64(stats.overheadNs.Load())/1e9)
+	fmt.Fprintf(w, "# TYPE wms_processor_timed_renders_total counter\nwms_processor_timed_renders_total %d\n", rep.ReportedRenders)
+	backends := []string{backendPrimary, backendCanary}
+	fmt.Fprintf(w, "# TYPE wms_backend_renders_total counter\n")
+	for _, b := range backends {
+		fmt.Fprintf(w, "wms_backend_renders_total{backend=%q} %d\n", b, backendStats[b].renders.Load())
+	}
+	fmt.Fprintf(w, "# TYPE wms_backend_render_errors_total counter\n")
+	for _, b := range backends {
+		fmt.Fprintf(w, "wms_backend_render_errors_total{backend=%q} %d\n", b, backendStats[b].errors.Load())
+	}
+	fmt.Fprintf(w, "# TYPE wms_backend_render_seconds_total counter\n")
+	for _, b := range backends {
+		fmt.Fprintf(w, "wms_backend_render_seconds_total{backend=%q} %g\n", b, float64(backendStats[b].ns.Load())/1e9)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// renderOrStream is handleGetMap's single-layer render. With
+// BUFFER_THRESHOLD_BYTES set, a cache miss whose processor response is at
+// least that large, or doesn't say, is copied straight to the client
+// rather than buffered and cached; streamed reports that the response has
+// been written. Smaller responses take the usual buffered path.
+func renderOrStream(w http.ResponseWriter, r *http.Request, q, v url.Values, width, height int, timing *serverTiming) (entry cacheEntry, streamed, ok bool) {
+	v = withLayerParams(v)
+	key := v.Encode()
+	if config().BufferThreshold <= 0 || maintenance.Load() || config().Layers[v.Get("layer")].masksOnServer() || v.Get("gutter") != "" {
+		entry, ok = renderCached(w, r, q, v, width, height, timing)
+		return entry, false, ok
+	}
+	if _, hit := tiles.Get(key); hit {
+		entry, ok = renderCached(w, r, q, v, width, height, timing)
+		return entry, false, ok
+	}
+	timing.phase("cache-lookup")
+
+	// The budget covers waiting for the processor's headers; once the body
+	// is flowing it runs to completion. There's no degraded fallback here.
+	ctx := r.Context()
+	var budget *time.Timer
+	if config().RenderBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		budget = time.AfterFunc(config().RenderBudget, cancel)
+	}
+	start := time.Now()
+	resp, contentType, body, err := openRender(ctx, v)
+	if budget != nil && !budget.Stop() && r.Context().Err() == nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = errRenderBudget
+	}
+	if err != nil {
+		backendRender(ctx, time.Since(start), err)
+		timing.phase("processor-fetch")
+		writeRenderError(w, q, err, timing)
+		return entry, false, false
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength >= 0 && resp.ContentLength < int64(config().BufferThreshold) {
+		data, err := io.ReadAll(body)
+		processor := processorRenderTime(resp.Header)
+		stats.miss(key, time.Since(start), processor)
+		backendRender(ctx, time.Since(start), err)
+		timing.phase("processor-fetch")
+		timing.overlap("processor", processor)
+		if err != nil {
+			writeRenderError(w, q, err, timing)
+			return entry, false, false
+		}
+		entry = cacheEntry{ContentType: contentType, Body: data, NoData: strings.EqualFold(resp.Header.Get("X-No-Data"), "true"), RenderTime: processor}
+		tiles.Put(key, entry)
+		putStale(v, entry)
+		setRenderHeaders(w, false, "")
+		return entry, false, true
+	}
+
+	// Only the wait for headers is known here; the full render isn't
+	processor := processorRenderTime(resp.Header)
+	timing.phase("processor-fetch")
+	timing.overlap("processor", processor)
+	setRenderHeaders(w, false, "")
+	w.Header().Set("X-Response-Mode", "streamed")
+	w.Header().Set("Server-Timing", timing.header())
+	w.Header().Set("Content-Type", contentType)
+	setDisposition(w, contentType, v)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	n, err := io.Copy(w, body)
+	stats.miss(key, time.Since(start), processor)
+	backendRender(ctx, time.Since(start), err)
+	if err != nil {
+		log.Printf("Streaming %s aborted after %d bytes: %v", v.Get("layer"), n, err)
+	}
+	return entry, true, true
+}
+
+// entryETag is a strong validator for a buffered image
+func entryETag(e cacheEntry) string {
+	sum := sha256.Sum256(e.Body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// namedStyle is a rendering bundle loaded from STYLES_DIR/<name>.json
+type namedStyle struct {
+	Name            string   `json:"-"`
+	Title           string   `json:"title"`
+	Palette         string   `json:"palette"`
+	ColorScaleRange string   `json:"colorscalerange"`
+	Gamma           *float64 `json:"gamma"`
+	Mode            string   `json:"mode"`   // processor interpolation, e.g. nearest or bilinear
+	Layers          []string `json:"layers"` // empty means every layer
+	// Extra pixels rendered around each edge and cropped off, overriding
+	// TILE_GUTTER
+	Gutter *int `json:"gutter"`
+}
+
+// loadStyles reads every *.json file in dir as a named style
+func loadStyles(dir string) (map[string]namedStyle, error) {
+	styles := map[string]namedStyle{}
+	if dir == "" {
+		return styles, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var s namedStyle
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		if s.Gutter != nil && (*s.Gutter < 0 || *s.Gutter > maxGutter) {
+			return nil, fmt.Errorf("%s: gutter %d is outside 0..%d", p, *s.Gutter, maxGutter)
+		}
+		s.Name = strings.TrimSuffix(filepath.Base(p), ".json")
+		if s.Title == "" {
+			s.Title = s.Name
+		}
+		styles[s.Name] = s
+	}
+	return styles, nil
+}
+
+// appliesTo reports whether the style may be used with the layer
+func (s namedStyle) appliesTo(layer string) bool {
+	return len(s.Layers) == 0 || containsString(s.Layers, layer)
+}
+
+// params returns the processor params the style sets
+func (s namedStyle) params() url.Values {
+	v := url.Values{}
+	if s.Palette != "" {
+		v.Set("palette", s.Palette)
+	}
+	if s.ColorScaleRange != "" {
+		v.Set("colorscalerange", s.ColorScaleRange)
+	}
+	if s.Gamma != nil {
+		v.Set("gamma", strconv.FormatFloat(*s.Gamma, 'f', -1, 64))
+	}
+	if s.Mode != "" {
+		v.Set("interpolation", s.Mode)
+	}
+	return v
+}
+
+// splitStyle parses an ncWMS combined STYLES value "<mode>/<palette>",
+// e.g. boxfill/rainbow. ok is false for values without a slash. A part
+// that is "default" (or ncWMS's "default-scalar" mode) comes back empty.
+func splitStyle(s string) (mode, palette string, ok bool) {
+	mode, palette, ok = strings.Cut(s, "/")
+	if !ok {
+		return "", "", false
+	}
+	if strings.EqualFold(mode, "default") || strings.EqualFold(mode, "default-scalar") {
+		mode = ""
+	}
+	if strings.EqualFold(palette, "default") {
+		palette = ""
+	}
+	return mode, palette, true
+}
+
+// styleParams returns the processor params for a STYLES value that isn't a
+// registry style: a combined value splits into styles=<mode> and
+// palette=<palette>, anything else is passed through as styles
+func styleParams(styles string) url.Values {
+	v := url.Values{}
+	mode, palette, ok := splitStyle(styles)
+	if !ok {
+		mode = styles
+	}
+	if mode != "" {
+		v.Set("styles", mode)
+	}
+	if palette != "" {
+		v.Set("palette", palette)
+	}
+	return v
+}
+
+// resolveStyle looks up STYLES in the registry. A nil style with no error
+// means the value is passed through to the processor, see styleParams.
+func resolveStyle(name, layer string) (*namedStyle, error) {
+	if mode, palette, ok := splitStyle(name); ok {
+		if len(config().Styles) > 0 && (!procInfo().knownPalette(mode) || !procInfo().knownPalette(palette)) {
+			return nil, fmt.Errorf("unknown style %q, expected <mode>/<palette> with a processor style and palette", name)
+		}
+		return nil, nil
+	}
+	if s, ok := config().Styles[name]; ok {
+		if !s.appliesTo(layer) {
+			return nil, fmt.Errorf("style %q is not available for layer %q", name, layer)
+		}
+		return &s, nil
+	}
+	if len(config().Styles) > 0 && !procInfo().knownPalette(name) {
+		return nil, fmt.Errorf("unknown style %q, expected one of: %s", name, strings.Join(styleNames(layer), ", "))
+	}
+	return nil, nil
+}
+
+// styleNames returns the registered styles usable with the layer, sorted
+func styleNames(layer string) []string {
+	var names []string
+	for name, s := range config().Styles {
+		if s.appliesTo(layer) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeStyles advertises the registered styles usable with the layer
+func writeStyles(c *capsWriter, layer string) {
+	for _, name := range styleNames(layer) {
+		c.start("Style")
+		c.elem("Name", name)
+		c.elem("Title", config().Styles[name].Title)
+		c.end()
+	}
+}
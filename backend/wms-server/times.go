@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ISO 8601 durations with fixed-length units only (weeks, days, h/m/s);
+// years and months are ambiguous and rejected.
+var isoDurationRe = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// isRelativeTime reports whether a TIME value is an ISO 8601 duration
+func isRelativeTime(s string) bool {
+	s = strings.TrimLeft(s, "+-")
+	return strings.HasPrefix(s, "P") || strings.HasPrefix(s, "p")
+}
+
+// parseISODuration parses e.g. PT6H, P1D, P1DT12H or -PT3H
+func parseISODuration(s string) (time.Duration, error) {
+	m := isoDurationRe.FindStringSubmatch(strings.ToUpper(s))
+	if m == nil || strings.HasSuffix(strings.ToUpper(s), "P") || strings.HasSuffix(strings.ToUpper(s), "T") {
+		return 0, fmt.Errorf("invalid ISO 8601 duration %q", s)
+	}
+
+	var d time.Duration
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute}
+	for i, unit := range units {
+		if m[i+2] != "" {
+			n, _ := strconv.Atoi(m[i+2])
+			d += time.Duration(n) * unit
+		}
+	}
+	if m[6] != "" {
+		secs, _ := strconv.ParseFloat(m[6], 64)
+		d += time.Duration(secs * float64(time.Second))
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// resolveRelativeTime resolves a duration offset from a model run to the
+// nearest available timestep. With a zero run the latest run is used and
+// any run's data may satisfy the offset.
+func resolveRelativeTime(li layerInfo, run time.Time, value string) (timeStep, error) {
+	offset, err := parseISODuration(value)
+	if err != nil {
+		return timeStep{}, err
+	}
+	if len(li.Files) == 0 {
+		return timeStep{}, fmt.Errorf("no data available for layer %s", li.Name)
+	}
+
+	steps := li.runSteps(run)
+	if run.IsZero() {
+		run = li.Files[len(li.Files)-1].RunTime
+		steps = li.timeSteps()
+	}
+	target := run.Add(offset)
+	step, ok := nearestTimeStep(steps, target)
+	if !ok {
+		return timeStep{}, fmt.Errorf("no data for layer %s at %s (run %s + %s)",
+			li.Name, target.Format(time.RFC3339), run.Format(time.RFC3339), value)
+	}
+	return step, nil
+}
+
+// resolveReferenceTime returns the model run named by DIM_REFERENCE_TIME
+func resolveReferenceTime(li layerInfo, value string) (time.Time, error) {
+	runs := li.runs()
+	if len(runs) == 0 {
+		return time.Time{}, fmt.Errorf("no data available for layer %s", li.Name)
+	}
+	if value == "" || strings.EqualFold(value, "latest") {
+		return runs[len(runs)-1], nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid DIM_REFERENCE_TIME %q, expected RFC3339", value)
+	}
+	for _, run := range runs {
+		if run.Equal(t) {
+			return run, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no %s run at %s", li.Name, t.UTC().Format(time.RFC3339))
+}
+
+// forecastHourStep resolves DIM_FORECAST_HOUR within a run (valid time =
+// run + forecast hour)
+func forecastHourStep(li layerInfo, run time.Time, value string) (timeStep, error) {
+	fh, err := strconv.Atoi(value)
+	if err != nil || fh < 0 {
+		return timeStep{}, fmt.Errorf("invalid DIM_FORECAST_HOUR %q", value)
+	}
+	valid := run.Add(time.Duration(fh) * time.Hour)
+	for _, st := range li.runSteps(run) {
+		if st.Time.Equal(valid) {
+			return st, nil
+		}
+	}
+	return timeStep{}, fmt.Errorf("forecast hour %d is not available for the %s run of layer %s",
+		fh, run.Format(time.RFC3339), li.Name)
+}
+
+// nearestTimeStep returns the step closest to t. Times outside the
+// covered range have no data.
+func nearestTimeStep(steps []timeStep, t time.Time) (timeStep, bool) {
+	if len(steps) == 0 || t.Before(steps[0].Time) || t.After(steps[len(steps)-1].Time) {
+		return timeStep{}, false
+	}
+	return closestTimeStep(steps, t)
+}
+
+// closestTimeStep returns the step closest to t, even outside the covered
+// range; on a tie the earlier step wins
+func closestTimeStep(steps []timeStep, t time.Time) (timeStep, bool) {
+	if len(steps) == 0 {
+		return timeStep{}, false
+	}
+	best := steps[0]
+	for _, s := range steps[1:] {
+		if absDuration(s.Time.Sub(t)) < absDuration(best.Time.Sub(t)) {
+			best = s
+		}
+	}
+	return best, true
+}
+
+// previousTimeStep returns the step at t or, failing that, the latest one
+// before it
+func previousTimeStep(steps []timeStep, t time.Time) (timeStep, bool) {
+	var best timeStep
+	found := false
+	for _, s := range steps {
+		if s.Time.After(t) {
+			break
+		}
+		best, found = s, true
+	}
+	return best, found
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// serverTiming collects request phases for the Server-Timing header
+type serverTiming struct {
+	start  time.Time
+	mark   time.Time
+	phases []timingPhase
+}
+
+type timingPhase struct {
+	name string
+	dur  time.Duration
+}
+
+func newServerTiming() *serverTiming {
+	now := time.Now()
+	return &serverTiming{start: now, mark: now}
+}
+
+// phase records the time elapsed since the previous phase (or the start)
+func (st *serverTiming) phase(name string) {
+	now := time.Now()
+	st.phases = append(st.phases, timingPhase{name: name, dur: now.Sub(st.mark)})
+	st.mark = now
+}
+
+// measured records a phase timed by the caller as the next one, moving
+// the mark past it (but never past now)
+func (st *serverTiming) measured(name string, d time.Duration) {
+	st.phases = append(st.phases, timingPhase{name: name, dur: d})
+	st.mark = st.mark.Add(d)
+	if now := time.Now(); st.mark.After(now) {
+		st.mark = now
+	}
+}
+
+// overlap records a phase reported by someone else that falls within the
+// ones already measured, such as the processor's own render time, without
+// moving the mark. Zero durations are skipped.
+func (st *serverTiming) overlap(name string, d time.Duration) {
+	if d > 0 {
+		st.phases = append(st.phases, timingPhase{name: name, dur: d})
+	}
+}
+
+// header renders the Server-Timing value. The per-phase breakdown is only
+// included in debug mode; total is always present.
+func (st *serverTiming) header() string {
+	parts := make([]string, 0, len(st.phases)+1)
+	if config().Debug {
+		for _, p := range st.phases {
+			parts = append(parts, formatTiming(p.name, p.dur))
+		}
+	}
+	parts = append(parts, formatTiming("total", time.Since(st.start)))
+	return strings.Join(parts, ", ")
+}
+
+func formatTiming(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.2f", name, float64(d.Microseconds())/1000)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request tracing, exported to OTEL_EXPORTER_OTLP_ENDPOINT as OTLP/HTTP
+// JSON. Every request is a server span and every processor call a client
+// span under it; the W3C traceparent header carries the trace on to the
+// processor. With no endpoint no spans are made and requests pass through.
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+)
+
+// span is one timed operation of a trace. A nil *span is tracing switched
+// off, and all its methods do nothing.
+type span struct {
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	sampled bool
+	name    string
+	kind    int
+	start   time.Time
+	attrs   []otlpAttr
+	status  int
+	once    sync.Once
+}
+
+type spanKey struct{}
+
+// startSpan starts a span under the one in ctx, or a new trace sampled at
+// OTEL_TRACES_SAMPLER_ARG. Children follow their parent's sampling, so a
+// trace is exported whole or not at all.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if config().OTLPEndpoint == "" {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID, s.parent, s.sampled = parent.traceID, parent.id, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = mrand.Float64() < config().TraceSampleRatio
+	}
+	rand.Read(s.id[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// set records an attribute: a string, int or bool
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	var v map[string]any
+	switch value := value.(type) {
+	case int:
+		v = map[string]any{"intValue": strconv.Itoa(value)}
+	case bool:
+		v = map[string]any{"boolValue": value}
+	default:
+		v = map[string]any{"stringValue": fmt.Sprint(value)}
+	}
+	s.attrs = append(s.attrs, otlpAttr{Key: key, Value: v})
+}
+
+// fail marks the span as an error
+func (s *span) fail() {
+	if s != nil {
+		s.status = spanStatusError
+	}
+}
+
+// end finishes the span and queues it for export if sampled; later calls
+// do nothing
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		if s.sampled {
+			traces.add(s.export(time.Now()))
+		}
+	})
+}
+
+// traceparent is the W3C header naming s as the parent
+func (s *span) traceparent() string {
+	flags := 0
+	if s.sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", s.traceID, s.id, flags)
+}
+
+// parseTraceparent reads a client's W3C traceparent as a remote parent span
+func parseTraceparent(h string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return nil, false
+	}
+	var s span
+	flags, err := hex.DecodeString(parts[3])
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || err != nil || len(flags) != 1 {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil || s.traceID == [16]byte{} {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.id[:], []byte(parts[2])); err != nil || s.id == [8]byte{} {
+		return nil, false
+	}
+	s.sampled = flags[0]&1 == 1
+	return &s, true
+}
+
+// traceRequests wraps each request in a server span, continuing the
+// client's trace when it sends traceparent
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config().OTLPEndpoint == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if remote, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey{}, remote)
+		}
+		ctx, sp := startSpan(ctx, r.Method+" "+spanRoute(r.URL.Path), spanKindServer)
+		sp.set("http.request.method", r.Method)
+		sp.set("url.path", r.URL.Path)
+		if req := wmsParams(r.URL.RawQuery).Get("REQUEST"); req != "" {
+			sp.set("wms.request", req)
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		finished := false
+		defer func() {
+			switch {
+			case !finished:
+				// Panicking: recoverPanics answers with a 500 or aborts
+				rec.status = http.StatusInternalServerError
+			case rec.status == 0:
+				rec.status = http.StatusOK
+			}
+			sp.set("http.response.status_code", rec.status)
+			if rec.status >= 500 {
+				sp.fail()
+			}
+			sp.end()
+		}()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		finished = true
+	})
+}
+
+// spanRoute names a request's endpoint by its first path segment under
+// BASE_PATH, so tile paths don't make a span name per tile
+func spanRoute(path string) string {
+	path = strings.TrimPrefix(path, config().BasePath)
+	first, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return "/" + first
+}
+
+// traceProcessorCall starts a client span for a processor request and
+// passes the trace on in its traceparent header
+func traceProcessorCall(req *http.Request) *span {
+	_, sp := startSpan(req.Context(), "processor "+req.URL.Path, spanKindClient)
+	if sp != nil {
+		req.Header.Set("traceparent", sp.traceparent())
+		sp.set("http.request.method", req.Method)
+		sp.set("url.full", req.URL.String())
+	}
+	return sp
+}
+
+// endProcessorCall records the processor's answer. A successful call's
+// span ends when its body is closed, so it covers streaming the image.
+func endProcessorCall(sp *span, resp *http.Response, err error) {
+	if sp == nil {
+		return
+	}
+	if err != nil {
+		sp.set("error.type", err.Error())
+		sp.fail()
+		sp.end()
+		return
+	}
+	sp.set("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		sp.fail()
+	}
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: sp}
+}
+
+type spanBody struct {
+	io.ReadCloser
+	span *span
+}
+
+func (b *spanBody) Close() error {
+	b.span.end()
+	return b.ReadCloser.Close()
+}
+
+// OTLP/HTTP JSON encoding of finished spans
+type otlpAttr struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+func (s *span) export(end time.Time) otlpSpan {
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.id[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parent != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	out.Status.Code = s.status
+	return out
+}
+
+// spanExporter batches finished spans and posts them to the collector
+// every few seconds. When the queue is full spans are dropped rather than
+// holding up requests.
+type spanExporter struct {
+	once   sync.Once
+	queue  chan otlpSpan
+	client *http.Client
+}
+
+const (
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+var traces = &spanExporter{
+	queue:  make(chan otlpSpan, 4*traceBatchSize),
+	client: &http.Client{Timeout: 10 * time.Second},
+}
+
+func (e *spanExporter) add(s otlpSpan) {
+	e.once.Do(func() { go e.run() })
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+func (e *spanExporter) run() {
+	tick := time.NewTicker(traceFlushInterval)
+	var batch []otlpSpan
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) < traceBatchSize {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if endpoint := config().OTLPEndpoint; endpoint != "" {
+			if err := e.post(endpoint, batch); err != nil {
+				log.Printf("Exporting %d spans to %s failed: %v", len(batch), endpoint, err)
+			}
+		}
+		batch = nil
+	}
+}
+
+func (e *spanExporter) post(endpoint string, batch []otlpSpan) error {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{
+				"attributes": []otlpAttr{{Key: "service.name", Value: map[string]any{"stringValue": config().ServiceName}}},
+			},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": "weather-wms"},
+				"spans": batch,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(endpoint+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraceRequestsWMSRequestAttribute(t *testing.T) {
+	useConfig(t, map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://127.0.0.1:1", "OTEL_TRACES_SAMPLER_ARG": "0"})
+	var got any
+	h := traceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = nil
+		s, _ := r.Context().Value(spanKey{}).(*span)
+		if s == nil {
+			t.Fatal("no server span in the request context")
+		}
+		for _, a := range s.attrs {
+			if a.Key == "wms.request" {
+				got = a.Value["stringValue"]
+			}
+		}
+	}))
+	for query, want := range map[string]any{
+		"REQUEST=GetMap":             "GetMap",
+		"request=getmap":             "getmap",
+		"Service=WMS&Request=GetMap": "GetMap",
+		"SERVICE=WMS":                nil,
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/wms?"+query, nil))
+		if got != want {
+			t.Errorf("%s: wms.request = %v, want %v", query, got, want)
+		}
+	}
+}
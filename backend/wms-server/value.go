@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxValuePoints caps a POST /value batch
+const maxValuePoints = 1000
+
+// valuePoint is one /value query. Layer falls back to the layer query
+// param; time is RFC3339 and optional like elevation.
+type valuePoint struct {
+	Layer     string  `json:"layer,omitempty"`
+	Lon       float64 `json:"lon"`
+	Lat       float64 `json:"lat"`
+	Time      string  `json:"time,omitempty"`
+	Elevation string  `json:"elevation,omitempty"`
+}
+
+// valueResult is the answer for one point; Error is set instead of Value
+// when that point failed
+type valueResult struct {
+	Layer string   `json:"layer"`
+	Lon   float64  `json:"lon"`
+	Lat   float64  `json:"lat"`
+	Time  string   `json:"time,omitempty"`
+	Value *float64 `json:"value"`
+	Units string   `json:"units,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+// valueHandler is GetFeatureInfo without the WMS ceremony, for scripts:
+// GET /value?layer=&lon=&lat=&time=&elevation= returns one value, and a
+// POSTed JSON array of points returns an array of results in the same order
+func valueHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	if r.Method == http.MethodPost {
+		var points []valuePoint
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(config().MaxPostBodyKB)*1024))
+		if err := dec.Decode(&points); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeJSONException(w, http.StatusRequestEntityTooLarge, "InvalidRequest",
+					fmt.Sprintf("body exceeds %d KB", config().MaxPostBodyKB))
+				return
+			}
+			writeJSONException(w, http.StatusBadRequest, "InvalidRequest", "body must be a JSON array of {layer, lon, lat, time, elevation}")
+			return
+		}
+		if len(points) > maxValuePoints {
+			writeJSONException(w, http.StatusBadRequest, "InvalidRequest",
+				fmt.Sprintf("%d points requested, maximum is %d", len(points), maxValuePoints))
+			return
+		}
+		results := make([]valueResult, len(points))
+		sem := make(chan struct{}, seriesConcurrency)
+		var wg sync.WaitGroup
+		for i, p := range points {
+			if p.Layer == "" {
+				p.Layer = qs.Get("layer")
+			}
+			wg.Add(1)
+			go func(i int, p valuePoint) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				res, _, err := pointResult(r, p)
+				if err != nil {
+					res.Error = err.Error()
+				}
+				results[i] = res
+			}(i, p)
+		}
+		wg.Wait()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+		return
+	}
+
+	p := valuePoint{Layer: qs.Get("layer"), Time: qs.Get("time"), Elevation: qs.Get("elevation")}
+	var err1, err2 error
+	p.Lon, err1 = strconv.ParseFloat(qs.Get("lon"), 64)
+	p.Lat, err2 = strconv.ParseFloat(qs.Get("lat"), 64)
+	if err1 != nil || err2 != nil {
+		writeJSONException(w, http.StatusBadRequest, "InvalidPoint", "lon and lat are required numbers")
+		return
+	}
+	res, code, err := pointResult(r, p)
+	if err != nil {
+		status := http.StatusBadRequest
+		switch code {
+		case "LayerNotDefined":
+			status = http.StatusNotFound
+		case "NoApplicableCode":
+			status = http.StatusBadGateway
+		}
+		writeJSONException(w, status, code, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// pointResult validates and runs one point query. On failure code is the
+// exception code to report it with.
+func pointResult(r *http.Request, p valuePoint) (valueResult, string, error) {
+	res := valueResult{Layer: p.Layer, Lon: p.Lon, Lat: p.Lat, Time: p.Time}
+	if p.Layer == "" {
+		return res, "MissingParameterValue", fmt.Errorf("layer is required")
+	}
+	if _, ok := layerIndex.Layer(p.Layer); !ok {
+		return res, "LayerNotDefined", fmt.Errorf("no data for layer %q", p.Layer)
+	}
+	if p.Lat < -90 || p.Lat > 90 || p.Lon < -180 || p.Lon > 360 {
+		return res, "InvalidPoint", fmt.Errorf("lon/lat %g,%g is out of range", p.Lon, p.Lat)
+	}
+	var t time.Time
+	if p.Time != "" {
+		var err error
+		if t, err = time.Parse(time.RFC3339, p.Time); err != nil {
+			return res, "InvalidDimensionValue", fmt.Errorf("invalid time %q, expected RFC3339", p.Time)
+		}
+	}
+
+	pv, err := queryPointValue(r.Context(), p.Layer, "", p.Elevation, p.Lon, p.Lat, t)
+	if err != nil {
+		log.Printf("Point query failed for %s: %v", p.Layer, err)
+		return res, "NoApplicableCode", err
+	}
+	res.Value = roundValue(pv.Value, featureInfoDecimals(p.Layer))
+	res.Units = pv.Units
+	if pv.Time != "" {
+		res.Time = pv.Time
+	}
+	return res, "", nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Tiles are 256px squares of the Web Mercator (GoogleMapsCompatible) grid
+const (
+	tileSize       = 256
+	mercatorExtent = 20037508.342789244
+	maxTileZoom    = 24
+)
+
+// wmtsTileHandler serves /wmts/{layer}/{time}/{z}/{x}/{y}.png. Pre-rendered
+// tiles under TILE_CACHE_DIR are served as-is; otherwise the tile is
+// rendered on demand (and written back when TILE_CACHE_WRITE is set).
+// {time} is an RFC3339 timestamp, or "latest" for the processor default.
+func wmtsTileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	layer, timeSeg := vars["layer"], vars["time"]
+	z, _ := strconv.Atoi(vars["z"])
+	x, _ := strconv.Atoi(vars["x"])
+	y, _ := strconv.Atoi(vars["y"])
+	if z > maxTileZoom || x >= 1<<z || y >= 1<<z {
+		http.Error(w, "tile coordinates out of range", http.StatusBadRequest)
+		return
+	}
+	if timeSeg != "latest" {
+		if _, err := time.Parse(time.RFC3339, timeSeg); err != nil {
+			http.Error(w, "invalid time, expected RFC3339 or latest", http.StatusBadRequest)
+			return
+		}
+	}
+
+	overlay := debugBorders(r.URL.Query().Get("debug"))
+	var diskPath string
+	if config().TileCacheDir != "" {
+		p, err := tileCachePath(config().TileCacheDir, layer, timeSeg, z, x, y)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		diskPath = p
+		// Overlaid tiles always render so the label is drawn
+		if f, err := os.Open(diskPath); err == nil && !overlay {
+			defer f.Close()
+			if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+				w.Header().Set("Content-Type", "image/png")
+				w.Header().Set("X-Tile-Source", "disk")
+				http.ServeContent(w, r, "", fi.ModTime(), f)
+				return
+			}
+		}
+	}
+
+	timing := newServerTiming()
+	v := tileParams(layer, timeSeg, z, x, y)
+	timing.phase("param-parse")
+
+	entry, ok := renderCached(w, r, nil, v, tileSize, tileSize, timing)
+	if !ok {
+		return
+	}
+	// "latest" moves with each model run, so only pinned times are persisted
+	if diskPath != "" && config().TileCacheWrite && timeSeg != "latest" &&
+		w.Header().Get("X-Render-Degraded") == "" && entry.ContentType == "image/png" {
+		if err := writeFileAtomic(diskPath, entry.Body); err != nil {
+			log.Printf("Tile cache write failed for %s: %v", diskPath, err)
+		}
+	}
+	if overlay {
+		minx, miny, maxx, maxy := bboxToLonLat(tileBBox(z, x, y), "EPSG:3857")
+		label := []string{fmt.Sprintf("%d/%d/%d", z, x, y), fmt.Sprintf("%.3f,%.3f,%.3f,%.3f", minx, miny, maxx, maxy), fmt.Sprintf("%dx%d", tileSize, tileSize)}
+		var err error
+		if entry, err = drawTileBorder(entry, label); err != nil {
+			http.Error(w, fmt.Sprintf("drawing debug overlay: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Server-Timing", timing.header())
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("X-Tile-Source", "render")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(entry.Body))
+}
+
+// tileParams are the processor params for tile z/x/y, shared with autowarm
+// so warmed tiles land on the same cache keys
+func tileParams(layer, timeSeg string, z, x, y int) url.Values {
+	minx, miny, maxx, maxy := bboxToLonLat(tileBBox(z, x, y), "EPSG:3857")
+	v := url.Values{}
+	v.Set("layer", layer)
+	v.Set("width", strconv.Itoa(tileSize))
+	v.Set("height", strconv.Itoa(tileSize))
+	v.Set("bbox", fmt.Sprintf("%f,%f,%f,%f", minx, miny, maxx, maxy))
+	if timeSeg != "latest" {
+		v.Set("time", timeSeg)
+	}
+	withGutter(v, config().TileGutter)
+	return v
+}
+
+// tileBBox returns the EPSG:3857 bounds of XYZ tile z/x/y
+func tileBBox(z, x, y int) [4]float64 {
+	size := 2 * mercatorExtent / float64(int(1)<<z)
+	minx := -mercatorExtent + float64(x)*size
+	maxy := mercatorExtent - float64(y)*size
+	return [4]float64{minx, maxy - size, minx + size, maxy}
+}
+
+// tileCachePath builds <dir>/<layer>/<time>/<z>/<x>/<y>.png, refusing
+// segments that could escape the cache directory
+func tileCachePath(dir, layer, timeSeg string, z, x, y int) (string, error) {
+	for _, seg := range []string{layer, timeSeg} {
+		if seg == "" || seg == "." || seg == ".." || strings.ContainsAny(seg, `/\`) || strings.Contains(seg, "\x00") {
+			return "", fmt.Errorf("invalid tile path segment %q", seg)
+		}
+	}
+	root := filepath.Clean(dir)
+	p := filepath.Join(root, layer, timeSeg, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".png")
+	if !strings.HasPrefix(p, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid tile path")
+	}
+	return p, nil
+}
+
+// writeFileAtomic writes data via a temp file and rename so readers never
+// see a partial tile
+func writeFileAtomic(p string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tile-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}